@@ -0,0 +1,355 @@
+package minke
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// annAccessLog disables access logging for an Ingress when set to "false".
+var annAccessLog = annPrefix + "access-log"
+
+// annAccessLogSample sets the ratio of requests to an Ingress that are
+// logged, between 0 and 1, overriding the global sampling ratio.
+var annAccessLogSample = annPrefix + "access-log-sample"
+
+// Access log formats, any other format is treated as a template.
+const (
+	AccessLogJSON     = "json"
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+)
+
+// statusClientClosed is logged for requests the client gave up on before
+// we responded, as nginx does.
+const statusClientClosed = 499
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// WithAccessLogFormat is an option for setting the format of the access
+// log, one of "json", "common", "combined" (the default), or a template
+// using the $variables listed in accessLogEntry.vars.
+func WithAccessLogFormat(format string) Option {
+	return func(c *Controller) error {
+		if format != "" {
+			c.accessLogFormat = format
+		}
+		return nil
+	}
+}
+
+// WithAccessLogSampling is an option for setting the ratio of requests
+// that are logged, between 0 and 1.
+func WithAccessLogSampling(ratio float64) Option {
+	return func(c *Controller) error {
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("access log sampling ratio must be between 0 and 1, got %v", ratio)
+		}
+		c.accessLogSample = ratio
+		return nil
+	}
+}
+
+// accessLogPolicy overrides the global access log settings for an Ingress.
+type accessLogPolicy struct {
+	disabled bool
+	sample   *float64
+}
+
+func (alp *accessLogPolicy) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{
+		"enabled": !alp.disabled,
+	}
+	if alp.sample != nil {
+		strmap["sample"] = *alp.sample
+	}
+	return json.Marshal(strmap)
+}
+
+// parseAccessLogPolicy reads the access log annotations, nil is returned
+// if neither is set.
+func parseAccessLogPolicy(anns map[string]string) (*accessLogPolicy, error) {
+	var alp *accessLogPolicy
+	if str, ok := anns[annAccessLog]; ok {
+		enabled, err := strconv.ParseBool(strings.TrimSpace(str))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s, should be true or false", str, annAccessLog)
+		}
+		alp = &accessLogPolicy{disabled: !enabled}
+	}
+	if str, ok := anns[annAccessLogSample]; ok {
+		sample, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil || sample < 0 || sample > 1 {
+			return nil, fmt.Errorf("invalid value %q for %s, should be a number between 0 and 1", str, annAccessLogSample)
+		}
+		if alp == nil {
+			alp = &accessLogPolicy{}
+		}
+		alp.sample = &sample
+	}
+	return alp, nil
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cb *countingBody) Read(b []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(b)
+	cb.n += int64(n)
+	return n, err
+}
+
+// accessLogEntry holds the details of a request for the access log.
+type accessLogEntry struct {
+	time             time.Time
+	clientIP         string
+	method           string
+	host             string
+	requestURI       string
+	path             string
+	proto            string
+	status           int
+	bytesIn          int64
+	bytesOut         int64
+	duration         time.Duration
+	upstreamDuration time.Duration
+	ingress          string
+	rule             string
+	service          string
+	endpoint         string
+	tlsVersion       string
+	tlsCipher        string
+	traceID          string
+	referer          string
+	userAgent        string
+}
+
+func (c *Controller) newAccessLogEntry(st *requestState, req *http.Request, rec *responseRecorder, body *countingBody, start time.Time) *accessLogEntry {
+	e := &accessLogEntry{
+		time:             start,
+		clientIP:         clientIP(req),
+		method:           req.Method,
+		host:             req.Host,
+		requestURI:       req.RequestURI,
+		path:             req.URL.Path,
+		proto:            req.Proto,
+		status:           rec.status,
+		bytesOut:         rec.bytes,
+		duration:         time.Since(start),
+		upstreamDuration: st.upstreamDuration,
+		referer:          req.Referer(),
+		userAgent:        req.UserAgent(),
+	}
+	if e.status == 0 {
+		e.status = http.StatusOK
+		if req.Context().Err() != nil {
+			e.status = statusClientClosed
+		}
+	}
+	if body != nil {
+		e.bytesIn = body.n
+	}
+	if st.ingress != nil {
+		e.ingress = st.ingress.namespace + "/" + st.ingress.name
+	}
+	if st.rule != nil {
+		e.rule = st.rule.host + st.rule.path
+	}
+	if st.backend.name != "" {
+		e.service = st.backend.namespace + "/" + st.backend.name + ":" + st.backend.portName
+	}
+	if st.endpoint.addr != "" {
+		e.endpoint = st.endpoint.addr + ":" + strconv.Itoa(st.endpoint.port)
+	}
+	if req.TLS != nil {
+		e.tlsVersion = tlsVersionName(req.TLS.Version)
+		e.tlsCipher = tls.CipherSuiteName(req.TLS.CipherSuite)
+	}
+	if sc := trace.SpanFromContext(req.Context()).SpanContext(); sc.TraceID.IsValid() {
+		e.traceID = sc.TraceID.String()
+	}
+	return e
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// protocol gives the short name of the HTTP version, h1, h2 or h3.
+func (e *accessLogEntry) protocol() string {
+	switch {
+	case strings.HasPrefix(e.proto, "HTTP/3"):
+		return "h3"
+	case strings.HasPrefix(e.proto, "HTTP/2"):
+		return "h2"
+	default:
+		return "h1"
+	}
+}
+
+// vars provides the variables available to access log templates.
+func (e *accessLogEntry) vars(name string) string {
+	switch name {
+	case "$":
+		return "$"
+	case "time":
+		return e.time.Format(time.RFC3339Nano)
+	case "time_local":
+		return e.time.Format(clfTimeFormat)
+	case "client_ip":
+		return e.clientIP
+	case "method":
+		return e.method
+	case "host":
+		return e.host
+	case "request_uri":
+		return e.requestURI
+	case "path":
+		return e.path
+	case "proto":
+		return e.proto
+	case "protocol":
+		return e.protocol()
+	case "status":
+		return strconv.Itoa(e.status)
+	case "bytes_in":
+		return strconv.FormatInt(e.bytesIn, 10)
+	case "bytes_out":
+		return strconv.FormatInt(e.bytesOut, 10)
+	case "duration":
+		return strconv.FormatFloat(e.duration.Seconds(), 'f', 6, 64)
+	case "upstream_duration":
+		return strconv.FormatFloat(e.upstreamDuration.Seconds(), 'f', 6, 64)
+	case "ingress":
+		return e.ingress
+	case "rule":
+		return e.rule
+	case "service":
+		return e.service
+	case "endpoint":
+		return e.endpoint
+	case "tls_version":
+		return e.tlsVersion
+	case "tls_cipher":
+		return e.tlsCipher
+	case "trace_id":
+		return e.traceID
+	case "referer":
+		return e.referer
+	case "user_agent":
+		return e.userAgent
+	}
+	return ""
+}
+
+func (e *accessLogEntry) json() string {
+	strmap := map[string]interface{}{
+		"time":      e.time.Format(time.RFC3339Nano),
+		"client_ip": e.clientIP,
+		"method":    e.method,
+		"host":      e.host,
+		"path":      e.path,
+		"protocol":  e.protocol(),
+		"status":    e.status,
+		"bytes_in":  e.bytesIn,
+		"bytes_out": e.bytesOut,
+		"duration":  e.duration.Seconds(),
+	}
+	optional := map[string]string{
+		"request_uri": e.requestURI,
+		"ingress":     e.ingress,
+		"rule":        e.rule,
+		"service":     e.service,
+		"endpoint":    e.endpoint,
+		"tls_version": e.tlsVersion,
+		"tls_cipher":  e.tlsCipher,
+		"trace_id":    e.traceID,
+		"referer":     e.referer,
+		"user_agent":  e.userAgent,
+	}
+	for k, v := range optional {
+		if v != "" {
+			strmap[k] = v
+		}
+	}
+	if e.upstreamDuration != 0 {
+		strmap["upstream_duration"] = e.upstreamDuration.Seconds()
+	}
+	bs, _ := json.Marshal(strmap)
+	return string(bs)
+}
+
+// common formats the entry in the Common Log Format.
+func (e *accessLogEntry) common() string {
+	bytes := "-"
+	if e.bytesOut > 0 {
+		bytes = strconv.FormatInt(e.bytesOut, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s",
+		e.clientIP,
+		e.time.Format(clfTimeFormat),
+		strconv.Quote(e.method+" "+e.requestURI+" "+e.proto),
+		e.status,
+		bytes)
+}
+
+// combined formats the entry in the Combined Log Format.
+func (e *accessLogEntry) combined() string {
+	return fmt.Sprintf("%s %s %s", e.common(), strconv.Quote(e.referer), strconv.Quote(e.userAgent))
+}
+
+func (e *accessLogEntry) format(format string) string {
+	switch format {
+	case AccessLogJSON:
+		return e.json()
+	case AccessLogCommon:
+		return e.common()
+	case AccessLogCombined:
+		return e.combined()
+	default:
+		return os.Expand(format, e.vars)
+	}
+}
+
+// logAccess writes the access log entry for a request, subject to the
+// sampling settings.
+func (c *Controller) logAccess(st *requestState, req *http.Request, rec *responseRecorder, body *countingBody, start time.Time) {
+	sample := c.accessLogSample
+	if st.ingress != nil && st.ingress.accessLog != nil {
+		if st.ingress.accessLog.disabled {
+			return
+		}
+		if st.ingress.accessLog.sample != nil {
+			sample = *st.ingress.accessLog.sample
+		}
+	}
+	if sample < 1 && rand.Float64() >= sample {
+		return
+	}
+
+	e := c.newAccessLogEntry(st, req, rec, body, start)
+	c.accessLogFunc("%s", e.format(c.accessLogFormat))
+}
@@ -0,0 +1,271 @@
+package minke
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/export/trace/tracetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseAccessLogPolicy(t *testing.T) {
+	half := 0.5
+	tests := []struct {
+		name   string
+		anns   map[string]string
+		exp    *accessLogPolicy
+		expErr bool
+	}{
+		{
+			name: "none",
+			anns: map[string]string{},
+		},
+		{
+			name: "disabled",
+			anns: map[string]string{annAccessLog: "false"},
+			exp:  &accessLogPolicy{disabled: true},
+		},
+		{
+			name: "sampled",
+			anns: map[string]string{annAccessLogSample: "0.5"},
+			exp:  &accessLogPolicy{sample: &half},
+		},
+		{
+			name:   "bad bool",
+			anns:   map[string]string{annAccessLog: "nope"},
+			expErr: true,
+		},
+		{
+			name:   "sample out of range",
+			anns:   map[string]string{annAccessLogSample: "2"},
+			expErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alp, err := parseAccessLogPolicy(tt.anns)
+			if err != nil {
+				if !tt.expErr {
+					t.Fatalf("unexpected error, %v", err)
+				}
+				return
+			}
+			if tt.expErr {
+				t.Fatalf("expected error")
+			}
+			if (alp == nil) != (tt.exp == nil) {
+				t.Fatalf("expected %v, got %v", tt.exp, alp)
+			}
+			if alp == nil {
+				return
+			}
+			if alp.disabled != tt.exp.disabled {
+				t.Errorf("expected disabled %v, got %v", tt.exp.disabled, alp.disabled)
+			}
+			if (alp.sample == nil) != (tt.exp.sample == nil) || (alp.sample != nil && *alp.sample != *tt.exp.sample) {
+				t.Errorf("expected sample %v, got %v", tt.exp.sample, alp.sample)
+			}
+		})
+	}
+}
+
+func TestAccessLogEntry_format(t *testing.T) {
+	e := &accessLogEntry{
+		time:       time.Date(2020, 12, 10, 13, 55, 36, 0, time.UTC),
+		clientIP:   "192.0.2.1",
+		method:     "GET",
+		host:       "example.com",
+		requestURI: "/index.html?q=1",
+		path:       "/index.html",
+		proto:      "HTTP/2.0",
+		status:     200,
+		bytesOut:   2326,
+		ingress:    "default/web",
+		service:    "default/app:http",
+		endpoint:   "10.0.0.1:8080",
+		referer:    "http://example.com/start.html",
+		userAgent:  "Mozilla/4.08",
+	}
+
+	tests := []struct {
+		format string
+		exp    string
+	}{
+		{
+			format: AccessLogCommon,
+			exp:    `192.0.2.1 - - [10/Dec/2020:13:55:36 +0000] "GET /index.html?q=1 HTTP/2.0" 200 2326`,
+		},
+		{
+			format: AccessLogCombined,
+			exp:    `192.0.2.1 - - [10/Dec/2020:13:55:36 +0000] "GET /index.html?q=1 HTTP/2.0" 200 2326 "http://example.com/start.html" "Mozilla/4.08"`,
+		},
+		{
+			format: "$protocol $host $status $ingress -> $endpoint $$",
+			exp:    "h2 example.com 200 default/web -> 10.0.0.1:8080 $",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if got := e.format(tt.format); got != tt.exp {
+				t.Fatalf("expected\n%s\ngot\n%s", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	ingress := func(name, host string, anns map[string]string) *networkingv1beta1.Ingress {
+		annotations := map[string]string{
+			"kubernetes.io/ingress.class":        "minke",
+			"ingress.kubernetes.io/ssl-redirect": "false",
+		}
+		for k, v := range anns {
+			annotations[k] = v
+		}
+		return &networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Annotations: annotations,
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: host,
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "app",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		ingress("logged", "logged", nil),
+		ingress("quiet", "quiet", map[string]string{annAccessLog: "false"}),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		},
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "http", Port: int32(port)}},
+				},
+			},
+		},
+	)
+
+	var mu sync.Mutex
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(tracetest.NewInMemoryExporter()))
+
+	ctrl, err := New(clientset,
+		WithAccessLogFunc(logf),
+		WithAccessLogFormat(AccessLogJSON),
+		WithTracer(tp.Tracer("minke")),
+	)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	for _, host := range []string{"logged", "quiet"} {
+		req, _ := http.NewRequest("POST", pts.URL+"/hello?x=1", strings.NewReader("some data"))
+		req.Host = host
+		resp, err := pts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 log line, got %d, %q", len(lines), lines)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("could not parse log line %q, %v", lines[0], err)
+	}
+
+	exp := map[string]interface{}{
+		"client_ip":   "127.0.0.1",
+		"method":      "POST",
+		"host":        "logged",
+		"path":        "/hello",
+		"request_uri": "/hello?x=1",
+		"protocol":    "h1",
+		"status":      float64(200),
+		"bytes_in":    float64(9),
+		"bytes_out":   float64(5),
+		"ingress":     "default/logged",
+		"service":     "default/app:http",
+		"endpoint":    u.Host,
+	}
+	for k, v := range exp {
+		if got[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, got[k])
+		}
+	}
+	for _, k := range []string{"duration", "upstream_duration", "trace_id"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("expected %s to be logged", k)
+		}
+	}
+}
@@ -0,0 +1,848 @@
+package minke
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// annACME requests that certificates for the TLS secrets of an ingress
+// are issued by our ACME client.
+var annACME = annPrefix + "acme"
+
+const (
+	// ACMEChallengeHTTP01 answers challenges on the plain HTTP listener.
+	ACMEChallengeHTTP01 = "http-01"
+	// ACMEChallengeTLSALPN01 answers challenges during the TLS handshake,
+	// the TLS listener must include acme.ALPNProto in its NextProtos.
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeAccountKey    = "account.key"
+
+	acmeTimeout        = 5 * time.Minute
+	acmeChallengeDelay = 10 * time.Second
+	acmeMinBackoff     = time.Minute
+	acmeMaxBackoff     = 6 * time.Hour
+)
+
+// WithACME is an option for enabling certificate issuance from an ACME
+// directory, such as Let's Encrypt, for ingresses with the acme annotation.
+// The account key and any pending challenges are kept in accountSecret, in
+// the form of NAMESPACE/NAME, which all replicas must be able to read.
+func WithACME(directory, email, accountSecret string) Option {
+	return func(c *Controller) error {
+		if directory == "" {
+			return nil
+		}
+		parts := strings.SplitN(accountSecret, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("acme account secret should be in the form of NAMESPACE/NAME")
+		}
+		c.acmeDirectory = directory
+		c.acmeEmail = email
+		c.acmeAccount = secretKey{namespace: parts[0], name: parts[1]}
+		return nil
+	}
+}
+
+// WithACMEChallenges is an option for setting the ACME challenge types we
+// will attempt, in order of preference.
+func WithACMEChallenges(types ...string) Option {
+	return func(c *Controller) error {
+		c.acmeChallenges = nil
+		for _, t := range types {
+			t = strings.TrimSpace(t)
+			switch t {
+			case "":
+				continue
+			case ACMEChallengeHTTP01, ACMEChallengeTLSALPN01:
+				c.acmeChallenges = append(c.acmeChallenges, t)
+			default:
+				return fmt.Errorf("unknown acme challenge type %q", t)
+			}
+		}
+		return nil
+	}
+}
+
+// WithACMERenewBefore is an option for setting how long before expiry
+// certificates are renewed. At most a third of a certificate's lifetime is
+// used.
+func WithACMERenewBefore(d time.Duration) Option {
+	return func(c *Controller) error {
+		c.acmeRenewBefore = d
+		return nil
+	}
+}
+
+// acmeManager obtains and renews certificates for the TLS secrets of
+// ingresses that ask for them. Only the leader places orders, but any
+// replica may be asked to answer a challenge, so challenges are shared
+// through the account secret.
+type acmeManager struct {
+	c           *Controller
+	directory   string
+	email       string
+	account     secretKey
+	challenges  []string
+	renewBefore time.Duration
+	queue       workqueue.DelayingInterface
+
+	clientMu sync.Mutex
+	client   *acme.Client // our registered account, only used by the leader
+
+	mu        sync.RWMutex
+	certs     map[secretKey]*acmeCert
+	responder *acme.Client            // computes challenge responses from the account key
+	http01    map[string]string       // tokens to the domain they are for
+	tlsalpn01 map[string]acmeALPNCert // domains to challenge certificates
+
+	// the ingresses wanting a certificate in each secret
+	claims map[secretKey]map[ingressKey]acmeClaim
+}
+
+// acmeALPNCert is a tls-alpn-01 challenge certificate, and the token it
+// was created for.
+type acmeALPNCert struct {
+	token string
+	cert  *tls.Certificate
+}
+
+// acmeClaim is an ingress wanting a certificate in a secret.
+type acmeClaim struct {
+	ing   interface{}
+	hosts []string
+}
+
+// acmeCert is a certificate that one or more ingresses want us to issue,
+// ing is the first of them by namespace and name, events are recorded
+// against it.
+type acmeCert struct {
+	ing     interface{}
+	ingKey  ingressKey
+	hosts   []string
+	renewAt time.Time
+
+	failures int
+	retryAt  time.Time
+	err      error
+}
+
+// MarshalJSON lets us report the certificates we are managing
+func (m *acmeManager) MarshalJSON() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	certs := map[string]interface{}{}
+	for sec, ac := range m.certs {
+		strmap := map[string]interface{}{
+			"ingress": fmt.Sprintf("%s/%s", ac.ingKey.namespace, ac.ingKey.name),
+			"hosts":   ac.hosts,
+		}
+		if !ac.renewAt.IsZero() {
+			strmap["renewAt"] = ac.renewAt
+		}
+		if ac.err != nil {
+			strmap["error"] = ac.err.Error()
+			strmap["retryAt"] = ac.retryAt
+		}
+		certs[sec.String()] = strmap
+	}
+	strmap := map[string]interface{}{
+		"directory":  m.directory,
+		"account":    m.account.String(),
+		"challenges": m.challenges,
+		"certs":      certs,
+	}
+	return json.Marshal(strmap)
+}
+
+func (c *Controller) setupACMEProcess(ctx context.Context) error {
+	if c.acmeDirectory == "" {
+		return nil
+	}
+
+	challenges := c.acmeChallenges
+	if len(challenges) == 0 {
+		challenges = []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01}
+	}
+	renewBefore := c.acmeRenewBefore
+	if renewBefore == 0 {
+		renewBefore = 30 * 24 * time.Hour
+	}
+
+	c.acme = &acmeManager{
+		c:           c,
+		directory:   c.acmeDirectory,
+		email:       c.acmeEmail,
+		account:     c.acmeAccount,
+		challenges:  challenges,
+		renewBefore: renewBefore,
+		queue:       workqueue.NewNamedDelayingQueue("acme"),
+		certs:       map[secretKey]*acmeCert{},
+		claims:      map[secretKey]map[ingressKey]acmeClaim{},
+		http01:      map[string]string{},
+		tlsalpn01:   map[string]acmeALPNCert{},
+	}
+
+	// Items queued while we were not the leader will have been dropped.
+	c.leader.addTask(func(ctx context.Context) {
+		c.acme.enqueueAll()
+	})
+
+	return nil
+}
+
+// updateIngress replaces the certificates wanted by an ingress, passing
+// none removes them. Existing certificates are left in their secrets. If
+// several ingresses want a certificate in the same secret, it is issued
+// for all their hosts.
+func (m *acmeManager) updateIngress(obj interface{}, key ingressKey, certs map[secretKey][]string) {
+	if m == nil {
+		return
+	}
+
+	// Neither http-01 nor tls-alpn-01 can validate a wildcard, orders for
+	// them would fail forever.
+	wanted := map[secretKey][]string{}
+	for sec, hosts := range certs {
+		var valid, wild []string
+		for _, h := range hosts {
+			if strings.HasPrefix(h, "*") {
+				wild = append(wild, h)
+				continue
+			}
+			valid = append(valid, h)
+		}
+		if len(wild) > 0 {
+			klog.Errorf("cannot issue acme certificates for wildcard hosts %s in secret %s", strings.Join(wild, ", "), sec)
+			m.c.recordEventf(obj, corev1.EventTypeWarning, "ACMEWildcardHost", "cannot issue certificates for wildcard hosts %s in secret %s, they need a dns-01 challenge", strings.Join(wild, ", "), sec)
+		}
+		if len(valid) > 0 {
+			wanted[sec] = valid
+		}
+	}
+	certs = wanted
+
+	m.mu.Lock()
+	changed := map[secretKey]bool{}
+	for sec, cls := range m.claims {
+		if _, ok := cls[key]; ok {
+			if _, ok := certs[sec]; !ok {
+				delete(cls, key)
+				changed[sec] = true
+			}
+		}
+	}
+	for sec, hosts := range certs {
+		if m.claims[sec] == nil {
+			m.claims[sec] = map[ingressKey]acmeClaim{}
+		}
+		m.claims[sec][key] = acmeClaim{ing: obj, hosts: hosts}
+		changed[sec] = true
+	}
+	for sec := range changed {
+		m.updateCert(sec)
+	}
+	m.mu.Unlock()
+
+	for sec := range changed {
+		m.queue.Add(sec)
+	}
+}
+
+// updateCert brings the certificate for a secret in line with the
+// ingresses that want it. It must be called with mu held.
+func (m *acmeManager) updateCert(sec secretKey) {
+	cls := m.claims[sec]
+	if len(cls) == 0 {
+		delete(m.claims, sec)
+		delete(m.certs, sec)
+		return
+	}
+
+	var keys []ingressKey
+	seen := map[string]bool{}
+	var hosts []string
+	for k, cl := range cls {
+		keys = append(keys, k)
+		for _, h := range cl.hosts {
+			if !seen[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	ac, ok := m.certs[sec]
+	if !ok || strings.Join(ac.hosts, ",") != strings.Join(hosts, ",") {
+		ac = &acmeCert{hosts: hosts}
+		m.certs[sec] = ac
+	}
+	ac.ing = cls[keys[0]].ing
+	ac.ingKey = keys[0]
+}
+
+// manages reports if we issue the certificate for the given secret.
+func (m *acmeManager) manages(sec secretKey) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.certs[sec]
+	return ok
+}
+
+// enqueueAll requests that every certificate we manage is checked.
+func (m *acmeManager) enqueueAll() {
+	if m == nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for sec := range m.certs {
+		m.queue.Add(sec)
+	}
+}
+
+// run processes certificates until stopCh is closed. Orders are only
+// placed if we are the leader.
+func (m *acmeManager) run(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		m.queue.ShutDown()
+	}()
+
+	for m.processNextItem() {
+	}
+}
+
+func (m *acmeManager) processNextItem() bool {
+	key, quit := m.queue.Get()
+	if quit {
+		return false
+	}
+	defer m.queue.Done(key)
+
+	m.processItem(key.(secretKey))
+
+	return true
+}
+
+func (m *acmeManager) processItem(sec secretKey) {
+	if !m.c.IsLeader() {
+		return
+	}
+
+	m.mu.RLock()
+	ac, ok := m.certs[sec]
+	var hosts []string
+	var obj interface{}
+	var retryAt time.Time
+	if ok {
+		hosts, obj, retryAt = ac.hosts, ac.ing, ac.retryAt
+	}
+	m.mu.RUnlock()
+	if !ok || len(hosts) == 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Before(retryAt) {
+		// a retry is already scheduled
+		return
+	}
+
+	if cert, err := m.c.secs.getCert(sec); err == nil {
+		if renewAt, ok := m.renewAt(cert, hosts); ok && now.Before(renewAt) {
+			m.mu.Lock()
+			ac.renewAt = renewAt
+			m.mu.Unlock()
+			m.queue.AddAfter(sec, renewAt.Sub(now))
+			return
+		}
+	}
+
+	klog.Infof("requesting acme certificate for %s into secret %s", strings.Join(hosts, ", "), sec)
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	err := m.obtain(ctx, sec, hosts)
+
+	m.mu.Lock()
+	ac.err = err
+	if err != nil {
+		backoff := acmeMinBackoff << ac.failures
+		if backoff > acmeMaxBackoff || backoff <= 0 {
+			backoff = acmeMaxBackoff
+		}
+		ac.failures++
+		ac.retryAt = now.Add(backoff)
+		m.queue.AddAfter(sec, backoff)
+	} else {
+		ac.failures = 0
+		ac.retryAt = time.Time{}
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		klog.Errorf("failed obtaining acme certificate for secret %s, %v", sec, err)
+		m.c.recordEventf(obj, corev1.EventTypeWarning, "ACMEFailed", "failed obtaining certificate for %s, %v", strings.Join(hosts, ", "), err)
+		return
+	}
+	klog.Infof("stored acme certificate for %s in secret %s", strings.Join(hosts, ", "), sec)
+	m.c.recordEventf(obj, corev1.EventTypeNormal, "ACMEIssued", "issued certificate for %s into secret %s", strings.Join(hosts, ", "), sec)
+}
+
+// renewAt gives the time a certificate should be renewed, false is
+// returned if it does not cover all the hosts.
+func (m *acmeManager) renewAt(cert *tls.Certificate, hosts []string) (time.Time, bool) {
+	if cert.Leaf == nil {
+		return time.Time{}, false
+	}
+	for _, h := range hosts {
+		if cert.Leaf.VerifyHostname(h) != nil {
+			return time.Time{}, false
+		}
+	}
+	before := m.renewBefore
+	if third := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore) / 3; before > third {
+		before = third
+	}
+	return cert.Leaf.NotAfter.Add(-before), true
+}
+
+// obtain places an order for the hosts, answers its challenges, and
+// stores the resulting certificate in sec.
+func (m *acmeManager) obtain(ctx context.Context, sec secretKey, hosts []string) error {
+	client, err := m.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(hosts...))
+	if err != nil {
+		return fmt.Errorf("creating order, %w", err)
+	}
+
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, u); err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("waiting for order, %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hosts[0]},
+		DNSNames: hosts,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalizing order, %w", err)
+	}
+
+	return m.storeCert(ctx, sec, der, key)
+}
+
+// authorize answers one of the challenges of an authorization.
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	z, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("fetching authorization, %w", err)
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+	domain := z.Identifier.Value
+
+	var chal *acme.Challenge
+	for _, t := range m.challenges {
+		for _, c := range z.Challenges {
+			if c.Type == t {
+				chal = c
+				break
+			}
+		}
+		if chal != nil {
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no supported challenge offered for %s", domain)
+	}
+
+	var entry string
+	switch chal.Type {
+	case ACMEChallengeHTTP01:
+		entry = ACMEChallengeHTTP01 + "." + chal.Token
+	case ACMEChallengeTLSALPN01:
+		entry = ACMEChallengeTLSALPN01 + "." + domain
+	}
+
+	if err := m.updateAccountSecret(ctx, func(data map[string][]byte) {
+		switch chal.Type {
+		case ACMEChallengeHTTP01:
+			data[entry] = []byte(domain)
+		case ACMEChallengeTLSALPN01:
+			data[entry] = []byte(chal.Token)
+		}
+	}); err != nil {
+		return fmt.Errorf("storing %s challenge for %s, %w", chal.Type, domain, err)
+	}
+	defer func() {
+		err := m.updateAccountSecret(context.Background(), func(data map[string][]byte) {
+			delete(data, entry)
+		})
+		if err != nil {
+			klog.Errorf("failed removing acme challenge %s, %v", entry, err)
+		}
+	}()
+
+	// Give the replicas a chance to see the challenge before the CA
+	// tries to validate it.
+	m.waitChallenge(ctx, chal.Type, chal.Token, domain)
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accepting %s challenge for %s, %w", chal.Type, domain, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, z.URI); err != nil {
+		return fmt.Errorf("authorizing %s, %w", domain, err)
+	}
+	return nil
+}
+
+func (m *acmeManager) waitChallenge(ctx context.Context, typ, token, domain string) {
+	ctx, cancel := context.WithTimeout(ctx, acmeChallengeDelay)
+	defer cancel()
+	for {
+		m.mu.RLock()
+		var ok bool
+		switch typ {
+		case ACMEChallengeHTTP01:
+			_, ok = m.http01[token]
+		case ACMEChallengeTLSALPN01:
+			_, ok = m.tlsalpn01[domain]
+		}
+		m.mu.RUnlock()
+		if ok {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// getClient returns a client for our ACME account, creating the account
+// key and registering the account if needed.
+func (m *acmeManager) getClient(ctx context.Context) (*acme.Client, error) {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.directory,
+		UserAgent:    "minke",
+	}
+	acct := &acme.Account{}
+	if m.email != "" {
+		acct.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("registering acme account, %w", err)
+	}
+
+	m.client = client
+	return client, nil
+}
+
+// accountKey reads our account key from the account secret, a new key is
+// created if there is not one.
+func (m *acmeManager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	var key crypto.Signer
+	err := m.updateAccountSecret(ctx, func(data map[string][]byte) {
+		if existing, err := parseACMEAccountKey(data[acmeAccountKey]); err == nil {
+			key = existing
+			return
+		}
+		newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return
+		}
+		der, err := x509.MarshalECPrivateKey(newKey)
+		if err != nil {
+			return
+		}
+		klog.Infof("creating acme account key in secret %s", m.account)
+		data[acmeAccountKey] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		key = newKey
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading acme account secret %s, %w", m.account, err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("could not create acme account key")
+	}
+	return key, nil
+}
+
+func parseACMEAccountKey(bs []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// updateAccountSecret applies f to the data of the account secret, the
+// secret is created if it does not exist. The secret is only written if
+// f changes it.
+func (m *acmeManager) updateAccountSecret(ctx context.Context, f func(map[string][]byte)) error {
+	secrets := m.c.client.CoreV1().Secrets(m.account.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		sec, err := secrets.Get(ctx, m.account.name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			data := map[string][]byte{}
+			f(data)
+			_, err = secrets.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: m.account.namespace, Name: m.account.name},
+				Type:       corev1.SecretTypeOpaque,
+				Data:       data,
+			}, metav1.CreateOptions{})
+			if k8serrors.IsAlreadyExists(err) {
+				// let RetryOnConflict have another go
+				return k8serrors.NewConflict(corev1.Resource("secrets"), m.account.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		nsec := sec.DeepCopy()
+		if nsec.Data == nil {
+			nsec.Data = map[string][]byte{}
+		}
+		f(nsec.Data)
+		if secretDataEqual(sec.Data, nsec.Data) {
+			return nil
+		}
+		_, err = secrets.Update(ctx, nsec, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func secretDataEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || string(v) != string(bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// storeCert writes an issued certificate chain and its key to sec, any
+// other data in the secret is kept.
+func (m *acmeManager) storeCert(ctx context.Context, sec secretKey, der [][]byte, key *ecdsa.PrivateKey) error {
+	var crt []byte
+	for _, d := range der {
+		crt = append(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: d})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	secrets := m.c.client.CoreV1().Secrets(sec.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := secrets.Get(ctx, sec.name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			_, err = secrets.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: sec.namespace, Name: sec.name},
+				Type:       corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					corev1.TLSCertKey:       crt,
+					corev1.TLSPrivateKeyKey: keyPEM,
+				},
+			}, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		nsec := existing.DeepCopy()
+		if nsec.Data == nil {
+			nsec.Data = map[string][]byte{}
+		}
+		nsec.Data[corev1.TLSCertKey] = crt
+		nsec.Data[corev1.TLSPrivateKeyKey] = keyPEM
+		_, err = secrets.Update(ctx, nsec, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// accountSecretUpdated refreshes our view of the pending challenges, this
+// is called on every replica.
+func (m *acmeManager) accountSecretUpdated(sec *corev1.Secret) {
+	if m == nil || sec.Namespace != m.account.namespace || sec.Name != m.account.name {
+		return
+	}
+
+	var responder *acme.Client
+	if key, err := parseACMEAccountKey(sec.Data[acmeAccountKey]); err == nil {
+		responder = &acme.Client{Key: key}
+	}
+
+	m.mu.RLock()
+	oldALPN := m.tlsalpn01
+	m.mu.RUnlock()
+
+	http01 := map[string]string{}
+	tlsalpn01 := map[string]acmeALPNCert{}
+	for k, v := range sec.Data {
+		switch {
+		case strings.HasPrefix(k, ACMEChallengeHTTP01+"."):
+			http01[strings.TrimPrefix(k, ACMEChallengeHTTP01+".")] = string(v)
+		case strings.HasPrefix(k, ACMEChallengeTLSALPN01+"."):
+			if responder == nil {
+				continue
+			}
+			domain := strings.TrimPrefix(k, ACMEChallengeTLSALPN01+".")
+			if old, ok := oldALPN[domain]; ok && old.token == string(v) {
+				tlsalpn01[domain] = old
+				continue
+			}
+			cert, err := responder.TLSALPN01ChallengeCert(string(v), domain)
+			if err != nil {
+				klog.Errorf("failed creating tls-alpn-01 certificate for %s, %v", domain, err)
+				continue
+			}
+			tlsalpn01[domain] = acmeALPNCert{token: string(v), cert: &cert}
+		}
+	}
+
+	m.mu.Lock()
+	m.responder = responder
+	m.http01 = http01
+	m.tlsalpn01 = tlsalpn01
+	m.mu.Unlock()
+}
+
+// serveHTTP01 answers an http-01 challenge, false is returned if the
+// request is not for a challenge we know about.
+func (m *acmeManager) serveHTTP01(w http.ResponseWriter, req *http.Request) bool {
+	if m == nil || req.TLS != nil || !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return false
+	}
+	token := strings.TrimPrefix(req.URL.Path, acmeChallengePath)
+
+	m.mu.RLock()
+	_, ok := m.http01[token]
+	responder := m.responder
+	m.mu.RUnlock()
+	if !ok || responder == nil {
+		return false
+	}
+
+	resp, err := responder.HTTP01ChallengeResponse(token)
+	if err != nil {
+		klog.Errorf("failed answering http-01 challenge, %v", err)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(resp))
+	return true
+}
+
+// isChallengeHello reports whether a handshake is from a tls-alpn-01
+// validator, which offers only the acme-tls/1 protocol.
+func (m *acmeManager) isChallengeHello(info *tls.ClientHelloInfo) bool {
+	return m != nil && len(info.SupportedProtos) == 1 && info.SupportedProtos[0] == acme.ALPNProto
+}
+
+// getChallengeCertificate returns the tls-alpn-01 challenge certificate
+// for a handshake from an ACME validator, or nil if this is not one.
+func (m *acmeManager) getChallengeCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !m.isChallengeHello(info) {
+		return nil, nil
+	}
+
+	m.mu.RLock()
+	ac, ok := m.tlsalpn01[info.ServerName]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no tls-alpn-01 challenge for %q", info.ServerName)
+	}
+	return ac.cert, nil
+}
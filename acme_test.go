@@ -0,0 +1,678 @@
+package minke
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// acmeStandIn is a minimal RFC 8555 server in the style of Pebble. It
+// does not check request signatures, but does really validate challenges
+// against the addresses it is given. Domains starting with "http." are
+// only offered http-01, those starting with "tlsalpn." only tls-alpn-01.
+type acmeStandIn struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	httpAddr   string
+	tlsAddr    string
+	seq        int
+	accounts   map[string]bool
+	thumbprint string
+	orders     map[string]*standInOrder
+	authzs     map[string]*standInAuthz
+	validated  map[string]int
+}
+
+type standInOrder struct {
+	status      string
+	identifiers []string
+	authzs      []string
+	cert        []byte
+}
+
+type standInAuthz struct {
+	status     string
+	domain     string
+	challenges []*standInChallenge
+}
+
+type standInChallenge struct {
+	id     string
+	typ    string
+	token  string
+	status string
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating ca key, %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "minke test acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating ca, %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	s := &acmeStandIn{
+		t:         t,
+		ca:        ca,
+		caKey:     caKey,
+		accounts:  map[string]bool{},
+		orders:    map[string]*standInOrder{},
+		authzs:    map[string]*standInAuthz{},
+		validated: map[string]int{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *acmeStandIn) url(path string) string {
+	return s.srv.URL + path
+}
+
+func (s *acmeStandIn) nextID() string {
+	s.seq++
+	return fmt.Sprint(s.seq)
+}
+
+func (s *acmeStandIn) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce":   s.url("/nonce"),
+			"newAccount": s.url("/new-account"),
+			"newOrder":   s.url("/new-order"),
+			"revokeCert": s.url("/revoke"),
+			"keyChange":  s.url("/key-change"),
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		s.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	var protected struct {
+		JWK struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"jwk"`
+	}
+	bs, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	json.Unmarshal(bs, &protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	switch parts[0] {
+	case "new-account":
+		jwk := protected.JWK
+		canon := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+		sum := sha256.Sum256([]byte(canon))
+		s.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+		w.Header().Set("Location", s.url("/account/1"))
+		if s.accounts[s.thumbprint] {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			s.accounts[s.thumbprint] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "valid"})
+	case "new-order":
+		var req struct {
+			Identifiers []struct{ Type, Value string }
+		}
+		json.Unmarshal(payload, &req)
+		o := &standInOrder{status: acme.StatusPending}
+		for _, id := range req.Identifiers {
+			z := &standInAuthz{status: acme.StatusPending, domain: id.Value}
+			for _, typ := range []string{ACMEChallengeHTTP01, ACMEChallengeTLSALPN01} {
+				if strings.HasPrefix(id.Value, "http.") && typ != ACMEChallengeHTTP01 ||
+					strings.HasPrefix(id.Value, "tlsalpn.") && typ != ACMEChallengeTLSALPN01 {
+					continue
+				}
+				z.challenges = append(z.challenges, &standInChallenge{
+					id:     s.nextID(),
+					typ:    typ,
+					token:  fmt.Sprintf("token-%s-%d", s.nextID(), time.Now().UnixNano()),
+					status: acme.StatusPending,
+				})
+			}
+			zid := s.nextID()
+			s.authzs[zid] = z
+			o.identifiers = append(o.identifiers, id.Value)
+			o.authzs = append(o.authzs, zid)
+		}
+		oid := s.nextID()
+		s.orders[oid] = o
+		w.Header().Set("Location", s.url("/order/"+oid))
+		w.WriteHeader(http.StatusCreated)
+		s.writeOrder(w, oid)
+	case "order":
+		s.updateOrder(parts[1])
+		w.Header().Set("Location", s.url("/order/"+parts[1]))
+		s.writeOrder(w, parts[1])
+	case "authz":
+		z, ok := s.authzs[parts[1]]
+		if !ok {
+			s.problem(w, http.StatusNotFound, "malformed", "no such authorization")
+			return
+		}
+		var chals []interface{}
+		for _, c := range z.challenges {
+			chals = append(chals, s.challengeJSON(c))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     z.status,
+			"identifier": map[string]string{"type": "dns", "value": z.domain},
+			"challenges": chals,
+		})
+	case "challenge":
+		for _, z := range s.authzs {
+			for _, c := range z.challenges {
+				if c.id != parts[1] {
+					continue
+				}
+				if c.status == acme.StatusPending {
+					c.status = acme.StatusProcessing
+					go s.validate(z, c)
+				}
+				json.NewEncoder(w).Encode(s.challengeJSON(c))
+				return
+			}
+		}
+		s.problem(w, http.StatusNotFound, "malformed", "no such challenge")
+	case "finalize":
+		o, ok := s.orders[parts[1]]
+		s.updateOrder(parts[1])
+		if !ok || o.status != acme.StatusReady {
+			s.problem(w, http.StatusForbidden, "orderNotReady", "order is not ready")
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			s.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(s.seq + 100)),
+			Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca, csr.PublicKey, s.caKey)
+		if err != nil {
+			s.problem(w, http.StatusInternalServerError, "serverInternal", err.Error())
+			return
+		}
+		o.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})...)
+		o.status = acme.StatusValid
+		w.Header().Set("Location", s.url("/order/"+parts[1]))
+		s.writeOrder(w, parts[1])
+	case "cert":
+		o, ok := s.orders[parts[1]]
+		if !ok || o.cert == nil {
+			s.problem(w, http.StatusNotFound, "malformed", "no such certificate")
+			return
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(o.cert)
+	default:
+		s.problem(w, http.StatusNotFound, "malformed", "unknown resource")
+	}
+}
+
+func (s *acmeStandIn) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + typ,
+		"detail": detail,
+	})
+}
+
+func (s *acmeStandIn) challengeJSON(c *standInChallenge) map[string]string {
+	return map[string]string{
+		"type":   c.typ,
+		"url":    s.url("/challenge/" + c.id),
+		"token":  c.token,
+		"status": c.status,
+	}
+}
+
+func (s *acmeStandIn) updateOrder(id string) {
+	o, ok := s.orders[id]
+	if !ok || o.status != acme.StatusPending {
+		return
+	}
+	ready := true
+	for _, zid := range o.authzs {
+		switch s.authzs[zid].status {
+		case acme.StatusInvalid:
+			o.status = acme.StatusInvalid
+			return
+		case acme.StatusPending:
+			ready = false
+		}
+	}
+	if ready {
+		o.status = acme.StatusReady
+	}
+}
+
+func (s *acmeStandIn) writeOrder(w http.ResponseWriter, id string) {
+	o := s.orders[id]
+	var ids []interface{}
+	for _, v := range o.identifiers {
+		ids = append(ids, map[string]string{"type": "dns", "value": v})
+	}
+	var authzs []string
+	for _, zid := range o.authzs {
+		authzs = append(authzs, s.url("/authz/"+zid))
+	}
+	resp := map[string]interface{}{
+		"status":         o.status,
+		"identifiers":    ids,
+		"authorizations": authzs,
+		"finalize":       s.url("/finalize/" + id),
+	}
+	if o.cert != nil {
+		resp["certificate"] = s.url("/cert/" + id)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// validate checks a challenge the way a real CA would, by connecting to
+// the addresses minke is listening on.
+func (s *acmeStandIn) validate(z *standInAuthz, c *standInChallenge) {
+	s.mu.Lock()
+	keyAuth := c.token + "." + s.thumbprint
+	httpAddr, tlsAddr := s.httpAddr, s.tlsAddr
+	s.mu.Unlock()
+
+	var err error
+	switch c.typ {
+	case ACMEChallengeHTTP01:
+		err = validateHTTP01(httpAddr, z.domain, c.token, keyAuth)
+	case ACMEChallengeTLSALPN01:
+		err = validateTLSALPN01(tlsAddr, z.domain, keyAuth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.t.Logf("%s validation of %s failed, %v", c.typ, z.domain, err)
+		c.status = acme.StatusInvalid
+		z.status = acme.StatusInvalid
+		return
+	}
+	s.validated[c.typ]++
+	c.status = acme.StatusValid
+	z.status = acme.StatusValid
+}
+
+func validateHTTP01(addr, domain, token, keyAuth string) error {
+	req, _ := http.NewRequest("GET", "http://"+addr+acmeChallengePath+token, nil)
+	req.Host = domain
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("got %d %q, wanted %q", resp.StatusCode, body, keyAuth)
+	}
+	return nil
+}
+
+func validateTLSALPN01(addr, domain, keyAuth string) error {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true,
+		// With TLS 1.3 the client finishes the handshake before the
+		// server checks for a client certificate, we would not see the
+		// handshake being refused.
+		MaxVersion: tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cs := conn.ConnectionState()
+	if cs.NegotiatedProtocol != acme.ALPNProto {
+		return fmt.Errorf("negotiated %q", cs.NegotiatedProtocol)
+	}
+	leaf := cs.PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+	want := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil {
+			return err
+		}
+		if !ext.Critical || string(got) != string(want[:]) {
+			return fmt.Errorf("acmeIdentifier does not match")
+		}
+		return nil
+	}
+	return fmt.Errorf("no acmeIdentifier extension")
+}
+
+func TestACME(t *testing.T) {
+	standIn := newACMEStandIn(t)
+	defer standIn.srv.Close()
+
+	ingress := func(name, host, secret string, tlsHosts []string) *networkingv1beta1.Ingress {
+		return &networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": "minke",
+					annACME:                       "true",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				TLS: []networkingv1beta1.IngressTLS{
+					{Hosts: tlsHosts, SecretName: secret},
+				},
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: host,
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "app",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	// A certificate close to expiry should be renewed.
+	oldCrt, oldKey := testCertificate(t, []string{"renew.example.com"}, time.Now().Add(24*time.Hour))
+
+	// Requiring client certificates should not get in the way of
+	// tls-alpn-01 validation.
+	clientCA := newTestCA(t, "Client CA")
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "client-ca", Namespace: "default"},
+			Data:       map[string][]byte{"ca.crt": clientCA.pem},
+		},
+		ingress("http", "http.example.com", "http-cert", nil),
+		ingress("tlsalpn", "tlsalpn.example.com", "tlsalpn-cert", []string{"tlsalpn.example.com"}),
+		ingress("renew", "renew.example.com", "renew-cert", nil),
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "renew-cert", Namespace: "default"},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       oldCrt,
+				corev1.TLSPrivateKeyKey: oldKey,
+			},
+		},
+	)
+
+	ctrl, err := New(clientset,
+		WithACME(standIn.url("/dir"), "admin@example.com", "default/minke-acme"),
+		WithClientAuth("default/client-ca", ClientAuthRequire),
+	)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+
+	plain := httptest.NewServer(ctrl)
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(ctrl)
+	secure.TLS = &tls.Config{
+		GetCertificate: ctrl.GetCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+	}
+	ctrl.ConfigureServerTLS(secure.TLS)
+	secure.StartTLS()
+	defer secure.Close()
+
+	standIn.mu.Lock()
+	standIn.httpAddr = plain.Listener.Addr().String()
+	standIn.tlsAddr = secure.Listener.Addr().String()
+	standIn.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+
+	issued := func(name string) *x509.Certificate {
+		sec, err := clientset.CoreV1().Secrets("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil
+		}
+		block, _ := pem.Decode(sec.Data[corev1.TLSCertKey])
+		if block == nil {
+			return nil
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || leaf.Issuer.CommonName != standIn.ca.Subject.CommonName {
+			return nil
+		}
+		return leaf
+	}
+
+	hosts := map[string]string{
+		"http-cert":    "http.example.com",
+		"tlsalpn-cert": "tlsalpn.example.com",
+		"renew-cert":   "renew.example.com",
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for name, host := range hosts {
+		var leaf *x509.Certificate
+		for leaf == nil && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+			leaf = issued(name)
+		}
+		if leaf == nil {
+			t.Fatalf("no certificate was issued into %s", name)
+		}
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("certificate in %s, %v", name, err)
+		}
+	}
+
+	standIn.mu.Lock()
+	if standIn.validated[ACMEChallengeHTTP01] == 0 || standIn.validated[ACMEChallengeTLSALPN01] == 0 {
+		t.Errorf("expected both challenge types to be validated, got %v", standIn.validated)
+	}
+	standIn.mu.Unlock()
+
+	// The issued certificates should be served.
+	for _, host := range hosts {
+		var cert *tls.Certificate
+		for time.Now().Before(deadline) {
+			cert, _ = ctrl.GetCertificate(&tls.ClientHelloInfo{
+				ServerName:        host,
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				SupportedVersions: []uint16{tls.VersionTLS13},
+			})
+			if cert != nil && cert.Leaf.Issuer.CommonName == standIn.ca.Subject.CommonName {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if cert == nil || cert.Leaf.Issuer.CommonName != standIn.ca.Subject.CommonName {
+			t.Errorf("issued certificate for %s is not being served", host)
+		}
+	}
+
+	account, err := clientset.CoreV1().Secrets("default").Get(ctx, "minke-acme", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not read account secret, %v", err)
+	}
+	if _, err := parseACMEAccountKey(account.Data[acmeAccountKey]); err != nil {
+		t.Errorf("invalid account key, %v", err)
+	}
+	for k := range account.Data {
+		if k != acmeAccountKey {
+			t.Errorf("challenge %s was not cleaned up", k)
+		}
+	}
+}
+
+func TestACMEManager_updateIngress(t *testing.T) {
+	ctrl, err := New(fake.NewSimpleClientset(),
+		WithACME("https://acme.example.com/dir", "admin@example.com", "default/minke-acme"),
+	)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	ctrl.recorder = recorder
+	ctrl.leader.setLeader(true)
+
+	events := func() []string {
+		var reasons []string
+		for {
+			select {
+			case ev := <-recorder.Events:
+				reasons = append(reasons, strings.Fields(ev)[1])
+			default:
+				return reasons
+			}
+		}
+	}
+	hostsOf := func(sec secretKey) string {
+		ctrl.acme.mu.RLock()
+		defer ctrl.acme.mu.RUnlock()
+		if ac, ok := ctrl.acme.certs[sec]; ok {
+			return strings.Join(ac.hosts, ",")
+		}
+		return ""
+	}
+
+	obj := &networkingv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}}
+	key := ingressKey{namespace: "default", name: "app"}
+	mixed := secretKey{namespace: "default", name: "mixed"}
+	wild := secretKey{namespace: "default", name: "wild"}
+
+	// wildcards cannot be validated, so are left out of orders
+	ctrl.acme.updateIngress(obj, key, map[secretKey][]string{
+		mixed: {"*.example.com", "www.example.com"},
+		wild:  {"*.example.org"},
+	})
+	if got := hostsOf(mixed); got != "www.example.com" {
+		t.Errorf("expected only www.example.com to be ordered, got %q", got)
+	}
+	if ctrl.acme.manages(wild) {
+		t.Errorf("did not expect a secret with only wildcard hosts to be managed")
+	}
+	if got := strings.Join(events(), ","); got != "ACMEWildcardHost,ACMEWildcardHost" {
+		t.Errorf("expected an event for each secret with wildcards, got %s", got)
+	}
+
+	// ingresses sharing a secret get one certificate for all their hosts
+	shared := secretKey{namespace: "default", name: "shared"}
+	other := &networkingv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}}
+	otherKey := ingressKey{namespace: "default", name: "other"}
+	ctrl.acme.updateIngress(obj, key, map[secretKey][]string{shared: {"a.example.com"}})
+	ctrl.acme.updateIngress(other, otherKey, map[secretKey][]string{shared: {"b.example.com"}})
+	if got := hostsOf(shared); got != "a.example.com,b.example.com" {
+		t.Fatalf("expected the hosts of both ingresses, got %q", got)
+	}
+
+	// a resync of either leaves the order alone
+	ctrl.acme.mu.RLock()
+	ac := ctrl.acme.certs[shared]
+	ctrl.acme.mu.RUnlock()
+	ctrl.acme.updateIngress(obj, key, map[secretKey][]string{shared: {"a.example.com"}})
+	ctrl.acme.updateIngress(other, otherKey, map[secretKey][]string{shared: {"b.example.com"}})
+	ctrl.acme.mu.RLock()
+	same := ctrl.acme.certs[shared] == ac
+	ctrl.acme.mu.RUnlock()
+	if !same {
+		t.Errorf("expected the certificate to be left alone on resync")
+	}
+
+	ctrl.acme.updateIngress(nil, otherKey, nil)
+	if got := hostsOf(shared); got != "a.example.com" {
+		t.Errorf("expected only the remaining ingress's hosts, got %q", got)
+	}
+	ctrl.acme.updateIngress(nil, key, nil)
+	if ctrl.acme.manages(shared) || ctrl.acme.manages(mixed) {
+		t.Errorf("did not expect secrets without ingresses to be managed")
+	}
+}
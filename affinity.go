@@ -0,0 +1,99 @@
+package minke
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// annAffinityCookie enables cookie based session affinity, the value is
+// the name of the cookie to use. It can be set on an Ingress or a Service,
+// the Ingress takes precedence.
+var annAffinityCookie = annPrefix + "affinity-cookie"
+
+// WithAffinityKey is an option for setting the key used to sign session
+// affinity cookies. All replicas must use the same key for affinity to be
+// respected across them. If not set, a random key is used.
+func WithAffinityKey(key []byte) Option {
+	return func(c *Controller) error {
+		if len(key) != 0 {
+			c.affinityKey = key
+		}
+		return nil
+	}
+}
+
+func randomAffinityKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Controller) affinitySignature(backend serviceKey, addr string) string {
+	mac := hmac.New(sha256.New, c.affinityKey)
+	mac.Write([]byte(backend.String()))
+	mac.Write([]byte{0})
+	mac.Write([]byte(addr))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// affinityCookie creates a cookie naming the chosen endpoint, signed so
+// that clients cannot direct requests to arbitrary endpoints.
+func (c *Controller) affinityCookie(name string, backend serviceKey, addr serviceAddr, r *http.Request) *http.Cookie {
+	str := addr.String()
+	return &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(str)) + "." + c.affinitySignature(backend, str),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// affinityFromCookie returns the endpoint named in a valid affinity
+// cookie, if that endpoint is still present.
+func (c *Controller) affinityFromCookie(name string, backend serviceKey, r *http.Request) (serviceAddr, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return serviceAddr{}, false
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return serviceAddr{}, false
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return serviceAddr{}, false
+	}
+	str := string(bs)
+	if !hmac.Equal([]byte(parts[1]), []byte(c.affinitySignature(backend, str))) {
+		return serviceAddr{}, false
+	}
+
+	for _, addr := range c.eps.getActiveAddrs(backend) {
+		if addr.String() == str {
+			return addr, true
+		}
+	}
+
+	return serviceAddr{}, false
+}
@@ -0,0 +1,363 @@
+package minke
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// annBalancer selects the load balancing strategy, it can be set on an
+// Ingress or a Service, the Ingress takes precedence.
+var annBalancer = annPrefix + "load-balancer"
+
+// annEndpointWeights sets the weights used by the weighted-round-robin
+// strategy. It is set on a Service as a JSON object mapping pod names or
+// IPs to an integer weight, endpoints not listed have a weight of 1.
+var annEndpointWeights = annPrefix + "endpoint-weights"
+
+const (
+	balancerRoundRobin         = "round-robin"
+	balancerRandom             = "random"
+	balancerLeastOutstanding   = "least-outstanding"
+	balancerPowerOfTwo         = "power-of-two"
+	balancerWeightedRoundRobin = "weighted-round-robin"
+
+	defaultBalancer = balancerRoundRobin
+)
+
+// balancer picks an endpoint for a request from a set of addresses.
+type balancer interface {
+	// update is called when the set of addresses changes, state for
+	// addresses that are still present should be kept.
+	update(addrs []serviceAddr)
+	// pick selects an address for the request. The returned function
+	// must be called once the request is complete.
+	pick(r *http.Request) (serviceAddr, func())
+}
+
+// acquirer is implemented by balancers that track in flight requests, so
+// that requests sent to an address they did not pick, such as one pinned by
+// an affinity cookie, are counted too.
+type acquirer interface {
+	// acquire counts a request to addr. The returned function must be
+	// called once the request is complete.
+	acquire(addr serviceAddr) func()
+}
+
+// balancerSpec describes the balancer to use for a backend.
+type balancerSpec struct {
+	strategy      string
+	hashKey       string // used by the hashing strategies
+	topologyAware bool
+	topologySet   bool   // topologyAware was given explicitly
+	zone          string // our zone, if topology aware
+}
+
+func (bs balancerSpec) String() string {
+	str := bs.strategy
+	if bs.hashKey != "" {
+		str = fmt.Sprintf("%s(%s)", str, bs.hashKey)
+	}
+	if bs.topologyAware {
+		str += "+topology-aware"
+	}
+	return str
+}
+
+func (bs balancerSpec) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bs.String())
+}
+
+var balancers = map[string]func(balancerSpec) balancer{
+	balancerRoundRobin:         func(balancerSpec) balancer { return &roundRobinBalancer{} },
+	balancerRandom:             func(balancerSpec) balancer { return &randomBalancer{} },
+	balancerLeastOutstanding:   func(balancerSpec) balancer { return &leastOutstandingBalancer{} },
+	balancerPowerOfTwo:         func(balancerSpec) balancer { return &powerOfTwoBalancer{} },
+	balancerWeightedRoundRobin: func(balancerSpec) balancer { return &weightedRoundRobinBalancer{} },
+	balancerRingHash:           func(spec balancerSpec) balancer { return newHashBalancer(spec, buildRingHash) },
+	balancerMaglev:             func(spec balancerSpec) balancer { return newHashBalancer(spec, buildMaglev) },
+}
+
+func (bs balancerSpec) validate() error {
+	if _, ok := balancers[bs.strategy]; !ok {
+		return fmt.Errorf("unknown load balancer %q", bs.strategy)
+	}
+	switch bs.strategy {
+	case balancerRingHash, balancerMaglev:
+		if bs.hashKey == "" {
+			return fmt.Errorf("load balancer %q requires the %s annotation", bs.strategy, annHashKey)
+		}
+		if _, err := parseHashKey(bs.hashKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withDefaults fills in the settings that were not given explicitly from
+// those of the service, returning the spec to pick endpoints with.
+func (bs balancerSpec) withDefaults(svc balancerSpec, zone string) balancerSpec {
+	if bs.strategy == "" {
+		bs.strategy, bs.hashKey = svc.strategy, svc.hashKey
+	}
+	if bs.strategy == "" {
+		bs.strategy = defaultBalancer
+	}
+	if !bs.topologySet {
+		bs.topologyAware = svc.topologyAware
+	}
+	bs.topologySet = false
+	if bs.topologyAware {
+		bs.zone = zone
+	}
+	return bs
+}
+
+func newBalancer(spec balancerSpec) balancer {
+	f, ok := balancers[spec.strategy]
+	if !ok {
+		f = balancers[defaultBalancer]
+	}
+	if spec.topologyAware && spec.zone != "" {
+		return &zoneBalancer{zone: spec.zone, balancer: f(spec)}
+	}
+	return f(spec)
+}
+
+// parseBalancerAnnotations reads the load balancing settings from the
+// annotations of an Ingress or Service. Invalid settings are returned as
+// errors, and are ignored.
+func parseBalancerAnnotations(anns map[string]string) (balancerSpec, string, []error) {
+	var spec balancerSpec
+	var errs []error
+
+	if strategy, ok := anns[annBalancer]; ok {
+		spec = balancerSpec{
+			strategy: strategy,
+			hashKey:  anns[annHashKey],
+		}
+		if err := spec.validate(); err != nil {
+			errs = append(errs, err)
+			spec = balancerSpec{}
+		}
+	}
+
+	if v, ok := anns[annTopologyAware]; ok {
+		aware, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s value %q, %w", annTopologyAware, v, err))
+		} else {
+			spec.topologyAware = aware
+			spec.topologySet = true
+		}
+	}
+
+	affinity := anns[annAffinityCookie]
+	if affinity != "" && !validCookieName(affinity) {
+		errs = append(errs, fmt.Errorf("invalid affinity cookie name %q", affinity))
+		affinity = ""
+	}
+
+	return spec, affinity, errs
+}
+
+func noop() {}
+
+type roundRobinBalancer struct {
+	mu    sync.RWMutex
+	addrs []serviceAddr
+	index uint64
+}
+
+func (b *roundRobinBalancer) update(addrs []serviceAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = addrs
+}
+
+func (b *roundRobinBalancer) pick(*http.Request) (serviceAddr, func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.addrs) == 0 {
+		return serviceAddr{}, noop
+	}
+	count := atomic.AddUint64(&b.index, 1)
+	return b.addrs[count%uint64(len(b.addrs))], noop
+}
+
+type randomBalancer struct {
+	mu    sync.RWMutex
+	addrs []serviceAddr
+}
+
+func (b *randomBalancer) update(addrs []serviceAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = addrs
+}
+
+func (b *randomBalancer) pick(*http.Request) (serviceAddr, func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.addrs) == 0 {
+		return serviceAddr{}, noop
+	}
+	return b.addrs[rand.Intn(len(b.addrs))], noop
+}
+
+// outstanding tracks the number of in flight requests to each address,
+// counts for addresses that remain across updates are kept.
+type outstanding struct {
+	mu     sync.RWMutex
+	addrs  []serviceAddr
+	counts []*int64
+}
+
+func (o *outstanding) update(addrs []serviceAddr) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	old := make(map[string]*int64, len(o.addrs))
+	for i, a := range o.addrs {
+		old[a.String()] = o.counts[i]
+	}
+
+	counts := make([]*int64, len(addrs))
+	for i, a := range addrs {
+		if c, ok := old[a.String()]; ok {
+			counts[i] = c
+			continue
+		}
+		counts[i] = new(int64)
+	}
+
+	o.addrs = addrs
+	o.counts = counts
+}
+
+func (o *outstanding) start(i int) (serviceAddr, func()) {
+	c := o.counts[i]
+	atomic.AddInt64(c, 1)
+	return o.addrs[i], func() { atomic.AddInt64(c, -1) }
+}
+
+func (o *outstanding) acquire(addr serviceAddr) func() {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for i, a := range o.addrs {
+		if a.String() == addr.String() {
+			_, done := o.start(i)
+			return done
+		}
+	}
+	return noop
+}
+
+type leastOutstandingBalancer struct {
+	outstanding
+}
+
+func (b *leastOutstandingBalancer) pick(*http.Request) (serviceAddr, func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	n := len(b.addrs)
+	if n == 0 {
+		return serviceAddr{}, noop
+	}
+
+	// start at a random offset so that ties are spread out.
+	offset := rand.Intn(n)
+	best := offset
+	bestCount := atomic.LoadInt64(b.counts[offset])
+	for i := 1; i < n; i++ {
+		j := (offset + i) % n
+		if c := atomic.LoadInt64(b.counts[j]); c < bestCount {
+			best, bestCount = j, c
+		}
+	}
+
+	return b.start(best)
+}
+
+type powerOfTwoBalancer struct {
+	outstanding
+}
+
+func (b *powerOfTwoBalancer) pick(*http.Request) (serviceAddr, func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	n := len(b.addrs)
+	switch n {
+	case 0:
+		return serviceAddr{}, noop
+	case 1:
+		return b.start(0)
+	}
+
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	if atomic.LoadInt64(b.counts[j]) < atomic.LoadInt64(b.counts[i]) {
+		i = j
+	}
+
+	return b.start(i)
+}
+
+// weightedRoundRobinBalancer implements smooth weighted round robin, as
+// used by nginx. Addresses are picked in proportion to their weight, and
+// picks of the same address are spread out.
+type weightedRoundRobinBalancer struct {
+	mu      sync.Mutex
+	addrs   []serviceAddr
+	current []int
+}
+
+func (b *weightedRoundRobinBalancer) update(addrs []serviceAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	old := make(map[string]int, len(b.addrs))
+	for i, a := range b.addrs {
+		old[a.String()] = b.current[i]
+	}
+
+	current := make([]int, len(addrs))
+	for i, a := range addrs {
+		current[i] = old[a.String()]
+	}
+
+	b.addrs = addrs
+	b.current = current
+}
+
+func (b *weightedRoundRobinBalancer) pick(*http.Request) (serviceAddr, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.addrs) == 0 {
+		return serviceAddr{}, noop
+	}
+
+	total := 0
+	best := 0
+	for i, a := range b.addrs {
+		w := a.weight
+		if w <= 0 {
+			w = 1
+		}
+		b.current[i] += w
+		total += w
+		if b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= total
+
+	return b.addrs[best], noop
+}
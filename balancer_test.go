@@ -0,0 +1,259 @@
+package minke
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestBalancers_distribution(t *testing.T) {
+	addrs := []serviceAddr{
+		{addr: "10.0.0.1", port: 80, weight: 1},
+		{addr: "10.0.0.2", port: 80, weight: 2},
+		{addr: "10.0.0.3", port: 80, weight: 3},
+	}
+
+	tests := []struct {
+		name     string
+		balancer string
+		exp      map[string]int
+	}{
+		{
+			name:     "round robin",
+			balancer: balancerRoundRobin,
+			exp:      map[string]int{"10.0.0.1:80": 200, "10.0.0.2:80": 200, "10.0.0.3:80": 200},
+		},
+		{
+			name:     "weighted round robin",
+			balancer: balancerWeightedRoundRobin,
+			exp:      map[string]int{"10.0.0.1:80": 100, "10.0.0.2:80": 200, "10.0.0.3:80": 300},
+		},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			b := newBalancer(balancerSpec{strategy: st.balancer})
+			b.update(addrs)
+			got := map[string]int{}
+			for i := 0; i < 600; i++ {
+				addr, done := b.pick(nil)
+				got[addr.String()]++
+				done()
+			}
+			for k, v := range st.exp {
+				if got[k] != v {
+					t.Fatalf("expected %v picks of %s, got %v", v, k, got[k])
+				}
+			}
+		})
+	}
+}
+
+func TestBalancers_outstanding(t *testing.T) {
+	addrs := []serviceAddr{
+		{addr: "10.0.0.1", port: 80},
+		{addr: "10.0.0.2", port: 80},
+	}
+
+	for _, name := range []string{balancerLeastOutstanding, balancerPowerOfTwo} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			b := newBalancer(balancerSpec{strategy: name})
+			b.update(addrs)
+
+			// hold a request open, the other address should always be picked
+			busy, done := b.pick(nil)
+			for i := 0; i < 10; i++ {
+				addr, d := b.pick(nil)
+				if addr == busy {
+					t.Fatalf("picked busy address %v", addr)
+				}
+				d()
+			}
+
+			// the outstanding count should survive an update
+			b.update([]serviceAddr{addrs[1], addrs[0], {addr: "10.0.0.3", port: 80}})
+			for i := 0; i < 10; i++ {
+				addr, d := b.pick(nil)
+				if addr == busy {
+					t.Fatalf("picked busy address %v after update", addr)
+				}
+				d()
+			}
+			done()
+		})
+	}
+}
+
+func TestBalancers_empty(t *testing.T) {
+	for name := range balancers {
+		b := newBalancer(balancerSpec{strategy: name, hashKey: "source-ip"})
+		addr, done := b.pick(nil)
+		if addr.addr != "" {
+			t.Fatalf("%s: expected no address, got %v", name, addr)
+		}
+		done()
+	}
+}
+
+func TestBalancers_hash(t *testing.T) {
+	var addrs []serviceAddr
+	for i := 1; i <= 10; i++ {
+		addrs = append(addrs, serviceAddr{addr: fmt.Sprintf("10.0.0.%d", i), port: 80, weight: 1})
+	}
+
+	reqs := make([]*http.Request, 1000)
+	for i := range reqs {
+		reqs[i] = &http.Request{Header: http.Header{}}
+		reqs[i].Header.Set("X-User", fmt.Sprintf("user-%d", i))
+	}
+
+	for _, name := range []string{balancerRingHash, balancerMaglev} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			b := newBalancer(balancerSpec{strategy: name, hashKey: "header:x-user"})
+			b.update(addrs)
+
+			before := make([]serviceAddr, len(reqs))
+			counts := map[serviceAddr]int{}
+			for i, r := range reqs {
+				before[i], _ = b.pick(r)
+				counts[before[i]]++
+				if again, _ := b.pick(r); again != before[i] {
+					t.Fatalf("request %d picked %v then %v", i, before[i], again)
+				}
+			}
+			for _, a := range addrs {
+				if counts[a] < 40 || counts[a] > 180 {
+					t.Fatalf("poor spread, %v got %d of %d requests", a, counts[a], len(reqs))
+				}
+			}
+
+			// removing one endpoint should only move the keys that were
+			// assigned to it.
+			removed := addrs[3]
+			b.update(append(append([]serviceAddr{}, addrs[:3]...), addrs[4:]...))
+			moved := 0
+			for i, r := range reqs {
+				after, _ := b.pick(r)
+				if after == removed {
+					t.Fatalf("picked removed endpoint %v", removed)
+				}
+				if after != before[i] {
+					if before[i] != removed {
+						moved++
+					}
+				}
+			}
+			if moved > len(reqs)/20 {
+				t.Fatalf("%d keys not on the removed endpoint moved", moved)
+			}
+		})
+	}
+}
+
+func TestParseBalancerAnnotations(t *testing.T) {
+	tests := []struct {
+		anns     map[string]string
+		spec     balancerSpec
+		affinity string
+		errs     int
+	}{
+		{anns: map[string]string{}},
+		{anns: map[string]string{annBalancer: "random"}, spec: balancerSpec{strategy: "random"}},
+		{anns: map[string]string{annBalancer: "unknown"}, errs: 1},
+		{anns: map[string]string{annBalancer: balancerMaglev}, errs: 1},
+		{anns: map[string]string{annBalancer: balancerMaglev, annHashKey: "header"}, errs: 1},
+		{
+			anns: map[string]string{annBalancer: balancerRingHash, annHashKey: "cookie:session"},
+			spec: balancerSpec{strategy: balancerRingHash, hashKey: "cookie:session"},
+		},
+		{anns: map[string]string{annAffinityCookie: "route"}, affinity: "route"},
+		{anns: map[string]string{annTopologyAware: "true"}, spec: balancerSpec{topologyAware: true, topologySet: true}},
+		{anns: map[string]string{annTopologyAware: "false"}, spec: balancerSpec{topologySet: true}},
+		{anns: map[string]string{annTopologyAware: "maybe"}, errs: 1},
+		{anns: map[string]string{annAffinityCookie: "bad;name"}, errs: 1},
+	}
+
+	for i, st := range tests {
+		spec, affinity, errs := parseBalancerAnnotations(st.anns)
+		if spec != st.spec || affinity != st.affinity || len(errs) != st.errs {
+			t.Errorf("%d: got %v %q %v, expected %v %q with %d errors", i, spec, affinity, errs, st.spec, st.affinity, st.errs)
+		}
+	}
+}
+
+func TestBalancerSpec_withDefaults(t *testing.T) {
+	aware := balancerSpec{strategy: balancerRandom, topologyAware: true, topologySet: true}
+	unaware := balancerSpec{strategy: balancerRandom, topologySet: true}
+
+	tests := []struct {
+		name string
+		ing  balancerSpec
+		svc  balancerSpec
+		exp  balancerSpec
+	}{
+		{name: "defaults", exp: balancerSpec{strategy: defaultBalancer}},
+		{name: "service strategy", svc: balancerSpec{strategy: balancerRingHash, hashKey: "source-ip"}, exp: balancerSpec{strategy: balancerRingHash, hashKey: "source-ip"}},
+		{name: "ingress strategy", ing: balancerSpec{strategy: balancerRandom}, svc: balancerSpec{strategy: balancerRingHash, hashKey: "source-ip"}, exp: balancerSpec{strategy: balancerRandom}},
+		{name: "service aware", svc: aware, exp: balancerSpec{strategy: balancerRandom, topologyAware: true, zone: "a"}},
+		{name: "ingress aware", ing: aware, svc: unaware, exp: balancerSpec{strategy: balancerRandom, topologyAware: true, zone: "a"}},
+		{name: "ingress turns off", ing: unaware, svc: aware, exp: balancerSpec{strategy: balancerRandom}},
+		{name: "ingress unset", ing: balancerSpec{strategy: balancerRandom}, svc: aware, exp: balancerSpec{strategy: balancerRandom, topologyAware: true, zone: "a"}},
+	}
+
+	for _, st := range tests {
+		if got := st.ing.withDefaults(st.svc, "a"); got != st.exp {
+			t.Errorf("%s: expected %#v, got %#v", st.name, st.exp, got)
+		}
+	}
+}
+
+func TestBalancers_acquire(t *testing.T) {
+	addrs := []serviceAddr{
+		{addr: "10.0.0.1", port: 80, zone: "a"},
+		{addr: "10.0.0.2", port: 80, zone: "a"},
+	}
+	key := serviceKey{namespace: "default", name: "app"}
+	eps := &epsSet{set: map[serviceKey]*serviceAddrSet{key: {addrs: addrs}}}
+
+	specs := []balancerSpec{
+		{strategy: balancerLeastOutstanding},
+		{strategy: balancerPowerOfTwo},
+		{strategy: balancerLeastOutstanding, topologyAware: true, zone: "a"},
+	}
+	for _, spec := range specs {
+		spec := spec
+		t.Run(spec.String(), func(t *testing.T) {
+			// a request pinned to the first address, as if by an
+			// affinity cookie, should keep the balancer away from it
+			done := eps.acquire(key, spec, addrs[0])
+			for i := 0; i < 10; i++ {
+				addr, d := eps.pick(key, spec, nil)
+				if addr == addrs[0] {
+					t.Fatalf("picked acquired address %v", addr)
+				}
+				d()
+			}
+			done()
+
+			// once released, both addresses are used again
+			got := map[serviceAddr]bool{}
+			for i := 0; i < 50; i++ {
+				addr, d := eps.pick(key, spec, nil)
+				got[addr] = true
+				d()
+			}
+			if len(got) != 2 {
+				t.Fatalf("expected both addresses to be picked, got %v", got)
+			}
+		})
+	}
+
+	// balancers that do not track requests, and unknown addresses, are
+	// ignored
+	eps.acquire(key, balancerSpec{strategy: balancerRoundRobin}, addrs[0])()
+	eps.acquire(key, balancerSpec{strategy: balancerLeastOutstanding}, serviceAddr{addr: "10.0.0.9", port: 80})()
+	eps.acquire(serviceKey{namespace: "default", name: "missing"}, balancerSpec{strategy: balancerLeastOutstanding}, addrs[0])()
+}
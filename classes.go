@@ -0,0 +1,261 @@
+package minke
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog/v2"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultControllerName is the value of spec.controller that IngressClasses
+// must have for minke to claim them.
+const DefaultControllerName = "github.com/tcolgate/minke"
+
+var annIsDefaultClass = networkingv1beta1.AnnotationIsDefaultIngressClass
+
+type ingressClass struct {
+	name       string
+	controller string
+	isDefault  bool
+	parameters *corev1.TypedLocalObjectReference
+}
+
+func (ic ingressClass) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{
+		"controller": ic.controller,
+		"default":    ic.isDefault,
+	}
+	if ic.parameters != nil {
+		strmap["parameters"] = ic.parameters
+	}
+	return json.Marshal(strmap)
+}
+
+// classSet tracks the IngressClasses that belong to us.
+type classSet struct {
+	sync.RWMutex
+	set map[string]ingressClass
+}
+
+// MarshalJSON lets us report the status of the class set
+func (cs *classSet) MarshalJSON() ([]byte, error) {
+	cs.RLock()
+	defer cs.RUnlock()
+	return json.Marshal(cs.set)
+}
+
+// ours reports if the named class exists and is handled by us.
+func (cs *classSet) ours(name string) bool {
+	cs.RLock()
+	defer cs.RUnlock()
+	_, ok := cs.set[name]
+	return ok
+}
+
+// haveDefault reports if any of our classes are marked as being the
+// cluster default.
+func (cs *classSet) haveDefault() bool {
+	cs.RLock()
+	defer cs.RUnlock()
+	for _, ic := range cs.set {
+		if ic.isDefault {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultClass returns the name of our default class, if we have one. If
+// there are several, the first by name is picked.
+func (cs *classSet) defaultClass() (string, bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	var names []string
+	for n, ic := range cs.set {
+		if ic.isDefault {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	sort.Strings(names)
+	return names[0], true
+}
+
+// parameters returns the parameters reference for one of our classes, this
+// can be used to load per-class settings.
+func (cs *classSet) parameters(name string) *corev1.TypedLocalObjectReference {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.set[name].parameters
+}
+
+type classUpdater struct {
+	c *Controller
+}
+
+func toIngressClass(obj interface{}) (ingressClass, error) {
+	var meta metav1.ObjectMeta
+	var ic ingressClass
+	switch cls := obj.(type) {
+	case *networkingv1.IngressClass:
+		meta = cls.ObjectMeta
+		ic.controller = cls.Spec.Controller
+		ic.parameters = cls.Spec.Parameters
+	case *networkingv1beta1.IngressClass:
+		meta = cls.ObjectMeta
+		ic.controller = cls.Spec.Controller
+		ic.parameters = cls.Spec.Parameters
+	default:
+		return ic, fmt.Errorf("interface was not an ingress class %T", obj)
+	}
+
+	ic.name = meta.Name
+	if v, ok := meta.Annotations[annIsDefaultClass]; ok {
+		isDefault, err := strconv.ParseBool(v)
+		if err != nil {
+			klog.Errorf("invalid annotation value for %q on ingress class %s, should be true or false", annIsDefaultClass, ic.name)
+		}
+		ic.isDefault = isDefault
+	}
+
+	return ic, nil
+}
+
+func (u *classUpdater) addItem(obj interface{}) error {
+	ic, err := toIngressClass(obj)
+	if err != nil {
+		return err
+	}
+
+	u.c.classes.Lock()
+	if u.c.classes.set == nil {
+		u.c.classes.set = make(map[string]ingressClass)
+	}
+	if ic.controller == u.c.controllerName {
+		klog.Infof("ingress class %s updated", ic.name)
+		u.c.classes.set[ic.name] = ic
+	} else {
+		delete(u.c.classes.set, ic.name)
+	}
+	u.c.classes.Unlock()
+
+	u.c.requeueIngresses()
+
+	return nil
+}
+
+func (u *classUpdater) delItem(obj interface{}) error {
+	ic, err := toIngressClass(obj)
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("ingress class removed, %s", ic.name)
+
+	u.c.classes.Lock()
+	delete(u.c.classes.set, ic.name)
+	u.c.classes.Unlock()
+
+	u.c.requeueIngresses()
+
+	return nil
+}
+
+// requeueIngresses causes all the ingresses to be reprocessed, this is
+// needed when the set of classes we own changes.
+func (c *Controller) requeueIngresses() {
+	if c.ingProc == nil {
+		return
+	}
+	for _, key := range c.ingProc.informer.GetStore().ListKeys() {
+		c.ingProc.queue.Add(key)
+	}
+}
+
+// requeueIngressAt causes an ingress to be reprocessed at the given time.
+func (c *Controller) requeueIngressAt(obj interface{}, at time.Time) {
+	if c.ingProc == nil {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	c.ingProc.queue.AddAfter(key, time.Until(at))
+}
+
+// ingressClassesAvailable checks if the server has the IngressClass API in
+// the version we would use, clusters before 1.18 do not.
+func ingressClassesAvailable(client kubernetes.Interface, v1 bool) bool {
+	gv := networkingv1beta1.SchemeGroupVersion.String()
+	if v1 {
+		gv = networkingv1.SchemeGroupVersion.String()
+	}
+	rs, err := client.Discovery().ServerResourcesForGroupVersion(gv)
+	if err != nil || rs == nil {
+		return false
+	}
+	for _, r := range rs.APIResources {
+		if r.Name == "ingressclasses" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Controller) setupClassProcess(ctx context.Context) error {
+	if !ingressClassesAvailable(c.client, c.ingV1) {
+		// Listing would fail forever, and hold up the cache sync.
+		klog.Infof("IngressClass API not available, only the ingress class annotation will be used")
+		return nil
+	}
+
+	upd := &classUpdater{c}
+
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return c.client.NetworkingV1beta1().IngressClasses().List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return c.client.NetworkingV1beta1().IngressClasses().Watch(ctx, options)
+		},
+	}
+	var obj runtime.Object = &networkingv1beta1.IngressClass{}
+
+	if c.ingV1 {
+		lw = &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return c.client.NetworkingV1().IngressClasses().List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return c.client.NetworkingV1().IngressClasses().Watch(ctx, options)
+			},
+		}
+		obj = &networkingv1.IngressClass{}
+	}
+
+	c.clsProc = makeProcessor(
+		lw,
+		obj,
+		c.refresh,
+		upd,
+	)
+
+	return nil
+}
@@ -0,0 +1,599 @@
+package minke
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+)
+
+// annClientAuth sets whether clients of the hosts of an ingress must
+// present a certificate, one of off, optional or require.
+var annClientAuth = annPrefix + "client-auth"
+
+// annClientCASecret names a secret, in the namespace of the ingress, whose
+// ca.crt holds the CAs client certificates must be issued by. If not set,
+// the global client CA secret is used.
+var annClientCASecret = annPrefix + "client-ca-secret"
+
+const (
+	// ClientAuthOff does not ask clients for a certificate.
+	ClientAuthOff = "off"
+	// ClientAuthOptional verifies a client certificate, if one is given.
+	ClientAuthOptional = "optional"
+	// ClientAuthRequire refuses requests without a valid client
+	// certificate.
+	ClientAuthRequire = "require"
+
+	clientCAKey = "ca.crt"
+)
+
+// WithClientAuth is an option for verifying client certificates against
+// the CAs in the ca.crt of a secret, in the form of NAMESPACE/NAME. The
+// mode is one of off, optional or require, and may be overridden for the
+// hosts of an ingress with annotations.
+func WithClientAuth(caSecret, mode string) Option {
+	return func(c *Controller) error {
+		if caSecret == "" {
+			return nil
+		}
+		parts := strings.SplitN(caSecret, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("client CA secret should be in the form of NAMESPACE/NAME")
+		}
+		m, err := parseClientAuthMode(mode)
+		if err != nil {
+			return err
+		}
+		c.clientAuthPolicy = &clientAuthPolicy{
+			mode: m,
+			ca:   secretKey{namespace: parts[0], name: parts[1]},
+		}
+		return nil
+	}
+}
+
+// WithClientCertHeaders is an option for setting the headers used to pass
+// the subject, SANs and SHA-256 fingerprint of a verified client
+// certificate to backends. Any copies sent by the client are removed. An
+// empty name disables a header.
+func WithClientCertHeaders(subject, sans, fingerprint string) Option {
+	return func(c *Controller) error {
+		c.clientCertHeaders = clientCertHeaders{
+			subject:     http.CanonicalHeaderKey(subject),
+			sans:        http.CanonicalHeaderKey(sans),
+			fingerprint: http.CanonicalHeaderKey(fingerprint),
+		}
+		return nil
+	}
+}
+
+type clientCertHeaders struct {
+	subject     string
+	sans        string
+	fingerprint string
+}
+
+// clientAuthPolicy is the client certificate verification used for a
+// host.
+type clientAuthPolicy struct {
+	mode    string
+	ca      secretKey
+	ing     ingressKey // the ingress that set this policy, if any
+	invalid bool       // set if the policy could not be parsed
+}
+
+func (p *clientAuthPolicy) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{
+		"mode": p.mode,
+	}
+	if p.ca != (secretKey{}) {
+		strmap["secret"] = p.ca.String()
+	}
+	if p.invalid {
+		strmap["invalid"] = true
+	}
+	if p.ing != (ingressKey{}) {
+		strmap["ingress"] = fmt.Sprintf("%s/%s", p.ing.namespace, p.ing.name)
+	}
+	return json.Marshal(strmap)
+}
+
+func parseClientAuthMode(str string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(str)); m {
+	case ClientAuthOff, ClientAuthOptional, ClientAuthRequire:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid client auth mode %q, should be off, optional or require", str)
+	}
+}
+
+// parseClientAuth reads the client auth annotations of an ingress, nil is
+// returned if they are not set. Setting only a CA secret requires client
+// certificates. If the annotations are invalid, the policy returned
+// refuses all client certificates.
+func parseClientAuth(namespace string, anns map[string]string) (*clientAuthPolicy, error) {
+	mode, hasMode := anns[annClientAuth]
+	sec, hasSec := anns[annClientCASecret]
+	if !hasMode && !hasSec {
+		return nil, nil
+	}
+
+	p := &clientAuthPolicy{mode: ClientAuthRequire}
+	if hasMode {
+		m, err := parseClientAuthMode(mode)
+		if err != nil {
+			return &clientAuthPolicy{mode: ClientAuthRequire, invalid: true}, err
+		}
+		p.mode = m
+	}
+	if hasSec {
+		name := strings.TrimSpace(sec)
+		if name == "" || strings.Contains(name, "/") {
+			return &clientAuthPolicy{mode: ClientAuthRequire, invalid: true}, fmt.Errorf("invalid value %q for %s, should be the name of a secret in the ingress namespace", sec, annClientCASecret)
+		}
+		p.ca = secretKey{namespace: namespace, name: name}
+	}
+	return p, nil
+}
+
+// clientAuthSet tracks the client auth policy of each host, and the CA
+// pools they use. Pools are reloaded when their secrets change.
+type clientAuthSet struct {
+	c *Controller
+
+	sync.RWMutex
+	global    *clientAuthPolicy
+	ingresses map[ingressKey]map[string]*clientAuthPolicy
+	objs      map[ingressKey]interface{} // the ingresses, for recording events
+	hosts     map[string]*clientAuthPolicy
+	pools     map[secretKey]*x509.CertPool
+	errs      map[secretKey]error
+}
+
+// MarshalJSON lets us report the client auth policies in use
+func (cs *clientAuthSet) MarshalJSON() ([]byte, error) {
+	cs.RLock()
+	defer cs.RUnlock()
+	strmap := map[string]interface{}{
+		"hosts": cs.hosts,
+	}
+	if cs.global != nil {
+		strmap["default"] = cs.global
+	}
+	errs := map[string]string{}
+	for k, err := range cs.errs {
+		errs[k.String()] = err.Error()
+	}
+	if len(errs) > 0 {
+		strmap["errors"] = errs
+	}
+	return json.Marshal(strmap)
+}
+
+func (c *Controller) setupClientAuth() {
+	c.clientAuth = &clientAuthSet{
+		c:         c,
+		global:    c.clientAuthPolicy,
+		ingresses: map[ingressKey]map[string]*clientAuthPolicy{},
+		objs:      map[ingressKey]interface{}{},
+		hosts:     map[string]*clientAuthPolicy{},
+		pools:     map[secretKey]*x509.CertPool{},
+		errs:      map[secretKey]error{},
+	}
+}
+
+// updateIngress sets the policy for the hosts of an ingress, a nil policy
+// removes it. If several ingresses set different policies for a host, the
+// strictest mode is used, or if they use different CAs, the policy is
+// invalid and all client certificates are refused. The conflict is
+// reported against each of the ingresses.
+func (cs *clientAuthSet) updateIngress(obj interface{}, key ingressKey, hosts []string, p *clientAuthPolicy) {
+	cs.Lock()
+
+	delete(cs.ingresses, key)
+	delete(cs.objs, key)
+	if p != nil && len(hosts) > 0 {
+		np := *p
+		np.ing = key
+		hps := map[string]*clientAuthPolicy{}
+		for _, h := range hosts {
+			hps[strings.ToLower(h)] = &np
+		}
+		cs.ingresses[key] = hps
+		cs.objs[key] = obj
+	}
+
+	var keys []ingressKey
+	for k := range cs.ingresses {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	claims := map[string][]*clientAuthPolicy{}
+	for _, k := range keys {
+		for h, p := range cs.ingresses[k] {
+			claims[h] = append(claims[h], p)
+		}
+	}
+
+	type conflict struct {
+		host   string
+		ings   []ingressKey
+		policy *clientAuthPolicy
+	}
+	var conflicts []conflict
+
+	hps := map[string]*clientAuthPolicy{}
+	for h, ps := range claims {
+		res, merged := cs.mergePolicies(ps)
+		hps[h] = res
+		if !merged {
+			continue
+		}
+		c := conflict{host: h, policy: res}
+		involved := false
+		for _, p := range ps {
+			c.ings = append(c.ings, p.ing)
+			involved = involved || p.ing == key
+		}
+		// Conflicts are reported when one of the ingresses changes.
+		if involved {
+			conflicts = append(conflicts, c)
+		}
+	}
+	cs.hosts = hps
+
+	objs := map[ingressKey]interface{}{}
+	for k, o := range cs.objs {
+		objs[k] = o
+	}
+	cs.Unlock()
+
+	for _, c := range conflicts {
+		var names []string
+		for _, ik := range c.ings {
+			names = append(names, ik.namespace+"/"+ik.name)
+		}
+		result := "using " + c.policy.mode
+		if c.policy.invalid {
+			result = "their client CAs differ, refusing all client certificates"
+		}
+		klog.Errorf("ingresses %s set different client auth policies for %s, %s", strings.Join(names, ", "), c.host, result)
+		for _, ik := range c.ings {
+			cs.c.recordEventf(objs[ik], corev1.EventTypeWarning, "ClientAuthConflict", "ingresses %s set different client auth policies for %s, %s", strings.Join(names, ", "), c.host, result)
+		}
+	}
+}
+
+// clientAuthStrictness orders the modes, so that conflicts can be
+// resolved to the strictest.
+var clientAuthStrictness = map[string]int{
+	ClientAuthOff:      0,
+	ClientAuthOptional: 1,
+	ClientAuthRequire:  2,
+}
+
+// mergePolicies resolves the policies several ingresses set for a host,
+// reporting if they differed. It must be called with the lock held.
+func (cs *clientAuthSet) mergePolicies(ps []*clientAuthPolicy) (*clientAuthPolicy, bool) {
+	res := ps[0]
+	merged := false
+	for _, p := range ps[1:] {
+		if p.mode == res.mode && p.ca == res.ca && p.invalid == res.invalid {
+			continue
+		}
+		merged = true
+		switch {
+		case res.invalid:
+		case p.invalid || cs.effectiveCA(p) != cs.effectiveCA(res):
+			res = &clientAuthPolicy{mode: ClientAuthRequire, ing: res.ing, invalid: true}
+		case clientAuthStrictness[p.mode] > clientAuthStrictness[res.mode]:
+			res = p
+		}
+	}
+	return res, merged
+}
+
+// effectiveCA is the secret holding the CAs for a policy.
+func (cs *clientAuthSet) effectiveCA(p *clientAuthPolicy) secretKey {
+	if p.ca == (secretKey{}) && cs.global != nil {
+		return cs.global.ca
+	}
+	return p.ca
+}
+
+// policyFor finds the policy for a host, checking for an exact match, then
+// a wildcard, then falling back to the global policy.
+func (cs *clientAuthSet) policyFor(host string) *clientAuthPolicy {
+	if cs == nil {
+		return nil
+	}
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	cs.RLock()
+	defer cs.RUnlock()
+	if p, ok := cs.hosts[host]; ok {
+		return cs.withDefaultCA(p)
+	}
+	if i := strings.Index(host, "."); i > 0 {
+		if p, ok := cs.hosts["*"+host[i:]]; ok {
+			return cs.withDefaultCA(p)
+		}
+	}
+	return cs.global
+}
+
+func (cs *clientAuthSet) withDefaultCA(p *clientAuthPolicy) *clientAuthPolicy {
+	if p.ca != (secretKey{}) || p.invalid || cs.global == nil {
+		return p
+	}
+	np := *p
+	np.ca = cs.global.ca
+	return &np
+}
+
+// pool returns the CAs for a policy, loading them if needed. If the
+// secret can't be loaded an empty pool is returned, so that no client
+// certificate will verify.
+func (cs *clientAuthSet) pool(p *clientAuthPolicy) *x509.CertPool {
+	if p.invalid {
+		return x509.NewCertPool()
+	}
+	key := p.ca
+	cs.RLock()
+	pool, ok := cs.pools[key]
+	cs.RUnlock()
+	if ok {
+		return pool
+	}
+	pool, _ = cs.load(key)
+	return pool
+}
+
+// load reads the CAs from a secret, replacing any we already have.
+func (cs *clientAuthSet) load(key secretKey) (*x509.CertPool, error) {
+	if key == (secretKey{}) {
+		return x509.NewCertPool(), fmt.Errorf("no client CA secret is configured")
+	}
+
+	// CA secrets need not hold a certificate and key, so the secrets cache
+	// will not have them, we read them from the lister instead.
+	var data map[string][]byte
+	sec, err := cs.c.secList.Secrets(key.namespace).Get(key.name)
+	if err == nil {
+		data = sec.Data
+	}
+
+	pool := x509.NewCertPool()
+	switch {
+	case k8serrors.IsNotFound(err):
+		err = errSecretNotFound
+	case err != nil:
+	case len(data[clientCAKey]) == 0:
+		err = fmt.Errorf("no %s in secret", clientCAKey)
+	case !pool.AppendCertsFromPEM(data[clientCAKey]):
+		err = fmt.Errorf("no certificates found in %s", clientCAKey)
+	}
+	if err != nil {
+		klog.Errorf("failed loading client CAs from %s, %v", key, err)
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	cs.pools[key] = pool
+	if err != nil {
+		cs.errs[key] = err
+	} else {
+		delete(cs.errs, key)
+	}
+	return pool, err
+}
+
+// secretUpdated reloads the CAs from a secret, if they are in use, and
+// requeues the ingresses that use them.
+func (cs *clientAuthSet) secretUpdated(key secretKey) {
+	if cs == nil {
+		return
+	}
+
+	cs.RLock()
+	used := cs.global != nil && cs.global.ca == key
+	ings := map[ingressKey]struct{}{}
+	for ik, hps := range cs.ingresses {
+		for _, p := range hps {
+			if p.ca == key {
+				used = true
+				ings[ik] = struct{}{}
+			}
+		}
+	}
+	_, loaded := cs.pools[key]
+	cs.RUnlock()
+	if !used && !loaded {
+		return
+	}
+
+	klog.Infof("reloading client CAs from %s", key)
+	cs.load(key)
+
+	if cs.c.ingProc == nil {
+		return
+	}
+	for ik := range ings {
+		cs.c.ingProc.queue.Add(ik.namespace + "/" + ik.name)
+	}
+}
+
+// checkIngress records an event against an ingress if the CAs for its
+// policy can't be loaded.
+func (cs *clientAuthSet) checkIngress(obj interface{}, p *clientAuthPolicy) {
+	if p == nil || p.mode == ClientAuthOff || p.invalid {
+		return
+	}
+	ca := p.ca
+	if ca == (secretKey{}) && cs.global != nil {
+		ca = cs.global.ca
+	}
+	if _, err := cs.load(ca); err != nil {
+		cs.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidClientCA", "client CAs from %s, %v, no client certificates will be accepted", ca, err)
+	}
+}
+
+// ConfigureServerTLS sets up a server TLS config to ask for client
+// certificates, according to the policy for the requested server name.
+// It should be called once cfg is otherwise complete.
+func (c *Controller) ConfigureServerTLS(cfg *tls.Config) {
+	base := cfg.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// ACME validators never present a client certificate. Requests
+		// are still checked by verifyClient, should one be sent.
+		if c.acme.isChallengeHello(hello) {
+			return nil, nil
+		}
+
+		p := c.clientAuth.policyFor(hello.ServerName)
+		if p == nil || p.mode == ClientAuthOff {
+			return nil, nil
+		}
+
+		conf := base.Clone()
+		conf.ClientCAs = c.clientAuth.pool(p)
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if p.mode == ClientAuthRequire {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return conf, nil
+	}
+}
+
+// verifyClient checks the client certificate of a request against the
+// policy for the requested host. The connection may have been set up for
+// a different host, so the certificate is verified again if needed.
+func (c *Controller) verifyClient(st *requestState, req *http.Request) {
+	p := c.clientAuth.policyFor(req.Host)
+	if p == nil || p.mode == ClientAuthOff {
+		return
+	}
+
+	var leaf *x509.Certificate
+	var err error
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		leaf, err = c.clientAuth.verify(p, req.TLS)
+	}
+	if err == nil && (leaf != nil || p.mode == ClientAuthOptional) {
+		st.clientCert = leaf
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("no client certificate")
+	}
+
+	status := http.StatusForbidden
+	host := req.Host
+	if h, _, herr := net.SplitHostPort(host); herr == nil {
+		host = h
+	}
+	if req.TLS != nil && !strings.EqualFold(req.TLS.ServerName, host) {
+		// The connection was set up for another host, the client should
+		// try again with a new one.
+		status = http.StatusMisdirectedRequest
+	}
+	panic(httpError{
+		status:     status,
+		logMessage: fmt.Sprintf("client certificate rejected for %s, %v", req.Host, err),
+		message:    "client certificate required",
+	})
+}
+
+func (cs *clientAuthSet) verify(p *clientAuthPolicy, state *tls.ConnectionState) (*x509.Certificate, error) {
+	leaf := state.PeerCertificates[0]
+
+	// If the handshake was verified against the same CAs, we need not
+	// repeat the work.
+	if len(state.VerifiedChains) > 0 {
+		if hp := cs.policyFor(state.ServerName); hp != nil && hp.mode != ClientAuthOff && !hp.invalid && !p.invalid && hp.ca == p.ca {
+			return leaf, nil
+		}
+	}
+
+	inter := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		inter.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         cs.pool(p),
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// setClientCertHeaders passes the details of a verified client
+// certificate to the backend.
+func (c *Controller) setClientCertHeaders(st *requestState, req *http.Request) {
+	hs := c.clientCertHeaders
+	for _, h := range []string{hs.subject, hs.sans, hs.fingerprint} {
+		if h != "" {
+			req.Header.Del(h)
+		}
+	}
+
+	cert := st.clientCert
+	if cert == nil {
+		return
+	}
+	if hs.subject != "" {
+		req.Header.Set(hs.subject, cert.Subject.String())
+	}
+	if hs.sans != "" {
+		if sans := certificateSANs(cert); len(sans) > 0 {
+			req.Header.Set(hs.sans, strings.Join(sans, ","))
+		}
+	}
+	if hs.fingerprint != "" {
+		sum := sha256.Sum256(cert.Raw)
+		req.Header.Set(hs.fingerprint, hex.EncodeToString(sum[:]))
+	}
+}
+
+// certificateSANs lists the subject alternative names of a certificate,
+// prefixed by their type.
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+	for _, n := range cert.DNSNames {
+		sans = append(sans, "DNS:"+n)
+	}
+	for _, e := range cert.EmailAddresses {
+		sans = append(sans, "email:"+e)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, "URI:"+u.String())
+	}
+	return sans
+}
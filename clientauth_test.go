@@ -0,0 +1,397 @@
+package minke
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key, %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate, %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue creates a client certificate signed by the CA.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key, %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: name, Organization: []string{"Minke"}},
+		DNSNames:       []string{name},
+		EmailAddresses: []string{"client@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating certificate, %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	tests := []struct {
+		anns    map[string]string
+		exp     *clientAuthPolicy
+		invalid bool
+	}{
+		{anns: map[string]string{}},
+		{
+			anns: map[string]string{annClientAuth: "Optional"},
+			exp:  &clientAuthPolicy{mode: ClientAuthOptional},
+		},
+		{
+			anns: map[string]string{annClientCASecret: "ca"},
+			exp:  &clientAuthPolicy{mode: ClientAuthRequire, ca: secretKey{namespace: "ns", name: "ca"}},
+		},
+		{
+			anns: map[string]string{annClientAuth: "off", annClientCASecret: "ca"},
+			exp:  &clientAuthPolicy{mode: ClientAuthOff, ca: secretKey{namespace: "ns", name: "ca"}},
+		},
+		{anns: map[string]string{annClientAuth: "sometimes"}, invalid: true},
+		{anns: map[string]string{annClientCASecret: "other/ca"}, invalid: true},
+	}
+
+	for i, tt := range tests {
+		p, err := parseClientAuth("ns", tt.anns)
+		if tt.invalid {
+			if err == nil || p == nil || !p.invalid || p.mode != ClientAuthRequire {
+				t.Errorf("%d: expected an invalid require policy, got %+v, %v", i, p, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error, %v", i, err)
+			continue
+		}
+		if (p == nil) != (tt.exp == nil) || (p != nil && *p != *tt.exp) {
+			t.Errorf("%d: expected %+v, got %+v", i, tt.exp, p)
+		}
+	}
+}
+
+func TestClientAuthSet_conflicts(t *testing.T) {
+	ctrl, err := New(fake.NewSimpleClientset(), WithClientAuth("default/client-ca", ClientAuthOptional))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	ctrl.recorder = recorder
+	ctrl.leader.setLeader(true)
+
+	ing := func(ns, name string) (interface{}, ingressKey) {
+		return &networkingv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}}, ingressKey{namespace: ns, name: name}
+	}
+	conflicts := func() int {
+		n := 0
+		for {
+			select {
+			case ev := <-recorder.Events:
+				if !strings.Contains(ev, "ClientAuthConflict") {
+					t.Fatalf("unexpected event %s", ev)
+				}
+				n++
+			default:
+				return n
+			}
+		}
+	}
+	cs := ctrl.clientAuth
+	hosts := []string{"shared.example.com"}
+
+	ownerObj, owner := ing("secure", "owner")
+	cs.updateIngress(ownerObj, owner, hosts, &clientAuthPolicy{mode: ClientAuthRequire})
+	if n := conflicts(); n != 0 {
+		t.Fatalf("expected no conflicts, got %d", n)
+	}
+
+	// another namespace cannot weaken the policy, and both are told
+	otherObj, other := ing("aaa", "other")
+	cs.updateIngress(otherObj, other, hosts, &clientAuthPolicy{mode: ClientAuthOff})
+	if p := cs.policyFor("shared.example.com"); p.mode != ClientAuthRequire || p.invalid {
+		t.Fatalf("expected the strictest policy, got %+v", p)
+	}
+	if n := conflicts(); n != 2 {
+		t.Fatalf("expected an event on both ingresses, got %d", n)
+	}
+
+	// the same CA given explicitly is not a conflict of CAs
+	cs.updateIngress(otherObj, other, hosts, &clientAuthPolicy{mode: ClientAuthOptional, ca: secretKey{namespace: "default", name: "client-ca"}})
+	if p := cs.policyFor("shared.example.com"); p.mode != ClientAuthRequire || p.invalid {
+		t.Fatalf("expected the strictest policy, got %+v", p)
+	}
+	conflicts()
+
+	// different CAs cannot be reconciled
+	cs.updateIngress(otherObj, other, hosts, &clientAuthPolicy{mode: ClientAuthRequire, ca: secretKey{namespace: "aaa", name: "other-ca"}})
+	if p := cs.policyFor("shared.example.com"); p.mode != ClientAuthRequire || !p.invalid {
+		t.Fatalf("expected an invalid policy, got %+v", p)
+	}
+	if n := conflicts(); n != 2 {
+		t.Fatalf("expected an event on both ingresses, got %d", n)
+	}
+
+	// once the other ingress goes, the owner's policy is used again
+	cs.updateIngress(nil, other, nil, nil)
+	if p := cs.policyFor("shared.example.com"); p.mode != ClientAuthRequire || p.invalid || p.ing != owner {
+		t.Fatalf("expected the owner's policy, got %+v", p)
+	}
+	if n := conflicts(); n != 0 {
+		t.Fatalf("expected no conflicts, got %d", n)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{"X-Client-Cert-Subject", "X-Client-Cert-Sans", "X-Client-Cert-Fingerprint"} {
+			if v := r.Header.Get(h); v != "" {
+				w.Header().Set("Got-"+h, v)
+			}
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	caA := newTestCA(t, "CA A")
+	caB := newTestCA(t, "CA B")
+	certA := caA.issue(t, "a.client.example.com")
+	certB := caB.issue(t, "b.client.example.com")
+
+	caSecret := func(name string, ca *testCA) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Data:       map[string][]byte{"ca.crt": ca.pem},
+		}
+	}
+
+	ingress := func(name string, anns map[string]string) *networkingv1beta1.Ingress {
+		anns["kubernetes.io/ingress.class"] = "minke"
+		anns["ingress.kubernetes.io/ssl-redirect"] = "false"
+		return &networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Annotations: anns,
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: name + ".example.com",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "app",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+	clientset := fake.NewSimpleClientset(
+		caSecret("client-ca", caA),
+		caSecret("other-ca", caB),
+		ingress("optional", map[string]string{}),
+		ingress("require", map[string]string{annClientAuth: "require"}),
+		ingress("other", map[string]string{annClientCASecret: "other-ca"}),
+		ingress("off", map[string]string{annClientAuth: "off"}),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		},
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "http", Port: int32(port)}},
+				},
+			},
+		},
+	)
+
+	ctrl, err := New(clientset, WithClientAuth("default/client-ca", ClientAuthOptional))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	srvCrt, srvKey := testCertificate(t, []string{"*.example.com"}, time.Now().Add(time.Hour))
+	srvCert, err := tls.X509KeyPair(srvCrt, srvKey)
+	if err != nil {
+		t.Fatalf("loading server certificate, %v", err)
+	}
+	pts := httptest.NewUnstartedServer(ctrl)
+	pts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{srvCert},
+		NextProtos:   []string{"http/1.1"},
+	}
+	ctrl.ConfigureServerTLS(pts.TLS)
+	pts.StartTLS()
+	defer pts.Close()
+
+	get := func(serverName, host string, cert *tls.Certificate) (*http.Response, error) {
+		tlsConf := &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		}
+		if cert != nil {
+			// Always send the certificate, even if the server would
+			// not accept its issuer.
+			tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConf,
+				DisableKeepAlives: true,
+			},
+		}
+		req, _ := http.NewRequest("GET", pts.URL+"/", nil)
+		req.Host = host
+		req.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	expectStatus := func(name, host string, cert *tls.Certificate, status int) *http.Response {
+		t.Helper()
+		resp, err := get(name, host, cert)
+		if err != nil {
+			t.Fatalf("%s: unexpected error, %v", host, err)
+		}
+		if resp.StatusCode != status {
+			t.Fatalf("%s: expected status %d, got %d", host, status, resp.StatusCode)
+		}
+		return resp
+	}
+
+	expectRefused := func(host string, cert *tls.Certificate) {
+		t.Helper()
+		if resp, err := get(host, host, cert); err == nil {
+			t.Fatalf("%s: expected the handshake to fail, got status %d", host, resp.StatusCode)
+		}
+	}
+
+	// Without a client certificate, nothing is passed on, even if the
+	// client sent the headers itself.
+	resp := expectStatus("optional.example.com", "optional.example.com", nil, http.StatusOK)
+	if v := resp.Header.Get("Got-X-Client-Cert-Subject"); v != "" {
+		t.Fatalf("expected no subject, got %q", v)
+	}
+
+	resp = expectStatus("optional.example.com", "optional.example.com", &certA, http.StatusOK)
+	if exp, v := "CN=a.client.example.com,O=Minke", resp.Header.Get("Got-X-Client-Cert-Subject"); v != exp {
+		t.Fatalf("expected subject %q, got %q", exp, v)
+	}
+	if exp, v := "DNS:a.client.example.com,email:client@example.com", resp.Header.Get("Got-X-Client-Cert-Sans"); v != exp {
+		t.Fatalf("expected SANs %q, got %q", exp, v)
+	}
+	sum := sha256.Sum256(certA.Leaf.Raw)
+	if exp, v := hex.EncodeToString(sum[:]), resp.Header.Get("Got-X-Client-Cert-Fingerprint"); v != exp {
+		t.Fatalf("expected fingerprint %q, got %q", exp, v)
+	}
+	expectRefused("optional.example.com", &certB)
+
+	expectRefused("require.example.com", nil)
+	expectStatus("require.example.com", "require.example.com", &certA, http.StatusOK)
+
+	expectRefused("other.example.com", &certA)
+	expectStatus("other.example.com", "other.example.com", &certB, http.StatusOK)
+
+	resp = expectStatus("off.example.com", "off.example.com", &certA, http.StatusOK)
+	if v := resp.Header.Get("Got-X-Client-Cert-Subject"); v != "" {
+		t.Fatalf("expected no subject, got %q", v)
+	}
+
+	// A connection set up for one host can not be used to skip the
+	// checks for another.
+	expectStatus("optional.example.com", "require.example.com", nil, http.StatusMisdirectedRequest)
+	expectStatus("optional.example.com", "other.example.com", &certA, http.StatusMisdirectedRequest)
+	expectStatus("off.example.com", "require.example.com", &certA, http.StatusMisdirectedRequest)
+
+	// Updated CAs are used without a restart.
+	_, err = clientset.CoreV1().Secrets("default").Update(ctx, caSecret("other-ca", caA), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("updating secret, %v", err)
+	}
+	time.Sleep(1 * time.Second)
+	expectStatus("other.example.com", "other.example.com", &certA, http.StatusOK)
+	expectRefused("other.example.com", &certB)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"flag"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -20,6 +21,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/sync/errgroup"
 
 	klog "k8s.io/klog/v2"
@@ -28,6 +30,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tcolgate/minke"
+	"go.opentelemetry.io/otel"
 )
 
 func init() {
@@ -41,14 +44,52 @@ var (
 	selector  = flag.String("l", "", "label selector to match ingresses")
 	class     = flag.String("class", "minke", "ingress class to match")
 
+	controllerName = flag.String("controller-name", minke.DefaultControllerName, "controller name IngressClasses must use for us to claim them")
+
 	adminAddr = flag.String("addr.admin", ":8080", "address to provide metrics")
 	httpAddr  = flag.String("addr.http", ":80", "address to serve http")
 	httpsAddr = flag.String("addr.https", ":443", "address to server http/http2/quic")
 
+	metricsProxyLabels  = flag.String("metrics.proxy-labels", "ingress,host,service", "comma separated list of the labels to add to proxy request metrics, from ingress, host and service")
+	metricsMaxLabelSets = flag.Int("metrics.max-label-sets", 1000, "maximum number of distinct label combinations for proxy request metrics, further combinations are recorded as other, 0 for no limit")
+
+	statusService   = flag.String("status.service", "", "NAMESPACE/NAME of a service whose load balancer addresses are published in ingress status")
+	statusAddresses = flag.String("status.addresses", "", "comma separated list of IPs or hostnames to publish in ingress status")
+
+	leaderLease    = flag.String("leader-elect.lease", "", "NAMESPACE/NAME of a Lease used to elect a leader for cluster writes, leave empty to disable leader election")
+	leaderIdentity = flag.String("leader-elect.identity", os.Getenv("POD_NAME"), "identity to use for leader election, defaults to the hostname")
+
+	defaultBackend = flag.String("default-backend", "", "NAMESPACE/NAME[:PORT] of a service to handle requests that match no ingress")
+
+	zone     = flag.String("zone", "", "topology zone we are running in, for zone aware balancing, read from the node's labels if not set")
+	nodeName = flag.String("node-name", os.Getenv("NODE_NAME"), "name of the node we are running on")
+
+	trustedProxies   = flag.String("forwarded.trusted-proxies", "", "comma separated list of CIDRs of proxies trusted to set X-Forwarded-* and Forwarded headers")
+	forwardedRFC7239 = flag.Bool("forwarded.rfc7239", false, "add an RFC 7239 Forwarded header to requests sent to backends")
+
+	proxyProtocolHTTP    = flag.Bool("proxy-protocol.http", false, "accept PROXY protocol headers on the http listener")
+	proxyProtocolHTTPS   = flag.Bool("proxy-protocol.https", false, "accept PROXY protocol headers on the https listener")
+	proxyProtocolSources = flag.String("proxy-protocol.trusted-cidrs", "", "comma separated list of CIDRs allowed to send PROXY protocol headers")
+
+	accessLogFormat = flag.String("access-log.format", "", "format of the access log written to stdout, one of json, common, combined, or a template using $variables, access logging is disabled if not set")
+	accessLogSample = flag.Float64("access-log.sample", 1.0, "ratio of requests to log, between 0 and 1")
+
+	acmeDirectory   = flag.String("acme.directory", "", "URL of an ACME directory to issue certificates for ingresses with the acme annotation, e.g. https://acme-v02.api.letsencrypt.org/directory, acme is disabled if not set")
+	acmeEmail       = flag.String("acme.email", "", "contact email address for the ACME account")
+	acmeAccount     = flag.String("acme.account-secret", "", "NAMESPACE/NAME of the secret holding the ACME account key and pending challenges, it must be in a watched namespace")
+	acmeChallenges  = flag.String("acme.challenges", "http-01,tls-alpn-01", "comma separated list of ACME challenge types to attempt, in order of preference")
+	acmeRenewBefore = flag.Duration("acme.renew-before", 30*24*time.Hour, "how long before expiry ACME certificates are renewed")
+
+	affinityKeyFile = flag.String("affinity.key-file", "", "file holding the key used to sign session affinity cookies, all replicas should share the key, a random key is used if not set")
+
 	httpRedir = flag.Bool("http.redirect-https", true, "What should the default http redirect bahviour be")
 
 	serverTLSDefaultSecrets = flag.String("tls.server.default.secrets", "", "comma separated list of the NAMESPACE/NAME of the default TLS secrets")
-	serverTLSClientCASecret = flag.String("tls.server.clientca.secret", "", "")
+	serverTLSClientCASecret = flag.String("tls.server.clientca.secret", "", "NAMESPACE/NAME of a secret whose ca.crt holds the CAs to verify client certificates against, it must be in a watched namespace, client certificates are not requested by default if not set")
+	serverTLSClientCAMode   = flag.String("tls.server.clientca.mode", "require", "whether clients must present a certificate by default, one of off, optional or require, ingresses may override this with annotations")
+	serverTLSClientSubject  = flag.String("tls.server.clientca.subject-header", "X-Client-Cert-Subject", "header used to pass the subject of a verified client certificate to backends, leave empty to disable")
+	serverTLSClientSANs     = flag.String("tls.server.clientca.sans-header", "X-Client-Cert-Sans", "header used to pass the subject alternative names of a verified client certificate to backends, leave empty to disable")
+	serverTLSClientFP       = flag.String("tls.server.clientca.fingerprint-header", "X-Client-Cert-Fingerprint", "header used to pass the SHA-256 fingerprint of a verified client certificate to backends, leave empty to disable")
 
 	clientTLSSecret = flag.String("tls.client.secret", "", "location cert to present for https client")
 	clientTLSCA     = flag.String("tls.client.ca.secret", "", "CA to trust for client connections")
@@ -80,10 +121,17 @@ func main() {
 
 	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 	registry.MustRegister(prometheus.NewGoCollector())
-	metricsprovider := minke.NewPrometheusMetrics(registry)
+	metricsprovider, err := minke.NewPrometheusMetrics(registry,
+		minke.ProxyMetricLabels(strings.Split(*metricsProxyLabels, ",")...),
+		minke.ProxyMetricMaxLabelSets(*metricsMaxLabelSets),
+	)
+	if err != nil {
+		klog.Fatalf("error creating metrics, %v", err)
+	}
 	minke.SetProvider(metricsprovider)
 
-	adminMux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	// OpenMetrics is needed to expose the trace exemplars.
+	adminMux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
 
 	clientset, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
@@ -135,6 +183,19 @@ func main() {
 		defaultSecrets = append(defaultSecrets, strings.TrimSpace(str))
 	}
 
+	var statusAddrs []string
+	for _, str := range strings.Split(*statusAddresses, ",") {
+		statusAddrs = append(statusAddrs, strings.TrimSpace(str))
+	}
+
+	var affinityKey []byte
+	if *affinityKeyFile != "" {
+		affinityKey, err = ioutil.ReadFile(*affinityKeyFile)
+		if err != nil {
+			klog.Fatalf("could not read affinity key, %v", err)
+		}
+	}
+
 	// we don't actually run this server. http3.SetQUICHeaders wants
 	// and instance of a server to discern the port from.
 	setquicheaders := (&http3.Server{
@@ -143,17 +204,62 @@ func main() {
 		},
 	}).SetQuicHeaders
 
-	ctrl, err := minke.New(
-		clientset,
+	opts := []minke.Option{
 		minke.WithNamespace(*namespace),
 		minke.WithClass(*class),
+		minke.WithControllerName(*controllerName),
 		minke.WithSelector(selector),
 		minke.WithDefaultHTTPRedirect(*httpRedir),
+		minke.WithDefaultBackend(*defaultBackend),
 		minke.WithDefaultTLSSecrets(defaultSecrets...),
 		minke.WithClientHTTPTransport(transport1),
 		minke.WithClientTLSSecret(*clientTLSSecret),
 		minke.WithSetQuicHeaders(setquicheaders),
+		minke.WithStatusService(*statusService),
+		minke.WithStatusAddresses(statusAddrs...),
+		minke.WithAffinityKey(affinityKey),
+		minke.WithTrustedProxies(strings.Split(*trustedProxies, ",")...),
+		minke.WithForwardedHeader(*forwardedRFC7239),
+		minke.WithZone(*zone),
+		minke.WithNodeName(*nodeName),
+	}
+
+	tp, err := newTracerProvider(ctx)
+	if err != nil {
+		klog.Fatalf("could not set up tracing, %v", err)
+	}
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+		opts = append(opts, minke.WithTracer(tp.Tracer("minke")))
+	}
+
+	if *accessLogFormat != "" {
+		accessLog := log.New(os.Stdout, "", 0)
+		opts = append(opts,
+			minke.WithAccessLogFunc(accessLog.Printf),
+			minke.WithAccessLogFormat(*accessLogFormat),
+			minke.WithAccessLogSampling(*accessLogSample),
+		)
+	}
+
+	if *acmeDirectory != "" {
+		opts = append(opts,
+			minke.WithACME(*acmeDirectory, *acmeEmail, *acmeAccount),
+			minke.WithACMEChallenges(strings.Split(*acmeChallenges, ",")...),
+			minke.WithACMERenewBefore(*acmeRenewBefore),
+		)
+	}
+
+	opts = append(opts,
+		minke.WithClientAuth(*serverTLSClientCASecret, *serverTLSClientCAMode),
+		minke.WithClientCertHeaders(*serverTLSClientSubject, *serverTLSClientSANs, *serverTLSClientFP),
 	)
+
+	if *leaderLease != "" {
+		opts = append(opts, minke.WithLeaderElection(*leaderLease, *leaderIdentity))
+	}
+
+	ctrl, err := minke.New(clientset, opts...)
 	if err != nil {
 		log.Fatalf("error creating controller, err = %v", err)
 		return
@@ -181,15 +287,36 @@ func main() {
 		return err
 	})
 
+	listen := func(addr string, proxyProto bool) (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil || !proxyProto {
+			return l, err
+		}
+		pl, err := minke.NewProxyProtocolListener(l, strings.Split(*proxyProtocolSources, ","))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return pl, nil
+	}
+
+	httpl, err := listen(*httpAddr, *proxyProtocolHTTP)
+	if err != nil {
+		klog.Fatalf("http listener error, %v", err)
+	}
+
 	server := &http.Server{
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		Addr:         *httpAddr,
 		Handler:      ctrl,
 	}
+	if pl, ok := httpl.(*minke.ProxyProtocolListener); ok {
+		server.ConnContext = pl.ConnContext
+	}
 
 	g.Go(func() error {
-		err := server.ListenAndServe()
+		err := server.Serve(httpl)
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Printf("http listener error, %v", err)
 		}
@@ -202,7 +329,22 @@ func main() {
 		MinVersion:               tlsMinVersion,
 		CipherSuites:             ciphers,
 		GetCertificate:           ctrl.GetCertificate,
+		// Set explicitly, the per client configs are copied before
+		// the http.Server would add h2.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if *acmeDirectory != "" {
+		// acme-tls/1 is only negotiated with ACME validators, which
+		// offer nothing else.
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+	ctrl.ConfigureServerTLS(tlsConfig)
+
+	httpsl, err := listen(*httpsAddr, *proxyProtocolHTTPS)
+	if err != nil {
+		klog.Fatalf("https listener error, %v", err)
 	}
+	tlsl := minke.NewProxyProtocolTLSListener(httpsl, metricsprovider.NewTLSServerMetrics(tlsConfig))
 
 	tlsServer := &http.Server{
 		ReadTimeout:  5 * time.Second,
@@ -210,15 +352,11 @@ func main() {
 		Addr:         *httpsAddr,
 		Handler:      ctrl,
 		TLSConfig:    tlsConfig,
+		ConnContext:  tlsl.ConnContext,
 	}
 
 	g.Go(func() error {
-		tlsl, err := tls.Listen("tcp", *httpsAddr, tlsConfig)
-		if err != nil {
-			klog.Errorf("https listener error, %v", err)
-			return err
-		}
-		err = tlsServer.Serve(tlsl)
+		err := tlsServer.Serve(tlsl)
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			klog.Errorf("https listener error, %v", err)
 			return err
@@ -247,6 +385,10 @@ func main() {
 	tlsServer.Shutdown(context.Background())
 	http3server.CloseGracefully(5 * time.Second)
 
+	if err := shutdownTracing(tp, 5*time.Second); err != nil {
+		klog.Errorf("error flushing traces, %v", err)
+	}
+
 	close(stop)
 
 	if err := ctx.Err(); err != nil && !errors.Is(err, context.Canceled) {
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/exporters/trace/jaeger"
+	"go.opentelemetry.io/otel/label"
+	exporttrace "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+)
+
+var (
+	tracingExporter   = flag.String("tracing.exporter", "", "trace exporter to use, one of otlp-grpc, otlp-http or jaeger, tracing is disabled if not set")
+	tracingEndpoint   = flag.String("tracing.endpoint", "", "address to send traces to, defaults to localhost:4317 for otlp-grpc, localhost:4318 for otlp-http and the agent on localhost:6831 for jaeger, a http(s) URL sends jaeger traces to a collector")
+	tracingInsecure   = flag.Bool("tracing.insecure", false, "disable TLS when sending traces over OTLP")
+	tracingHeaders    = flag.String("tracing.headers", "", "comma separated list of KEY=VALUE headers to send with OTLP exports")
+	tracingRatio      = flag.Float64("tracing.sample-ratio", 1.0, "ratio of new traces to sample, requests with a sampled parent are always sampled")
+	tracingAttributes = flag.String("tracing.resource-attributes", "", "comma separated list of KEY=VALUE attributes to add to the trace resource")
+	tracingBatchSize  = flag.Int("tracing.batch-size", sdktrace.DefaultMaxExportBatchSize, "maximum number of spans sent in each export")
+	tracingQueueSize  = flag.Int("tracing.queue-size", sdktrace.DefaultMaxQueueSize, "maximum number of spans queued for export, further spans are dropped")
+	tracingBatchDelay = flag.Duration("tracing.batch-timeout", sdktrace.DefaultBatchTimeout, "maximum time spans wait before being exported")
+)
+
+// parseKeyValues parses a comma separated list of KEY=VALUE pairs.
+func parseKeyValues(str string) (map[string]string, error) {
+	kvs := map[string]string{}
+	for _, kv := range strings.Split(str, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid KEY=VALUE pair %q", kv)
+		}
+		kvs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return kvs, nil
+}
+
+// newTraceResource describes this process, the pod and namespace are taken
+// from the POD_NAME and POD_NAMESPACE environment variables.
+func newTraceResource(ctx context.Context) (*resource.Resource, error) {
+	attrs := []label.KeyValue{
+		semconv.ServiceNameKey.String("minke"),
+	}
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		attrs = append(attrs, semconv.K8SPodNameKey.String(pod))
+	}
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		attrs = append(attrs, semconv.K8SNamespaceNameKey.String(ns))
+	}
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		attrs = append(attrs, label.String("k8s.node.name", node))
+	}
+
+	extra, err := parseKeyValues(*tracingAttributes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource attributes, %w", err)
+	}
+	for k, v := range extra {
+		attrs = append(attrs, label.String(k, v))
+	}
+
+	return resource.New(ctx, resource.WithAttributes(attrs...))
+}
+
+func newTraceExporter(ctx context.Context) (exporttrace.SpanExporter, error) {
+	headers, err := parseKeyValues(*tracingHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing headers, %w", err)
+	}
+
+	switch *tracingExporter {
+	case "otlp-grpc":
+		opts := []otlpgrpc.Option{otlpgrpc.WithHeaders(headers)}
+		if *tracingEndpoint != "" {
+			opts = append(opts, otlpgrpc.WithEndpoint(*tracingEndpoint))
+		}
+		if *tracingInsecure {
+			opts = append(opts, otlpgrpc.WithInsecure())
+		}
+		return otlp.NewExporter(ctx, otlpgrpc.NewDriver(opts...))
+	case "otlp-http":
+		endpoint := *tracingEndpoint
+		if endpoint == "" {
+			endpoint = "localhost:4318"
+		}
+		opts := []otlphttp.Option{
+			otlphttp.WithHeaders(headers),
+			otlphttp.WithEndpoint(endpoint),
+		}
+		if *tracingInsecure {
+			opts = append(opts, otlphttp.WithInsecure())
+		}
+		return otlp.NewExporter(ctx, otlphttp.NewDriver(opts...))
+	case "jaeger":
+		endpoint := jaeger.WithAgentEndpoint(*tracingEndpoint)
+		if *tracingEndpoint == "" {
+			endpoint = jaeger.WithAgentEndpoint("localhost:6831")
+		}
+		if strings.HasPrefix(*tracingEndpoint, "http://") || strings.HasPrefix(*tracingEndpoint, "https://") {
+			endpoint = jaeger.WithCollectorEndpoint(*tracingEndpoint)
+		}
+		return jaeger.NewRawExporter(endpoint)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", *tracingExporter)
+	}
+}
+
+// newTracerProvider sets up batched export of traces, as configured by
+// the tracing flags. It returns nil if tracing is disabled.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if *tracingExporter == "" {
+		return nil, nil
+	}
+
+	if *tracingRatio < 0 || *tracingRatio > 1 {
+		return nil, fmt.Errorf("sample ratio must be between 0 and 1, got %v", *tracingRatio)
+	}
+
+	res, err := newTraceResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	exp, err := newTraceExporter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*tracingRatio))
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sampler}),
+		sdktrace.WithResource(res),
+		sdktrace.WithBatcher(exp,
+			sdktrace.WithMaxExportBatchSize(*tracingBatchSize),
+			sdktrace.WithMaxQueueSize(*tracingQueueSize),
+			sdktrace.WithBatchTimeout(*tracingBatchDelay),
+		),
+	), nil
+}
+
+// shutdownTracing flushes any pending spans.
+func shutdownTracing(tp *sdktrace.TracerProvider, timeout time.Duration) error {
+	if tp == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return tp.Shutdown(ctx)
+}
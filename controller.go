@@ -17,11 +17,13 @@ import (
 	"golang.org/x/net/http2"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 	trace "go.opentelemetry.io/otel/trace"
 
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog/v2"
 
 	"k8s.io/client-go/kubernetes"
@@ -29,7 +31,6 @@ import (
 	unversionedcore "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	listcorev1 "k8s.io/client-go/listers/core/v1"
-	listnetworkingv1beta1 "k8s.io/client-go/listers/networking/v1beta1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 )
@@ -39,19 +40,41 @@ type Controller struct {
 	client         kubernetes.Interface
 	namespace      string
 	class          string
+	controllerName string
 	selector       labels.Selector
 	refresh        time.Duration
 	logFunc        func(string, ...interface{})
 	accessLogFunc  func(string, ...interface{})
 	setquicheaders func(http.Header) error
 
+	accessLogFormat string
+	accessLogSample float64
+
 	defaultHTTPRedir bool
 
 	defaultBackendNamespace string
 	defaultBackendName      string
+	defaultBackendPort      string
 
 	defaultTLSSecrets []secretKey
 
+	affinityKey []byte
+
+	trustedProxies  []*net.IPNet
+	forwardedHeader bool
+
+	statusService   *svcKey
+	statusAddresses []apiv1.LoadBalancerIngress
+
+	acmeDirectory   string
+	acmeEmail       string
+	acmeAccount     secretKey
+	acmeChallenges  []string
+	acmeRenewBefore time.Duration
+
+	clientAuthPolicy  *clientAuthPolicy // the default client auth, nil if disabled
+	clientCertHeaders clientCertHeaders
+
 	clientTransport           *http.Transport
 	clientHTTP2Transport      *http2.Transport
 	clientTLSSecretNamespace  string
@@ -60,7 +83,13 @@ type Controller struct {
 	clientTLSCertificateMutex sync.RWMutex
 
 	ingProc *processor
-	ingList listnetworkingv1beta1.IngressLister
+	ingV1   bool // true if we are using networking.k8s.io/v1 Ingresses
+
+	epsSlices bool // true if we are using EndpointSlices
+	nodeName  string
+	zone      string
+
+	clsProc *processor
 
 	svcProc *processor
 	svcList listcorev1.ServiceLister
@@ -69,8 +98,8 @@ type Controller struct {
 	secList listcorev1.SecretLister
 
 	epsProc *processor
-	epsList listcorev1.EndpointsLister
 
+	leader    *leaderElection
 	recorder  record.EventRecorder
 	hasSynced func() bool
 
@@ -82,13 +111,23 @@ type Controller struct {
 	proxy *httputil.ReverseProxy
 	http.Handler
 
-	metrics MetricsProvider
-	tracer  trace.Tracer
+	metrics      MetricsProvider
+	splitMetric  TrafficSplitMetric
+	mirrorMetric MirrorMetric
+	certMetric   CertificateMetric
+	mirrorSem    chan struct{} // limits outstanding mirrored requests
+	tracer       trace.Tracer
+	propagator   propagation.TextMapPropagator
+
+	ings    *ingressSet    // Hostnames to ingress mapping and certs
+	classes *classSet      // IngressClasses that we own
+	svc     *svcUpdater    // Service to ports/protocols mapping
+	eps     *epsSet        // Service to endpoints mapping
+	secs    *secUpdater    // Secrets
+	status  *statusUpdater // Ingress status publishing, nil if disabled
+	acme    *acmeManager   // ACME certificate issuance, nil if disabled
 
-	ings *ingressSet // Hostnames to ingress mapping and certs
-	svc  *svcUpdater // Service to ports/protocols mapping
-	eps  *epsSet     // Service to endpoints mapping
-	secs *secUpdater // Secrets
+	clientAuth *clientAuthSet // Client certificate policies and CAs
 
 	certMap *certMap
 }
@@ -104,6 +143,15 @@ func WithClass(cls string) Option {
 	}
 }
 
+// WithControllerName is an option for setting the controller name that
+// IngressClasses must specify for us to claim them.
+func WithControllerName(name string) Option {
+	return func(c *Controller) error {
+		c.controllerName = name
+		return nil
+	}
+}
+
 // WithNamespace is an option for setting the set of namespaces to watch
 func WithNamespace(ns string) Option {
 	return func(c *Controller) error {
@@ -121,10 +169,14 @@ func WithSelector(s labels.Selector) Option {
 	}
 }
 
-// WithDefaultBackend sets the backend to be used as defaultBackend when none
-// is specified
+// WithDefaultBackend sets the backend to be used for requests that do not
+// match any ingress, in the form of NAMESPACE/NAME[:PORT]. PORT may be a port
+// name or number, and can be omitted for single port services.
 func WithDefaultBackend(str string) Option {
 	return func(c *Controller) error {
+		if str == "" {
+			return nil
+		}
 		parts := strings.SplitN(str, "/", 2)
 		if len(parts) != 2 {
 			return fmt.Errorf("default backend service should be in the for of NAMESPACE/NAME")
@@ -132,6 +184,10 @@ func WithDefaultBackend(str string) Option {
 
 		c.defaultBackendNamespace = parts[0]
 		c.defaultBackendName = parts[1]
+		if i := strings.LastIndex(parts[1], ":"); i != -1 {
+			c.defaultBackendName = parts[1][:i]
+			c.defaultBackendPort = parts[1][i+1:]
+		}
 		return nil
 	}
 }
@@ -258,16 +314,28 @@ func New(client kubernetes.Interface, opts ...Option) (*Controller, error) {
 	c := Controller{
 		client:               client,
 		class:                "minke",
+		controllerName:       DefaultControllerName,
 		namespace:            metav1.NamespaceAll,
 		selector:             labels.Everything(),
 		metrics:              metricsProvider,
 		tracer:               otel.Tracer("minke"),
+		propagator:           defaultPropagator(),
 		clientTransport:      transport1,
 		clientHTTP2Transport: transport2,
 
 		ings:             &ingressSet{},
+		classes:          &classSet{},
+		leader:           &leaderElection{},
 		eps:              &epsSet{},
+		mirrorSem:        make(chan struct{}, mirrorMaxInFlight),
 		defaultHTTPRedir: true,
+		accessLogFormat:  AccessLogCombined,
+		accessLogSample:  1,
+		clientCertHeaders: clientCertHeaders{
+			subject:     "X-Client-Cert-Subject",
+			sans:        "X-Client-Cert-Sans",
+			fingerprint: "X-Client-Cert-Fingerprint",
+		},
 	}
 
 	for _, opt := range opts {
@@ -276,9 +344,17 @@ func New(client kubernetes.Interface, opts ...Option) (*Controller, error) {
 		}
 	}
 
+	if c.affinityKey == nil {
+		c.affinityKey = randomAffinityKey()
+	}
+
 	// TODO(): verify that any default secrets are in the same namespace as any
 	// namespace, or the watch wont see them. (or stop using listwatch for secrets)
 
+	if c.logFunc == nil {
+		c.logFunc = klog.Infof
+	}
+
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(c.logFunc)
 	eventBroadcaster.StartRecordingToSink(&unversionedcore.EventSinkImpl{
@@ -287,12 +363,36 @@ func New(client kubernetes.Interface, opts ...Option) (*Controller, error) {
 	c.recorder = eventBroadcaster.NewRecorder(scheme.Scheme,
 		apiv1.EventSource{Component: "loadbalancer-controller"})
 
+	if c.metrics != nil {
+		c.leader.metric = c.metrics.NewLeaderElectionMetric(c.leader.name)
+		c.splitMetric = c.metrics.NewTrafficSplitMetric()
+		c.mirrorMetric = c.metrics.NewMirrorMetric()
+		c.certMetric = c.metrics.NewCertificateMetric(func() []CertificateInfo {
+			return c.certMap.certificates()
+		})
+	}
+
 	ctx := context.Background()
+	c.setupClientAuth()
 	c.setupSecretProcess(ctx)
 
+	c.ingV1 = ingressV1Available(c.client)
+	c.epsSlices = endpointSlicesAvailable(c.client)
+
+	if c.zone == "" && c.nodeName != "" {
+		zone, err := c.lookupZone(ctx)
+		if err != nil {
+			klog.Errorf("zone aware balancing disabled, %v", err)
+		}
+		c.zone = zone
+	}
+
 	c.setupServiceProcess(ctx)
 	c.setupEndpointsProcess(ctx)
+	c.setupClassProcess(ctx)
 	c.setupIngProcess(ctx)
+	c.setupStatusProcess(ctx)
+	c.setupACMEProcess(ctx)
 
 	if c.clientTransport.TLSClientConfig == nil {
 		c.clientTransport.TLSClientConfig = &tls.Config{}
@@ -308,6 +408,14 @@ func New(client kubernetes.Interface, opts ...Option) (*Controller, error) {
 		return net.Dial(netw, addr)
 	}
 
+	if c.metrics != nil {
+		dial := c.clientTransport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		c.clientTransport.DialContext = c.metrics.NewHTTPDialMetrics(dial)
+	}
+
 	c.transport = &httpTransport{
 		base:  c.clientTransport,
 		http2: c.clientHTTP2Transport,
@@ -317,11 +425,20 @@ func New(client kubernetes.Interface, opts ...Option) (*Controller, error) {
 		c.transport = c.metrics.NewHTTPTransportMetrics(c.transport)
 	}
 
+	if c.tracer != nil {
+		c.transport = &tracingTransport{
+			tracer:     c.tracer,
+			propagator: c.propagator,
+			base:       c.transport,
+		}
+	}
+
 	c.proxy = &httputil.ReverseProxy{
-		Director:      c.director,
-		FlushInterval: 10 * time.Millisecond,
-		ErrorHandler:  c.errorHandler,
-		Transport:     c.transport,
+		Director:       c.director,
+		ModifyResponse: c.modifyResponse,
+		FlushInterval:  10 * time.Millisecond,
+		ErrorHandler:   c.errorHandler,
+		Transport:      c.transport,
 	}
 
 	c.Handler = http.HandlerFunc(c.handler)
@@ -331,12 +448,22 @@ func New(client kubernetes.Interface, opts ...Option) (*Controller, error) {
 	}
 
 	if c.tracer != nil {
-		c.Handler = addInboundTracing(c.tracer, c.Handler)
+		c.Handler = addInboundTracing(c.tracer, c.propagator, c.Handler)
 	}
 
 	return &c, nil
 }
 
+// recordEventf records an event against obj. Only the leader records
+// events, so that replicas do not duplicate them.
+func (c *Controller) recordEventf(obj interface{}, eventtype, reason, messageFmt string, args ...interface{}) {
+	robj, ok := obj.(runtime.Object)
+	if !ok || c.recorder == nil || !c.IsLeader() {
+		return
+	}
+	c.recorder.Eventf(robj, eventtype, reason, messageFmt, args...)
+}
+
 func (c *Controller) Run(stopCh <-chan struct{}) {
 	// we need the secrets cache up to preload the
 	// default secrets.
@@ -345,26 +472,46 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 		stopCh,
 		c.secProc.hasSynced) {
 	}
+	c.secs.startFirstPass(c.secProc.informer.GetStore().ListKeys())
 	go c.secProc.runWorker()
 
 	c.certMap.setDefaults(c.defaultTLSSecrets)
 
+	synced := []cache.InformerSynced{
+		c.ingProc.hasSynced,
+		c.svcProc.hasSynced,
+		c.epsProc.hasSynced,
+		c.secProc.hasSynced,
+	}
+
 	go c.svcProc.run(stopCh)
 	go c.epsProc.run(stopCh)
+	if c.clsProc != nil {
+		go c.clsProc.run(stopCh)
+		synced = append(synced, c.clsProc.hasSynced)
+	}
 	go c.ingProc.run(stopCh)
 
-	if !cache.WaitForCacheSync(
-		stopCh,
-		c.ingProc.hasSynced,
-		c.svcProc.hasSynced,
-		c.epsProc.hasSynced,
-		c.secProc.hasSynced) {
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 	}
 
+	if c.clsProc != nil {
+		go c.clsProc.runWorker()
+	}
 	go c.ingProc.runWorker()
 	go c.svcProc.runWorker()
 	go c.epsProc.runWorker()
 
+	if c.status != nil {
+		go c.status.run(stopCh)
+	}
+
+	if c.acme != nil {
+		go c.acme.run(stopCh)
+	}
+
+	go c.runLeaderElection(stopCh)
+
 	<-stopCh
 }
 
@@ -373,15 +520,25 @@ func (c *Controller) Stop() {
 	defer c.stopLock.Unlock()
 
 	if !c.stopping {
+		if c.clsProc != nil {
+			c.clsProc.queue.ShutDown()
+		}
 		c.ingProc.queue.ShutDown()
 		c.svcProc.queue.ShutDown()
 		c.secProc.queue.ShutDown()
 		c.epsProc.queue.ShutDown()
+		if c.status != nil {
+			c.status.queue.ShutDown()
+		}
+		if c.acme != nil {
+			c.acme.queue.ShutDown()
+		}
 	}
 }
 
 func (c *Controller) HasSynced() bool {
-	return (c.ingProc.informer.HasSynced() &&
+	return ((c.clsProc == nil || c.clsProc.informer.HasSynced()) &&
+		c.ingProc.informer.HasSynced() &&
 		c.svcProc.informer.HasSynced() &&
 		c.secProc.informer.HasSynced() &&
 		c.epsProc.informer.HasSynced())
@@ -403,9 +560,29 @@ func (c *Controller) ServeReadyzHTTP(w http.ResponseWriter, r *http.Request) {
 func (c *Controller) MarshalJSON() ([]byte, error) {
 	status := map[string]interface{}{
 		"ingresses": c.ings,
+		"classes":   c.classes,
 		"certs":     c.certMap,
 		"endpoints": c.eps,
+		"leader":    c.leader,
+	}
+	if c.defaultBackendName != "" {
+		status["defaultBackend"] = serviceKey{
+			namespace: c.defaultBackendNamespace,
+			name:      c.defaultBackendName,
+			portName:  c.defaultBackendPort,
+		}
+	}
+	if c.status != nil {
+		status["statusAddresses"] = c.status
+	}
+	if c.acme != nil {
+		status["acme"] = c.acme
+	}
+	status["clientAuth"] = c.clientAuth
+	if c.zone != "" {
+		status["zone"] = c.zone
 	}
+	status["endpointSlices"] = c.epsSlices
 	return json.Marshal(status)
 }
 
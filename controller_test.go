@@ -8,20 +8,29 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	fakediscovery "k8s.io/client-go/discovery/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestTest(t *testing.T) {
@@ -206,7 +215,10 @@ func BenchmarkMinke(b *testing.B) {
 		},
 	)
 
-	mp := NewPrometheusMetrics(prometheus.NewRegistry())
+	mp, err := NewPrometheusMetrics(prometheus.NewRegistry())
+	if err != nil {
+		b.Fatalf("error creating metrics, err = %v", err)
+	}
 	ctrl, err := New(clientset, WithMetricsProvider(mp))
 	if err != nil {
 		b.Fatalf("error creating controller, err = %v", err)
@@ -424,6 +436,174 @@ func TestWebsocket(t *testing.T) {
 
 }
 
+// TestWebsocket_metrics upgrades a connection through a controller with
+// metrics enabled. Metrics and tracing both wrap the ResponseWriter, the
+// upgrade must still be able to hijack the connection.
+func TestWebsocket_metrics(t *testing.T) {
+	var upgrader = websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error("ws server upgrade:", err)
+			return
+		}
+		defer c.Close()
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil {
+				break
+			}
+			if err := c.WriteMessage(mt, message); err != nil {
+				t.Error("ws server write:", err)
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	cp, _ := strconv.Atoi(u.Port())
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "first",
+											ServicePort: intstr.FromString("mysvc"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "mysvc"}},
+			},
+		},
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "mysvc", Port: int32(cp)}},
+				},
+			},
+		},
+	)
+
+	mp, err := NewPrometheusMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("error creating metrics, err = %v", err)
+	}
+	ctrl, err := New(clientset, WithMetricsProvider(mp))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	h := http.Header{}
+	h.Set("Host", "blah")
+	ctrlu, _ := url.Parse(pts.URL)
+	ctrlu.Scheme = "ws"
+	ctrlu.Path = "/"
+
+	c, _, err := websocket.DefaultDialer.DialContext(ctx, ctrlu.String(), h)
+	if err != nil {
+		t.Fatal("ws client dial:", err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("ws client write, %v", err)
+	}
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ws client read failed, %v", err)
+	}
+	if string(message) != "hello" {
+		t.Fatalf("read expected %q, got %q", "hello", message)
+	}
+}
+
+// TestResponseWriterInterfaces checks that our ResponseWriter wrappers
+// keep the optional interfaces that the ReverseProxy of older Go releases
+// looks for directly, rather than through http.ResponseController.
+func TestResponseWriterInterfaces(t *testing.T) {
+	mp, err := NewPrometheusMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("error creating metrics, err = %v", err)
+	}
+
+	checked := make(chan string, 1)
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var missing []string
+		if _, ok := w.(http.Flusher); !ok {
+			missing = append(missing, "Flusher")
+		}
+		if _, ok := w.(http.CloseNotifier); !ok {
+			missing = append(missing, "CloseNotifier")
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			missing = append(missing, "Hijacker")
+			checked <- strings.Join(missing, ",")
+			return
+		}
+		checked <- strings.Join(missing, ",")
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			t.Errorf("hijack failed, %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nOK")
+		brw.Flush()
+	})
+	h = mp.NewHTTPServerMetrics(h)
+	h = addInboundTracing(otel.Tracer("minke"), defaultPropagator(), h)
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("request failed, %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if missing := <-checked; missing != "" {
+		t.Fatalf("wrapped ResponseWriter is missing %s", missing)
+	}
+	if string(body) != "OK" {
+		t.Fatalf("expected a response from the hijacked connection, got %q", body)
+	}
+}
+
 func TestHTTP2Backend(t *testing.T) {
 	h2s := &http2.Server{}
 
@@ -544,3 +724,451 @@ func TestHTTP2Backend(t *testing.T) {
 
 	t.Logf("http2 http resp body: %s", bs)
 }
+
+func TestIngressV1(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	cp, _ := strconv.Atoi(u.Port())
+	clientset := fake.NewSimpleClientset(
+		&networkingv1.Ingress{
+			TypeMeta: metav1.TypeMeta{
+				Kind: "Ingress",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+				},
+			},
+			Spec: networkingv1.IngressSpec{
+				Rules: []networkingv1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1.IngressRuleValue{
+							HTTP: &networkingv1.HTTPIngressRuleValue{
+								Paths: []networkingv1.HTTPIngressPath{
+									{
+										Backend: networkingv1.IngressBackend{
+											Service: &networkingv1.IngressServiceBackend{
+												Name: "first",
+												Port: networkingv1.ServiceBackendPort{Number: 8080},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		&corev1.Service{
+			TypeMeta: metav1.TypeMeta{
+				Kind: "Service",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Name: "mysvc", Port: 8080},
+				},
+			},
+		},
+		&corev1.Endpoints{
+			TypeMeta: metav1.TypeMeta{
+				Kind: "Endpoints",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "first",
+			},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{
+						{IP: u.Hostname()},
+					},
+					Ports: []corev1.EndpointPort{
+						{Name: "mysvc", Port: int32(cp)},
+					},
+				},
+			},
+		},
+	)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: networkingv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "ingresses", Namespaced: true, Kind: "Ingress"},
+				{Name: "ingressclasses", Kind: "IngressClass"},
+			},
+		},
+	}
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+		return
+	}
+	if !ctrl.ingV1 {
+		t.Fatalf("expected networking.k8s.io/v1 ingresses to be used")
+	}
+	if ctrl.clsProc == nil {
+		t.Fatalf("expected ingress classes to be watched")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	req, _ := http.NewRequest("GET", pts.URL+"/hello", nil)
+	req.Host = "blah"
+	resp, err := pts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", resp.StatusCode)
+	}
+}
+
+func TestIngressClassesUnavailable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	cp, _ := strconv.Atoi(u.Port())
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "first",
+											ServicePort: intstr.FromInt(8080),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{Name: "mysvc", Port: 8080},
+				},
+			},
+		},
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "first",
+			},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{
+						{IP: u.Hostname()},
+					},
+					Ports: []corev1.EndpointPort{
+						{Name: "mysvc", Port: int32(cp)},
+					},
+				},
+			},
+		},
+	)
+	// servers before 1.18 have no IngressClass API, listing them fails
+	clientset.PrependReactor("list", "ingressclasses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(networkingv1beta1.Resource("ingressclasses"), "")
+	})
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	if ctrl.clsProc != nil {
+		t.Fatalf("did not expect ingress classes to be watched")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	if !ctrl.HasSynced() {
+		t.Fatalf("expected the controller to have synced")
+	}
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	req, _ := http.NewRequest("GET", pts.URL+"/hello", nil)
+	req.Host = "blah"
+	resp, err := pts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", resp.StatusCode)
+	}
+}
+
+func TestIngressStatus(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			TypeMeta: metav1.TypeMeta{
+				Kind: "Ingress",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": "minke",
+				},
+			},
+		},
+		&networkingv1beta1.Ingress{
+			TypeMeta: metav1.TypeMeta{
+				Kind: "Ingress",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "second",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": "other",
+				},
+			},
+		},
+	)
+
+	ctrl, err := New(clientset, WithStatusAddresses("10.0.0.1", "lb.example.com"))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	ing, err := clientset.NetworkingV1beta1().Ingresses("default").Get(ctx, "first", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting ingress, err = %v", err)
+	}
+	if len(ing.Status.LoadBalancer.Ingress) != 2 {
+		t.Fatalf("expected 2 addresses in status, got %v", ing.Status.LoadBalancer.Ingress)
+	}
+
+	ing, err = clientset.NetworkingV1beta1().Ingresses("default").Get(ctx, "second", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting ingress, err = %v", err)
+	}
+	if len(ing.Status.LoadBalancer.Ingress) != 0 {
+		t.Fatalf("expected no addresses in status, got %v", ing.Status.LoadBalancer.Ingress)
+	}
+}
+
+func TestIngressStatus_service(t *testing.T) {
+	ingress := func(name, class string, addrs ...string) *networkingv1beta1.Ingress {
+		ing := &networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": class,
+				},
+			},
+		}
+		for _, addr := range addrs {
+			ing.Status.LoadBalancer.Ingress = append(ing.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: addr})
+		}
+		return ing
+	}
+	service := func(addr string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "lb", Namespace: "default"},
+			Status: corev1.ServiceStatus{
+				LoadBalancer: corev1.LoadBalancerStatus{
+					Ingress: []corev1.LoadBalancerIngress{{IP: addr}},
+				},
+			},
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		service("192.0.2.1"),
+		ingress("first", "minke", "192.0.2.1"),
+		ingress("second", "minke"),
+	)
+
+	var mu sync.Mutex
+	updates := map[string]int{}
+	clientset.PrependReactor("update", "ingresses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" {
+			obj := action.(k8stesting.UpdateAction).GetObject().(*networkingv1beta1.Ingress)
+			mu.Lock()
+			updates[obj.Name]++
+			mu.Unlock()
+		}
+		return false, nil, nil
+	})
+
+	ctrl, err := New(clientset, WithStatusService("default/lb"))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	status := func(name string) []corev1.LoadBalancerIngress {
+		ing, err := clientset.NetworkingV1beta1().Ingresses("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("error getting ingress, err = %v", err)
+		}
+		return ing.Status.LoadBalancer.Ingress
+	}
+
+	if got := status("second"); len(got) != 1 || got[0].IP != "192.0.2.1" {
+		t.Fatalf("expected the service address in status, got %v", got)
+	}
+	// The status was already correct, it should not have been cleared
+	// while the service was unknown.
+	mu.Lock()
+	if updates["first"] != 0 {
+		t.Errorf("expected no status updates to first, got %d", updates["first"])
+	}
+	mu.Unlock()
+
+	// While we are not leading, second is released and the address
+	// changes, so the status of second is one we published before.
+	ctrl.leader.setLeader(false)
+	second, _ := clientset.NetworkingV1beta1().Ingresses("default").Get(ctx, "second", metav1.GetOptions{})
+	second.Annotations["kubernetes.io/ingress.class"] = "other"
+	if _, err := clientset.NetworkingV1beta1().Ingresses("default").Update(ctx, second, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating ingress, err = %v", err)
+	}
+	if _, err := clientset.CoreV1().Services("default").UpdateStatus(ctx, service("192.0.2.2"), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("error updating service, err = %v", err)
+	}
+	time.Sleep(1 * time.Second)
+
+	ctrl.leader.setLeader(true)
+	ctrl.status.enqueueAll()
+	time.Sleep(1 * time.Second)
+
+	if got := status("first"); len(got) != 1 || got[0].IP != "192.0.2.2" {
+		t.Errorf("expected the new service address in status, got %v", got)
+	}
+	if got := status("second"); len(got) != 0 {
+		t.Errorf("expected the old status to be removed, got %v", got)
+	}
+}
+
+func TestIngressStatus_owner(t *testing.T) {
+	owner := DefaultControllerName + "/minke"
+	ingress := func(name, class, owner string, addrs ...string) *networkingv1beta1.Ingress {
+		ing := &networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": class,
+				},
+			},
+		}
+		if owner != "" {
+			ing.Annotations[annStatusOwner] = owner
+		}
+		for _, addr := range addrs {
+			ing.Status.LoadBalancer.Ingress = append(ing.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: addr})
+		}
+		return ing
+	}
+
+	// The addresses in the status of released and foreign are not ones
+	// this controller has seen, as if they were published before a
+	// restart.
+	clientset := fake.NewSimpleClientset(
+		ingress("first", "minke", ""),
+		ingress("released", "other", owner, "192.0.2.9"),
+		ingress("foreign", "other", "", "192.0.2.9"),
+		ingress("elsewhere", "other", DefaultControllerName+"/other", "192.0.2.9"),
+	)
+
+	ctrl, err := New(clientset, WithStatusAddresses("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	get := func(name string) *networkingv1beta1.Ingress {
+		ing, err := clientset.NetworkingV1beta1().Ingresses("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("error getting ingress, err = %v", err)
+		}
+		return ing
+	}
+
+	tests := []struct {
+		name  string
+		owner string
+		addrs []string
+	}{
+		{"first", owner, []string{"192.0.2.1"}},
+		{"released", "", nil},
+		{"foreign", "", []string{"192.0.2.9"}},
+		{"elsewhere", DefaultControllerName + "/other", []string{"192.0.2.9"}},
+	}
+	for _, tt := range tests {
+		ing := get(tt.name)
+		if got := ing.Annotations[annStatusOwner]; got != tt.owner {
+			t.Errorf("%s: expected status owner %q, got %q", tt.name, tt.owner, got)
+		}
+		var got []string
+		for _, addr := range ing.Status.LoadBalancer.Ingress {
+			got = append(got, addr.IP)
+		}
+		if !reflect.DeepEqual(got, tt.addrs) {
+			t.Errorf("%s: expected status %v, got %v", tt.name, tt.addrs, got)
+		}
+	}
+}
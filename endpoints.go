@@ -4,16 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"sync"
-	"sync/atomic"
 
 	corev1 "k8s.io/api/core/v1"
-	networkingv1beta1 "k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 
-	listcorev1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
@@ -35,13 +33,51 @@ func (sk serviceKey) MarshalJSON() ([]byte, error) {
 }
 
 type serviceAddrSet struct {
-	addrs []serviceAddr
-	index uint64
+	sync.Mutex
+	addrs     []serviceAddr
+	balancers map[balancerSpec]balancer
+}
+
+// update replaces the set of addresses, and passes them on to any
+// balancers that have been created for this service.
+func (set *serviceAddrSet) update(addrs []serviceAddr) {
+	set.Lock()
+	defer set.Unlock()
+	set.addrs = addrs
+	for _, b := range set.balancers {
+		b.update(addrs)
+	}
+}
+
+func (set *serviceAddrSet) getAddrs() []serviceAddr {
+	set.Lock()
+	defer set.Unlock()
+	return set.addrs
+}
+
+// getBalancer returns the balancer for the spec, creating it if needed.
+func (set *serviceAddrSet) getBalancer(spec balancerSpec) balancer {
+	set.Lock()
+	defer set.Unlock()
+	b, ok := set.balancers[spec]
+	if !ok {
+		if set.balancers == nil {
+			set.balancers = make(map[balancerSpec]balancer)
+		}
+		b = newBalancer(spec)
+		b.update(set.addrs)
+		set.balancers[spec] = b
+	}
+	return b
 }
 
 type serviceAddr struct {
-	addr string
-	port int
+	addr   string
+	port   int
+	target string // name of the pod, if known
+	node   string // name of the node, if known
+	zone   string // topology zone, if known
+	weight int
 }
 
 func (sa serviceAddr) String() string {
@@ -67,48 +103,54 @@ func (eps *epsSet) MarshalJSON() ([]byte, error) {
 	strmap := map[string][]string{}
 	for k, vs := range eps.set {
 		kstr := k.String()
-		for _, v := range vs.addrs {
+		for _, v := range vs.getAddrs() {
 			strmap[kstr] = append(strmap[kstr], v.String())
 		}
 	}
 	return json.Marshal(strmap)
 }
 
-func backendToServiceKey(namespace string, b *networkingv1beta1.IngressBackend) serviceKey {
-	if b.ServicePort.IntVal != 0 {
-		return serviceKey{
-			namespace: namespace,
-			name:      b.ServiceName,
-		}
-	}
-	return serviceKey{
-		namespace: namespace,
-		name:      b.ServiceName,
-		portName:  b.ServicePort.String(),
-	}
-}
-
 type epsUpdater struct {
 	c *Controller
 }
 
-func (eps *epsSet) getNextAddr(key serviceKey) serviceAddr {
+// pick selects an address for the service using the given balancer. The
+// returned function must be called once the request is complete.
+func (eps *epsSet) pick(key serviceKey, spec balancerSpec, r *http.Request) (serviceAddr, func()) {
 	eps.RLock()
 	set := eps.set[key]
 	eps.RUnlock()
 	if set == nil {
-		return serviceAddr{}
+		return serviceAddr{}, noop
 	}
-	count := atomic.AddUint64(&set.index, 1)
-	addr := set.addrs[count%uint64(len(set.addrs))]
-	return addr
+	return set.getBalancer(spec).pick(r)
+}
+
+// acquire counts a request to an address that was chosen without calling
+// pick, for balancers that track in flight requests. The returned function
+// must be called once the request is complete.
+func (eps *epsSet) acquire(key serviceKey, spec balancerSpec, addr serviceAddr) func() {
+	eps.RLock()
+	set := eps.set[key]
+	eps.RUnlock()
+	if set == nil {
+		return noop
+	}
+	if a, ok := set.getBalancer(spec).(acquirer); ok {
+		return a.acquire(addr)
+	}
+	return noop
 }
 
 func (eps *epsSet) getActiveAddrs(key serviceKey) []serviceAddr {
 	eps.RLock()
-	defer eps.RUnlock()
+	set := eps.set[key]
+	eps.RUnlock()
+	if set == nil {
+		return nil
+	}
 
-	return eps.set[key].addrs
+	return set.getAddrs()
 }
 
 func (u *epsUpdater) addItem(obj interface{}) error {
@@ -117,25 +159,12 @@ func (u *epsUpdater) addItem(obj interface{}) error {
 		return fmt.Errorf("interface was not an ingress %T", obj)
 	}
 
-	portlessKey := serviceKey{
-		namespace: eps.Namespace,
-		name:      eps.Name,
-	}
-
-	addrsset := make(map[serviceKey]*serviceAddrSet)
+	weights := u.c.svc.getEndpointWeights(eps.Namespace, eps.Name)
+	addrsset := make(map[serviceKey][]serviceAddr)
 
 	for i := range eps.Subsets {
 		set := eps.Subsets[i]
 
-		for j := range set.Addresses {
-			if addrsset[portlessKey] == nil {
-				addrsset[portlessKey] = &serviceAddrSet{}
-			}
-			addrsset[portlessKey].addrs = append(addrsset[portlessKey].addrs, serviceAddr{
-				addr: set.Addresses[j].IP,
-			})
-		}
-
 		for j := range set.Ports {
 			key := serviceKey{
 				namespace: eps.Namespace,
@@ -146,28 +175,54 @@ func (u *epsUpdater) addItem(obj interface{}) error {
 			port := set.Ports[j].Port
 
 			for j := range set.Addresses {
-				if addrsset[key] == nil {
-					addrsset[key] = &serviceAddrSet{}
-				}
-				addrsset[key].addrs = append(addrsset[key].addrs, serviceAddr{
+				addr := serviceAddr{
 					addr: set.Addresses[j].IP,
 					port: int(port),
-				})
+				}
+				if ref := set.Addresses[j].TargetRef; ref != nil && ref.Kind == "Pod" {
+					addr.target = ref.Name
+				}
+				if set.Addresses[j].NodeName != nil {
+					addr.node = *set.Addresses[j].NodeName
+				}
+				addr.weight = weights.weight(addr)
+				addrsset[key] = append(addrsset[key], addr)
 			}
 		}
 	}
 
 	u.c.eps.Lock()
-	if u.c.eps.set == nil {
-		u.c.eps.set = make(map[serviceKey]*serviceAddrSet)
+	defer u.c.eps.Unlock()
+	u.c.eps.updateService(eps.Namespace, eps.Name, addrsset)
+
+	return nil
+}
+
+// updateService replaces the addresses of all the ports of a service. The
+// caller must hold the lock.
+func (eps *epsSet) updateService(namespace, name string, addrsset map[serviceKey][]serviceAddr) {
+	if eps.set == nil {
+		eps.set = make(map[serviceKey]*serviceAddrSet)
 	}
 
+	// ports may have been removed from the service, so we clear
+	// out anything we no longer have addresses for. Existing sets
+	// are updated in place to preserve any balancer state.
+	for key := range eps.set {
+		if key.namespace == namespace &&
+			key.name == name {
+			if _, ok := addrsset[key]; !ok {
+				delete(eps.set, key)
+			}
+		}
+	}
 	for k, v := range addrsset {
-		u.c.eps.set[k] = v
+		if set, ok := eps.set[k]; ok {
+			set.update(v)
+			continue
+		}
+		eps.set[k] = &serviceAddrSet{addrs: v}
 	}
-	u.c.eps.Unlock()
-
-	return nil
 }
 
 func (u *epsUpdater) clearEndpoints(name, namespace string) {
@@ -187,12 +242,16 @@ func (u *epsUpdater) delItem(obj interface{}) error {
 
 	u.c.eps.Lock()
 	defer u.c.eps.Unlock()
-	u.clearEndpoints(eps.Namespace, eps.Name)
+	u.clearEndpoints(eps.Name, eps.Namespace)
 
 	return nil
 }
 
 func (c *Controller) setupEndpointsProcess(ctx context.Context) error {
+	if c.epsSlices {
+		return c.setupEndpointSlicesProcess(ctx)
+	}
+
 	upd := &epsUpdater{c}
 
 	c.epsProc = makeProcessor(
@@ -209,7 +268,5 @@ func (c *Controller) setupEndpointsProcess(ctx context.Context) error {
 		upd,
 	)
 
-	c.epsList = listcorev1.NewEndpointsLister(c.epsProc.informer.GetIndexer())
-
 	return nil
 }
@@ -0,0 +1,40 @@
+package minke
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEndpoints_delItem(t *testing.T) {
+	first := serviceKey{namespace: "default", name: "first", portName: "http"}
+	firstAdmin := serviceKey{namespace: "default", name: "first", portName: "admin"}
+	second := serviceKey{namespace: "default", name: "second", portName: "http"}
+	addrs := []serviceAddr{{addr: "10.0.0.1", port: 8080}}
+
+	c := &Controller{
+		eps: &epsSet{set: map[serviceKey]*serviceAddrSet{
+			first:      {addrs: addrs},
+			firstAdmin: {addrs: addrs},
+			second:     {addrs: addrs},
+		}},
+	}
+	u := &epsUpdater{c}
+
+	err := u.delItem(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, key := range []serviceKey{first, firstAdmin} {
+		if got := c.eps.getActiveAddrs(key); len(got) != 0 {
+			t.Errorf("expected no addresses for %v, got %v", key, got)
+		}
+	}
+	if got := c.eps.getActiveAddrs(second); len(got) != 1 {
+		t.Errorf("expected the addresses of %v to be kept, got %v", second, got)
+	}
+}
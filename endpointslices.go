@@ -0,0 +1,244 @@
+package minke
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// indexByService indexes EndpointSlices by the NAMESPACE/NAME of the
+// service they belong to.
+const indexByService = "service"
+
+// endpointSlicesAvailable checks if the API server offers
+// discovery.k8s.io/v1beta1 EndpointSlices, if it does not we fall back to
+// watching Endpoints.
+func endpointSlicesAvailable(client kubernetes.Interface) bool {
+	rs, err := client.Discovery().ServerResourcesForGroupVersion(discoveryv1beta1.SchemeGroupVersion.String())
+	if err != nil || rs == nil {
+		return false
+	}
+	for _, r := range rs.APIResources {
+		if r.Name == "endpointslices" {
+			return true
+		}
+	}
+	return false
+}
+
+func sliceServiceIndexFunc(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1beta1.EndpointSlice)
+	if !ok {
+		return nil, fmt.Errorf("interface was not an endpoint slice %T", obj)
+	}
+	name := slice.Labels[discoveryv1beta1.LabelServiceName]
+	if name == "" {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + name}, nil
+}
+
+// epsSliceUpdater merges all the EndpointSlices of a service into the
+// same addresses sets as the Endpoints updater.
+type epsSliceUpdater struct {
+	c *Controller
+
+	mu sync.Mutex
+	// slice NAMESPACE/NAME to service name, so that we can find the
+	// service of a deleted slice.
+	services map[string]string
+}
+
+func (u *epsSliceUpdater) addItem(obj interface{}) error {
+	slice, ok := obj.(*discoveryv1beta1.EndpointSlice)
+	if !ok {
+		return fmt.Errorf("interface was not an endpoint slice %T", obj)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := slice.Namespace + "/" + slice.Name
+	name := slice.Labels[discoveryv1beta1.LabelServiceName]
+	if old, ok := u.services[key]; ok && old != name {
+		// the slice has moved service, unlikely, but the old one
+		// needs updating
+		delete(u.services, key)
+		if err := u.syncService(slice.Namespace, old); err != nil {
+			return err
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	u.services[key] = name
+
+	return u.syncService(slice.Namespace, name)
+}
+
+func (u *epsSliceUpdater) delItem(obj interface{}) error {
+	slice, ok := obj.(*discoveryv1beta1.EndpointSlice)
+	if !ok {
+		return fmt.Errorf("interface was not an endpoint slice %T", obj)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := slice.Namespace + "/" + slice.Name
+	name, ok := u.services[key]
+	if !ok {
+		return nil
+	}
+	delete(u.services, key)
+
+	return u.syncService(slice.Namespace, name)
+}
+
+// syncService rebuilds the addresses of a service from all of its slices.
+func (u *epsSliceUpdater) syncService(namespace, name string) error {
+	objs, err := u.c.epsProc.informer.GetIndexer().ByIndex(indexByService, namespace+"/"+name)
+	if err != nil {
+		return err
+	}
+
+	weights := u.c.svc.getEndpointWeights(namespace, name)
+	ready := make(map[serviceKey][]serviceAddr)
+	terminating := make(map[serviceKey][]serviceAddr)
+
+	for _, obj := range objs {
+		slice := obj.(*discoveryv1beta1.EndpointSlice)
+		for _, p := range slice.Ports {
+			if p.Port == nil {
+				continue
+			}
+			key := serviceKey{
+				namespace: namespace,
+				name:      name,
+			}
+			if p.Name != nil {
+				key.portName = *p.Name
+			}
+
+			for _, ep := range slice.Endpoints {
+				state := endpointSliceState(ep.Conditions)
+				if state == endpointNotServing {
+					continue
+				}
+				for _, ip := range ep.Addresses {
+					addr := serviceAddr{
+						addr: ip,
+						port: int(*p.Port),
+						zone: ep.Topology[zoneLabel],
+					}
+					if ep.NodeName != nil {
+						addr.node = *ep.NodeName
+					}
+					if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+						addr.target = ep.TargetRef.Name
+					}
+					addr.weight = weights.weight(addr)
+
+					switch state {
+					case endpointReady:
+						ready[key] = append(ready[key], addr)
+					case endpointTerminating:
+						terminating[key] = append(terminating[key], addr)
+					}
+				}
+			}
+		}
+	}
+
+	// Terminating endpoints that are still serving are only used if
+	// there is nothing else to send traffic to.
+	for key, addrs := range terminating {
+		if len(ready[key]) == 0 {
+			ready[key] = addrs
+		}
+	}
+
+	u.c.eps.Lock()
+	defer u.c.eps.Unlock()
+	u.c.eps.updateService(namespace, name, ready)
+
+	return nil
+}
+
+type endpointState int
+
+const (
+	endpointReady endpointState = iota
+	endpointTerminating
+	endpointNotServing
+)
+
+// endpointSliceState interprets the conditions of an endpoint. A nil
+// ready condition is treated as ready, as the API requires.
+func endpointSliceState(cond discoveryv1beta1.EndpointConditions) endpointState {
+	if cond.Terminating != nil && *cond.Terminating {
+		if cond.Serving != nil && *cond.Serving {
+			return endpointTerminating
+		}
+		return endpointNotServing
+	}
+	if cond.Ready == nil || *cond.Ready {
+		return endpointReady
+	}
+	return endpointNotServing
+}
+
+func (c *Controller) setupEndpointSlicesProcess(ctx context.Context) error {
+	upd := &epsSliceUpdater{
+		c:        c,
+		services: make(map[string]string),
+	}
+
+	c.epsProc = makeProcessor(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return c.client.DiscoveryV1beta1().EndpointSlices(c.namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return c.client.DiscoveryV1beta1().EndpointSlices(c.namespace).Watch(ctx, options)
+			},
+		},
+		&discoveryv1beta1.EndpointSlice{},
+		c.refresh,
+		upd,
+	)
+
+	return c.epsProc.informer.AddIndexers(cache.Indexers{
+		indexByService: sliceServiceIndexFunc,
+	})
+}
+
+// requeueEndpoints causes the endpoints of a service to be rebuilt, for
+// instance when the endpoint weights have changed.
+func (c *Controller) requeueEndpoints(namespace, name string) {
+	if c.epsProc == nil {
+		return
+	}
+
+	if !c.epsSlices {
+		c.epsProc.queue.Add(namespace + "/" + name)
+		return
+	}
+
+	objs, err := c.epsProc.informer.GetIndexer().ByIndex(indexByService, namespace+"/"+name)
+	if err != nil {
+		return
+	}
+	for _, obj := range objs {
+		if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+			c.epsProc.queue.Add(key)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package minke
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEndpointSlices(t *testing.T) {
+	yes, no := true, false
+	port := int32(8080)
+	portName := "http"
+	zoneA, zoneB := map[string]string{zoneLabel: "a"}, map[string]string{zoneLabel: "b"}
+	node := "node1"
+
+	slice := func(name string, eps ...discoveryv1beta1.Endpoint) *discoveryv1beta1.EndpointSlice {
+		return &discoveryv1beta1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1beta1.LabelServiceName: "first"},
+			},
+			AddressType: discoveryv1beta1.AddressTypeIPv4,
+			Ports:       []discoveryv1beta1.EndpointPort{{Name: &portName, Port: &port}},
+			Endpoints:   eps,
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: portName, Port: 80}},
+			},
+		},
+		slice("first-1",
+			discoveryv1beta1.Endpoint{Addresses: []string{"10.0.0.1"}, Topology: zoneA, NodeName: &node},
+			discoveryv1beta1.Endpoint{Addresses: []string{"10.0.0.2"}, Topology: zoneB, Conditions: discoveryv1beta1.EndpointConditions{Ready: &no}},
+		),
+		slice("first-2",
+			discoveryv1beta1.Endpoint{Addresses: []string{"10.0.0.3"}, Topology: zoneB, Conditions: discoveryv1beta1.EndpointConditions{Ready: &yes}},
+			discoveryv1beta1.Endpoint{Addresses: []string{"10.0.0.4"}, Topology: zoneB, Conditions: discoveryv1beta1.EndpointConditions{Serving: &yes, Terminating: &yes}},
+		),
+	)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: discoveryv1beta1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{
+				{Name: "endpointslices", Namespaced: true, Kind: "EndpointSlice"},
+			},
+		},
+	}
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	if !ctrl.epsSlices {
+		t.Fatalf("expected endpoint slices to be used")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	key := serviceKey{namespace: "default", name: "first", portName: portName}
+	got := addrStrings(ctrl.eps.getActiveAddrs(key))
+	exp := []string{"10.0.0.1:8080", "10.0.0.3:8080"}
+	if !equalStrings(got, exp) {
+		t.Fatalf("expected addresses %v, got %v", exp, got)
+	}
+	for _, a := range ctrl.eps.getActiveAddrs(key) {
+		if a.addr == "10.0.0.1" && (a.zone != "a" || a.node != node) {
+			t.Fatalf("expected zone and node to be recorded, got %#v", a)
+		}
+	}
+
+	// with no ready endpoints left, the terminating one is used
+	err = clientset.DiscoveryV1beta1().EndpointSlices("default").Delete(ctx, "first-1", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("error deleting slice, %v", err)
+	}
+	upd := slice("first-2",
+		discoveryv1beta1.Endpoint{Addresses: []string{"10.0.0.4"}, Topology: zoneB, Conditions: discoveryv1beta1.EndpointConditions{Serving: &yes, Terminating: &yes}},
+	)
+	_, err = clientset.DiscoveryV1beta1().EndpointSlices("default").Update(ctx, upd, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("error updating slice, %v", err)
+	}
+	time.Sleep(1 * time.Second)
+
+	got = addrStrings(ctrl.eps.getActiveAddrs(key))
+	exp = []string{"10.0.0.4:8080"}
+	if !equalStrings(got, exp) {
+		t.Fatalf("expected addresses %v, got %v", exp, got)
+	}
+}
+
+func TestLocalAddrs(t *testing.T) {
+	addr := func(ip, zone string) serviceAddr {
+		return serviceAddr{addr: ip, port: 80, zone: zone, weight: 1}
+	}
+
+	tests := []struct {
+		name  string
+		addrs []serviceAddr
+		exp   []string
+	}{
+		{
+			name:  "balanced",
+			addrs: []serviceAddr{addr("10.0.0.1", "a"), addr("10.0.0.2", "b"), addr("10.0.0.3", "a"), addr("10.0.0.4", "b")},
+			exp:   []string{"10.0.0.1:80", "10.0.0.3:80"},
+		},
+		{
+			name:  "no local",
+			addrs: []serviceAddr{addr("10.0.0.1", "b"), addr("10.0.0.2", "c")},
+		},
+		{
+			name:  "too few local",
+			addrs: []serviceAddr{addr("10.0.0.1", "a"), addr("10.0.0.2", "b"), addr("10.0.0.3", "b"), addr("10.0.0.4", "b"), addr("10.0.0.5", "b"), addr("10.0.0.6", "b")},
+		},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			got := addrStrings(localAddrs("a", st.addrs))
+			if !equalStrings(got, st.exp) {
+				t.Fatalf("expected %v, got %v", st.exp, got)
+			}
+		})
+	}
+}
+
+func addrStrings(addrs []serviceAddr) []string {
+	var strs []string
+	for _, a := range addrs {
+		strs = append(strs, a.String())
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package minke
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithTrustedProxies is an option for setting the CIDRs of proxies that we
+// trust to report the client address, protocol and host in the
+// X-Forwarded-* and Forwarded headers. Those headers are discarded from
+// any other peer.
+func WithTrustedProxies(cidrs ...string) Option {
+	return func(c *Controller) error {
+		for _, str := range cidrs {
+			str = strings.TrimSpace(str)
+			if str == "" {
+				continue
+			}
+			if !strings.Contains(str, "/") {
+				if ip := net.ParseIP(str); ip != nil && ip.To4() != nil {
+					str += "/32"
+				} else {
+					str += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(str)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %q, %w", str, err)
+			}
+			c.trustedProxies = append(c.trustedProxies, n)
+		}
+		return nil
+	}
+}
+
+// WithForwardedHeader is an option for adding an RFC 7239 Forwarded header
+// to requests passed to backends.
+func WithForwardedHeader(enabled bool) Option {
+	return func(c *Controller) error {
+		c.forwardedHeader = enabled
+		return nil
+	}
+}
+
+// ClientIP returns the IP address of the client that made a request
+// handled by the controller. If the request came via a trusted proxy this
+// is the address the proxy reported.
+func ClientIP(r *http.Request) string {
+	return clientIP(r)
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (c *Controller) trusted(ipstr string) bool {
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheme returns the scheme the client used, as reported by a trusted
+// proxy, or of our own listener.
+func (st *requestState) scheme(r *http.Request) string {
+	if st.forwardedProto != "" {
+		return st.forwardedProto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedElement is one hop of a Forwarded header.
+type forwardedElement struct {
+	forIP string
+	proto string
+	host  string
+}
+
+// parseForwarded parses the elements of the Forwarded header, as described
+// in RFC 7239. Unknown parameters are ignored.
+func parseForwarded(vs []string) []forwardedElement {
+	var els []forwardedElement
+	for _, v := range vs {
+		for _, el := range splitQuoted(v, ',') {
+			var fe forwardedElement
+			for _, pair := range splitQuoted(el, ';') {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				val := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+				switch strings.ToLower(strings.TrimSpace(kv[0])) {
+				case "for":
+					fe.forIP = forwardedNodeIP(val)
+				case "proto":
+					fe.proto = strings.ToLower(val)
+				case "host":
+					fe.host = val
+				}
+			}
+			els = append(els, fe)
+		}
+	}
+	return els
+}
+
+// forwardedNodeIP extracts the IP from a node identifier, which may have a
+// port, and may be a bracketed IPv6 address.
+func forwardedNodeIP(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			return node[1:i]
+		}
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// splitQuoted splits s on sep, ignoring separators in quoted strings.
+func splitQuoted(s string, sep rune) []string {
+	var res []string
+	inQuote := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case r == sep && !inQuote:
+			res = append(res, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		res = append(res, rest)
+	}
+	return res
+}
+
+// resolveClient works out the address of the client, and the protocol and
+// host it used, trusting the forwarding headers only as far back as
+// they were added by trusted proxies.
+func (c *Controller) resolveClient(st *requestState, r *http.Request) {
+	st.peerTrusted = c.trusted(peerIP(r))
+	st.clientIP = peerIP(r)
+	st.forwardedProto = "http"
+	if r.TLS != nil {
+		st.forwardedProto = "https"
+	}
+	st.forwardedHost = r.Host
+
+	if !st.peerTrusted {
+		return
+	}
+
+	// The Forwarded header is preferred, if present.
+	var hops []forwardedElement
+	if fwd := r.Header.Values("Forwarded"); len(fwd) != 0 {
+		hops = parseForwarded(fwd)
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(v, ",") {
+				hops = append(hops, forwardedElement{forIP: forwardedNodeIP(strings.TrimSpace(ip))})
+			}
+		}
+		if len(hops) != 0 {
+			if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+				hops[len(hops)-1].proto = strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+			}
+			if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+				hops[len(hops)-1].host = strings.TrimSpace(strings.Split(host, ",")[0])
+			}
+		}
+	}
+
+	// Walk back from the most recent hop, until we find one that was
+	// not added by a trusted proxy. Hops without an IP, such as
+	// obfuscated identifiers, end the walk.
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if net.ParseIP(hop.forIP) == nil {
+			break
+		}
+		st.clientIP = hop.forIP
+		if hop.proto != "" {
+			st.forwardedProto = hop.proto
+		}
+		if hop.host != "" {
+			st.forwardedHost = hop.host
+		}
+		if !c.trusted(hop.forIP) {
+			break
+		}
+	}
+}
+
+// setForwardedHeaders sets the forwarding headers on the outbound
+// request. Headers supplied by untrusted peers are replaced.
+func (c *Controller) setForwardedHeaders(st *requestState, req *http.Request) {
+	if !st.peerTrusted {
+		// The ReverseProxy will set X-Forwarded-For to the peer.
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("X-Forwarded-Prefix")
+		req.Header.Del("Forwarded")
+	}
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", st.forwardedProto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", st.forwardedHost)
+	}
+
+	if c.forwardedHeader {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Add("Forwarded", fmt.Sprintf("for=%s;proto=%s;host=%q", forwardedNode(peerIP(req)), proto, req.Host))
+	}
+}
+
+// forwardedNode formats an IP for the Forwarded header, IPv6 addresses
+// must be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
@@ -0,0 +1,142 @@
+package minke
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestController_resolveClient(t *testing.T) {
+	c := &Controller{}
+	if err := WithTrustedProxies("10.0.0.0/8", "192.0.2.1", "2001:db8::/32")(c); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		remote   string
+		headers  http.Header
+		expIP    string
+		expProto string
+		expHost  string
+	}{
+		{
+			name:     "untrusted peer",
+			remote:   "198.51.100.1:1234",
+			headers:  http.Header{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"https"}},
+			expIP:    "198.51.100.1",
+			expProto: "http",
+			expHost:  "example.com",
+		},
+		{
+			name:     "trusted peer",
+			remote:   "10.1.1.1:1234",
+			headers:  http.Header{"X-Forwarded-For": {"1.2.3.4"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"public.example.com"}},
+			expIP:    "1.2.3.4",
+			expProto: "https",
+			expHost:  "public.example.com",
+		},
+		{
+			name:     "spoofed hops",
+			remote:   "10.1.1.1:1234",
+			headers:  http.Header{"X-Forwarded-For": {"6.6.6.6, 1.2.3.4", "10.2.2.2"}},
+			expIP:    "1.2.3.4",
+			expProto: "http",
+			expHost:  "example.com",
+		},
+		{
+			name:     "all trusted",
+			remote:   "192.0.2.1:1234",
+			headers:  http.Header{"X-Forwarded-For": {"10.0.0.1"}},
+			expIP:    "10.0.0.1",
+			expProto: "http",
+			expHost:  "example.com",
+		},
+		{
+			name:     "forwarded preferred",
+			remote:   "[2001:db8::1]:1234",
+			headers:  http.Header{"Forwarded": {`for="[2001:db8::2]:80";proto=https, for=1.2.3.4;proto=https;host="a.example.com"`}, "X-Forwarded-For": {"6.6.6.6"}},
+			expIP:    "1.2.3.4",
+			expProto: "https",
+			expHost:  "a.example.com",
+		},
+		{
+			name:     "forwarded obfuscated",
+			remote:   "10.1.1.1:1234",
+			headers:  http.Header{"Forwarded": {`for=unknown, for=10.3.3.3`}},
+			expIP:    "10.3.3.3",
+			expProto: "http",
+			expHost:  "example.com",
+		},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = st.remote
+			req.Header = st.headers
+
+			rs := &requestState{}
+			c.resolveClient(rs, req)
+			if rs.clientIP != st.expIP || rs.forwardedProto != st.expProto || rs.forwardedHost != st.expHost {
+				t.Fatalf("expected %s %s %s, got %s %s %s", st.expIP, st.expProto, st.expHost, rs.clientIP, rs.forwardedProto, rs.forwardedHost)
+			}
+		})
+	}
+}
+
+func TestController_setForwardedHeaders(t *testing.T) {
+	c := &Controller{forwardedHeader: true}
+	if err := WithTrustedProxies("10.0.0.0/8")(c); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header = http.Header{
+		"X-Forwarded-For":    {"1.2.3.4"},
+		"X-Forwarded-Proto":  {"https"},
+		"X-Forwarded-Prefix": {"/admin"},
+		"Forwarded":          {"for=1.2.3.4"},
+	}
+	st := &requestState{}
+	c.resolveClient(st, req)
+	c.setForwardedHeaders(st, req)
+
+	exp := http.Header{
+		"X-Forwarded-Proto": {"http"},
+		"X-Forwarded-Host":  {"example.com"},
+		"Forwarded":         {`for=198.51.100.1;proto=http;host="example.com"`},
+	}
+	if !reflect.DeepEqual(req.Header, exp) {
+		t.Fatalf("expected headers %v, got %v", exp, req.Header)
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.1.1.1:1234"
+	req.Header = http.Header{
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=1.2.3.4;proto=https"},
+	}
+	st = &requestState{}
+	c.resolveClient(st, req)
+	c.setForwardedHeaders(st, req)
+
+	exp = http.Header{
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"example.com"},
+		"Forwarded":         {"for=1.2.3.4;proto=https", `for=10.1.1.1;proto=http;host="example.com"`},
+	}
+	if !reflect.DeepEqual(req.Header, exp) {
+		t.Fatalf("expected headers %v, got %v", exp, req.Header)
+	}
+}
+
+func TestWithTrustedProxies_invalid(t *testing.T) {
+	if err := WithTrustedProxies("10.0.0.0/33")(&Controller{}); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
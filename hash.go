@@ -0,0 +1,244 @@
+package minke
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// annHashKey sets what the ring-hash and maglev strategies hash on. It
+// can be one of header:NAME, cookie:NAME, query:NAME or source-ip.
+var annHashKey = annPrefix + "hash-key"
+
+const (
+	balancerRingHash = "ring-hash"
+	balancerMaglev   = "maglev"
+
+	// number of points on the ring, per unit of endpoint weight.
+	ringHashReplicas = 100
+	// size of the maglev lookup table, this must be prime, and should
+	// be much larger than the number of endpoints.
+	maglevTableSize = 65537
+)
+
+// hashKeyFunc extracts the value to hash from a request, false is
+// returned if the request does not carry the value.
+type hashKeyFunc func(r *http.Request) (string, bool)
+
+func parseHashKey(str string) (hashKeyFunc, error) {
+	if str == "source-ip" {
+		return func(r *http.Request) (string, bool) {
+			ip := clientIP(r)
+			return ip, ip != ""
+		}, nil
+	}
+
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid hash key %q, should be header:NAME, cookie:NAME, query:NAME or source-ip", str)
+	}
+	name := parts[1]
+
+	switch parts[0] {
+	case "header":
+		name = http.CanonicalHeaderKey(name)
+		return func(r *http.Request) (string, bool) {
+			v := r.Header.Get(name)
+			return v, v != ""
+		}, nil
+	case "cookie":
+		return func(r *http.Request) (string, bool) {
+			c, err := r.Cookie(name)
+			if err != nil || c.Value == "" {
+				return "", false
+			}
+			return c.Value, true
+		}, nil
+	case "query":
+		return func(r *http.Request) (string, bool) {
+			v := r.URL.Query().Get(name)
+			return v, v != ""
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid hash key %q, should be header:NAME, cookie:NAME, query:NAME or source-ip", str)
+	}
+}
+
+// clientIP returns the IP address of the client that made the request,
+// as resolved from any trusted forwarding headers.
+func clientIP(r *http.Request) string {
+	if st := getRequestState(r); st.clientIP != "" {
+		return st.clientIP
+	}
+	return peerIP(r)
+}
+
+func hash64(strs ...string) uint64 {
+	h := fnv.New64a()
+	for _, s := range strs {
+		h.Write([]byte(s))
+	}
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer, fnv on its own has poor avalanche
+// for short, similar, inputs such as IP addresses.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hashBalancer picks endpoints by hashing a key from the request, requests
+// without a key are sent to a random endpoint.
+type hashBalancer struct {
+	key   hashKeyFunc
+	build func([]serviceAddr) hashTable
+
+	mu    sync.RWMutex
+	addrs []serviceAddr
+	table hashTable
+}
+
+// hashTable looks up the index of the endpoint for a hash.
+type hashTable interface {
+	lookup(h uint64) int
+}
+
+func newHashBalancer(spec balancerSpec, build func([]serviceAddr) hashTable) *hashBalancer {
+	key, err := parseHashKey(spec.hashKey)
+	if err != nil {
+		key = func(*http.Request) (string, bool) { return "", false }
+	}
+	return &hashBalancer{key: key, build: build}
+}
+
+func (b *hashBalancer) update(addrs []serviceAddr) {
+	table := b.build(addrs)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = addrs
+	b.table = table
+}
+
+func (b *hashBalancer) pick(r *http.Request) (serviceAddr, func()) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.addrs) == 0 {
+		return serviceAddr{}, noop
+	}
+
+	var k string
+	var ok bool
+	if r != nil {
+		k, ok = b.key(r)
+	}
+	if !ok {
+		return b.addrs[rand.Intn(len(b.addrs))], noop
+	}
+
+	return b.addrs[b.table.lookup(hash64(k))], noop
+}
+
+type ringEntry struct {
+	hash  uint64
+	index int
+}
+
+// ringHash is a consistent hash ring, with each endpoint placed on the
+// ring multiple times in proportion to its weight.
+type ringHash []ringEntry
+
+func buildRingHash(addrs []serviceAddr) hashTable {
+	var ring ringHash
+	for i, a := range addrs {
+		w := a.weight
+		if w <= 0 {
+			w = 1
+		}
+		name := a.String()
+		for j := 0; j < w*ringHashReplicas; j++ {
+			ring = append(ring, ringEntry{hash: hash64(name, "-", strconv.Itoa(j)), index: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func (ring ringHash) lookup(h uint64) int {
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].index
+}
+
+// maglevTable implements the lookup table from Google's Maglev paper, it
+// gives an even spread of keys, and moves few keys as endpoints change.
+type maglevTable []int
+
+func buildMaglev(addrs []serviceAddr) hashTable {
+	n := len(addrs)
+	if n == 0 {
+		return maglevTable{}
+	}
+
+	// the permutations are based on the address rather than the index
+	// so that they are stable as endpoints come and go.
+	sorted := make([]int, n)
+	for i := range sorted {
+		sorted[i] = i
+	}
+	sort.Slice(sorted, func(i, j int) bool { return addrs[sorted[i]].String() < addrs[sorted[j]].String() })
+
+	const m = maglevTableSize
+	offsets := make([]uint64, n)
+	skips := make([]uint64, n)
+	for i, idx := range sorted {
+		name := addrs[idx].String()
+		offsets[i] = hash64(name, "offset") % m
+		skips[i] = hash64(name, "skip")%(m-1) + 1
+	}
+
+	table := make(maglevTable, m)
+	for i := range table {
+		table[i] = -1
+	}
+	next := make([]uint64, n)
+	filled := 0
+	for {
+		for i, idx := range sorted {
+			w := addrs[idx].weight
+			if w <= 0 {
+				w = 1
+			}
+			// weighted endpoints take extra turns
+			for t := 0; t < w; t++ {
+				c := (offsets[i] + next[i]*skips[i]) % m
+				for table[c] >= 0 {
+					next[i]++
+					c = (offsets[i] + next[i]*skips[i]) % m
+				}
+				table[c] = idx
+				next[i]++
+				filled++
+				if filled == m {
+					return table
+				}
+			}
+		}
+	}
+}
+
+func (t maglevTable) lookup(h uint64) int {
+	return t[h%uint64(len(t))]
+}
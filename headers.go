@@ -0,0 +1,249 @@
+package minke
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// annRequestHeaders changes the headers of requests passed to the
+// backends of an Ingress. The value is a JSON object, for example:
+//
+//	{
+//	  "remove": ["X-Internal-User"],
+//	  "set": {"X-Client-IP": "$client_ip"},
+//	  "add": {"X-Route": "$ingress"}
+//	}
+//
+// Headers are removed, then set, then added. Values may use $client_ip,
+// $host, $method, $path, $scheme, $ingress (NAMESPACE/NAME),
+// $ingress_name, $namespace and $service. $$ gives a literal $.
+//
+// Policies for individual rules can be given in "rules", keyed by the
+// path of the rule as written in the Ingress. They are applied after
+// the policy for the whole Ingress:
+//
+//	{"rules": {"/api": {"set": {"Cache-Control": "no-store"}}}}
+var annRequestHeaders = annPrefix + "request-headers"
+
+// annResponseHeaders changes the headers of responses from the backends
+// of an Ingress, it takes the same form as annRequestHeaders.
+var annResponseHeaders = annPrefix + "response-headers"
+
+type headerPolicy struct {
+	remove []string
+	set    [][2]string
+	add    [][2]string
+	rules  map[string]*headerPolicy
+}
+
+func (hp *headerPolicy) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{}
+	if len(hp.remove) != 0 {
+		strmap["remove"] = hp.remove
+	}
+	if len(hp.set) != 0 {
+		strmap["set"] = hp.set
+	}
+	if len(hp.add) != 0 {
+		strmap["add"] = hp.add
+	}
+	if len(hp.rules) != 0 {
+		strmap["rules"] = hp.rules
+	}
+	return json.Marshal(strmap)
+}
+
+type headerPolicyJSON struct {
+	Remove []string                     `json:"remove"`
+	Set    map[string]string            `json:"set"`
+	Add    map[string]string            `json:"add"`
+	Rules  map[string]*headerPolicyJSON `json:"rules"`
+}
+
+// sortedHeaders returns the headers in a stable order, with canonical
+// names.
+func sortedHeaders(hs map[string]string) [][2]string {
+	var res [][2]string
+	for k, v := range hs {
+		res = append(res, [2]string{http.CanonicalHeaderKey(k), v})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i][0] < res[j][0] })
+	return res
+}
+
+// parseHeaderPolicy parses the value of a header annotation.
+func parseHeaderPolicy(str string) (*headerPolicy, error) {
+	var in headerPolicyJSON
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, fmt.Errorf("invalid header policy, %w", err)
+	}
+
+	hp, err := newHeaderPolicy(&in)
+	if err != nil {
+		return nil, err
+	}
+	for path, rin := range in.Rules {
+		if rin == nil {
+			return nil, fmt.Errorf("invalid header policy, no policy for rule %s", path)
+		}
+		if len(rin.Rules) != 0 {
+			return nil, fmt.Errorf("invalid header policy, rule %s cannot have rules of its own", path)
+		}
+		rhp, err := newHeaderPolicy(rin)
+		if err != nil {
+			return nil, err
+		}
+		if hp.rules == nil {
+			hp.rules = map[string]*headerPolicy{}
+		}
+		hp.rules[path] = rhp
+	}
+
+	return hp, nil
+}
+
+func newHeaderPolicy(in *headerPolicyJSON) (*headerPolicy, error) {
+	hp := &headerPolicy{
+		set: sortedHeaders(in.Set),
+		add: sortedHeaders(in.Add),
+	}
+	for _, h := range in.Remove {
+		hp.remove = append(hp.remove, http.CanonicalHeaderKey(h))
+	}
+	for _, hs := range [][][2]string{hp.set, hp.add} {
+		for _, h := range hs {
+			if h[0] == "" {
+				return nil, fmt.Errorf("invalid header policy, empty header name")
+			}
+		}
+	}
+
+	return hp, nil
+}
+
+// checkPaths verifies that the rules of the policy name paths used by
+// the Ingress.
+func (hp *headerPolicy) checkPaths(paths []string) error {
+	used := map[string]bool{}
+	for _, p := range paths {
+		used[p] = true
+	}
+	for path := range hp.rules {
+		if !used[path] {
+			return fmt.Errorf("invalid header policy, rule %s is not a path of the ingress", path)
+		}
+	}
+	return nil
+}
+
+// ingressPaths lists the paths used by the rules of an Ingress.
+func ingressPaths(ing *networkingv1.Ingress) []string {
+	var paths []string
+	for _, r := range ing.Spec.Rules {
+		if r.HTTP == nil {
+			continue
+		}
+		for _, p := range r.HTTP.Paths {
+			paths = append(paths, p.Path)
+		}
+	}
+	return paths
+}
+
+// forRule returns the policy for the rule with the given path, if any.
+func (hp *headerPolicy) forRule(path string) *headerPolicy {
+	if hp == nil {
+		return nil
+	}
+	return hp.rules[path]
+}
+
+// headerVars returns the function used to expand header templates for a
+// request.
+func headerVars(st *requestState, r *http.Request) func(string) string {
+	return func(name string) string {
+		switch name {
+		case "$":
+			return "$"
+		case "client_ip":
+			return clientIP(r)
+		case "host":
+			return r.Host
+		case "method":
+			return r.Method
+		case "path":
+			return r.URL.Path
+		case "scheme":
+			return st.scheme(r)
+		case "ingress":
+			if st.ingress != nil {
+				return st.ingress.namespace + "/" + st.ingress.name
+			}
+		case "ingress_name":
+			if st.ingress != nil {
+				return st.ingress.name
+			}
+		case "namespace":
+			if st.ingress != nil {
+				return st.ingress.namespace
+			}
+		case "service":
+			return st.backend.name
+		case "proxy_authority":
+			return st.proxy.Authority()
+		case "proxy_vpce_id":
+			return st.proxy.AWSVPCEndpointID()
+		}
+		return ""
+	}
+}
+
+// apply changes the headers, expanding templates with vars.
+func (hp *headerPolicy) apply(h http.Header, vars func(string) string) {
+	if hp == nil {
+		return
+	}
+	for _, k := range hp.remove {
+		h.Del(k)
+	}
+	for _, kv := range hp.set {
+		h.Set(kv[0], os.Expand(kv[1], vars))
+	}
+	for _, kv := range hp.add {
+		h.Add(kv[0], os.Expand(kv[1], vars))
+	}
+}
+
+// applyRequestHeaders applies the request header policies of the matched
+// ingress and rule to the outbound request.
+func (c *Controller) applyRequestHeaders(st *requestState, req *http.Request) {
+	if st.ingress == nil {
+		return
+	}
+	vars := headerVars(st, req)
+	st.ingress.requestHeaders.apply(req.Header, vars)
+	if st.rule != nil {
+		st.rule.requestHeaders.apply(req.Header, vars)
+	}
+}
+
+// applyResponseHeaders applies the response header policies of the
+// matched ingress and rule.
+func (c *Controller) applyResponseHeaders(st *requestState, resp *http.Response) {
+	if st.ingress == nil {
+		return
+	}
+	vars := headerVars(st, resp.Request)
+	st.ingress.responseHeaders.apply(resp.Header, vars)
+	if st.rule != nil {
+		st.rule.responseHeaders.apply(resp.Header, vars)
+	}
+}
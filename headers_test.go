@@ -0,0 +1,120 @@
+package minke
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderPolicy_apply(t *testing.T) {
+	hp, err := parseHeaderPolicy(`{
+		"remove": ["x-internal"],
+		"set": {"x-client": "$client_ip", "x-route": "${ingress} via $host to $service", "x-price": "$$5"},
+		"add": {"via": "minke"}
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/path", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Internal", "secret")
+	req.Header.Set("X-Client", "spoofed")
+	req.Header.Set("Via", "1.1 other")
+
+	st := &requestState{
+		ingress: &ingress{name: "web", namespace: "prod"},
+		backend: serviceKey{namespace: "prod", name: "web-svc"},
+	}
+	hp.apply(req.Header, headerVars(st, req))
+
+	exp := http.Header{
+		"X-Client": {"192.0.2.1"},
+		"X-Route":  {"prod/web via example.com to web-svc"},
+		"X-Price":  {"$5"},
+		"Via":      {"1.1 other", "minke"},
+	}
+	if !reflect.DeepEqual(req.Header, exp) {
+		t.Fatalf("expected headers %v, got %v", exp, req.Header)
+	}
+}
+
+func TestParseHeaderPolicy_errors(t *testing.T) {
+	for _, str := range []string{
+		`{"set": {"": "x"}}`,
+		`{"delete": ["x"]}`,
+		`["x"]`,
+		`{"rules": {"/api": null}}`,
+		`{"rules": {"/api": {"set": {"": "x"}}}}`,
+		`{"rules": {"/api": {"rules": {"/api": {}}}}}`,
+	} {
+		if _, err := parseHeaderPolicy(str); err == nil {
+			t.Errorf("expected an error for %s", str)
+		}
+	}
+}
+
+func TestController_applyResponseHeaders(t *testing.T) {
+	hp, err := parseHeaderPolicy(`{"set": {"strict-transport-security": "max-age=31536000"}, "remove": ["server"]}`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp := &http.Response{
+		Header:  http.Header{"Server": {"backend/1.0"}},
+		Request: req,
+	}
+
+	c := &Controller{}
+	c.applyResponseHeaders(&requestState{ingress: &ingress{responseHeaders: hp}}, resp)
+
+	exp := http.Header{"Strict-Transport-Security": {"max-age=31536000"}}
+	if !reflect.DeepEqual(resp.Header, exp) {
+		t.Fatalf("expected headers %v, got %v", exp, resp.Header)
+	}
+}
+
+func TestController_applyRequestHeaders_rules(t *testing.T) {
+	hp, err := parseHeaderPolicy(`{
+		"set": {"x-route": "$ingress", "x-tier": "web"},
+		"rules": {"/api/*": {"set": {"x-tier": "api"}, "remove": ["cookie"]}}
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err := hp.checkPaths([]string{"/api/*", "/web/*"}); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err := hp.checkPaths([]string{"/web/*"}); err == nil {
+		t.Fatalf("expected an error for a rule that is not in the ingress")
+	}
+
+	ing := &ingress{name: "web", namespace: "prod", requestHeaders: hp}
+	api := &ingressRule{path: "/api/*", requestHeaders: hp.forRule("/api/*")}
+	web := &ingressRule{path: "/web/*", requestHeaders: hp.forRule("/web/*")}
+
+	tests := []struct {
+		rule *ingressRule
+		exp  http.Header
+	}{
+		{
+			rule: api,
+			exp:  http.Header{"X-Route": {"prod/web"}, "X-Tier": {"api"}},
+		},
+		{
+			rule: web,
+			exp:  http.Header{"X-Route": {"prod/web"}, "X-Tier": {"web"}, "Cookie": {"a=b"}},
+		},
+	}
+
+	c := &Controller{}
+	for _, st := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Cookie", "a=b")
+		c.applyRequestHeaders(&requestState{ingress: ing, rule: st.rule}, req)
+		if !reflect.DeepEqual(req.Header, st.exp) {
+			t.Errorf("%s: expected headers %v, got %v", st.rule.path, st.exp, req.Header)
+		}
+	}
+}
@@ -16,12 +16,19 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/klog/v2"
 
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	networkingv1beta1 "k8s.io/api/networking/v1beta1"
-	listnetworkingv1beta1 "k8s.io/client-go/listers/networking/v1beta1"
 
 	"k8s.io/client-go/tools/cache"
 )
 
+const annPrefix = "minke.tcolgate.github.com/"
+
+// annPriority sets the order in which ingresses sharing a host are
+// considered, lower values are considered first.
+var annPriority = annPrefix + "priority"
+
 // ingressSet maps hostnames to the ingresses that use them.
 type ingressSet struct {
 	sync.RWMutex
@@ -72,15 +79,31 @@ func (pt pathType) MarshalJSON() ([]byte, error) {
 type ingress struct {
 	name           string
 	namespace      string
+	class          string
 	priority       *int
 	defaultBackend *serviceKey
 	rules          []ingressRule
 	httpRedir      bool
+	balancer       balancerSpec
+	affinity       string // name of the affinity cookie, if enabled
+	match          *matchConditions
+	split          *trafficSplit // the split for the default backend
+	redirect       *redirectConfig
+
+	requestHeaders  *headerPolicy
+	responseHeaders *headerPolicy
+
+	accessLog *accessLogPolicy
 }
 
 func (ing ingress) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ing.statusMap())
+}
+
+func (ing ingress) statusMap() map[string]interface{} {
 	strmap := map[string]interface{}{
 		"ingress":   fmt.Sprintf("%s/%s", ing.namespace, ing.name),
+		"class":     ing.class,
 		"rules":     ing.rules,
 		"httpRedir": ing.httpRedir,
 	}
@@ -90,7 +113,42 @@ func (ing ingress) MarshalJSON() ([]byte, error) {
 	if ing.priority != nil {
 		strmap["priority"] = *ing.priority
 	}
-	return json.Marshal(strmap)
+	if ing.balancer.strategy != "" {
+		strmap["balancer"] = ing.balancer
+	}
+	if ing.affinity != "" {
+		strmap["affinityCookie"] = ing.affinity
+	}
+	if ing.match != nil {
+		strmap["match"] = ing.match
+	}
+	if ing.split != nil {
+		strmap["trafficSplit"] = ing.split
+	}
+	if ing.redirect != nil {
+		strmap["redirect"] = ing.redirect
+	}
+	if ing.requestHeaders != nil {
+		strmap["requestHeaders"] = ing.requestHeaders
+	}
+	if ing.responseHeaders != nil {
+		strmap["responseHeaders"] = ing.responseHeaders
+	}
+	if ing.accessLog != nil {
+		strmap["accessLog"] = ing.accessLog
+	}
+	return strmap
+}
+
+// MarshalJSON reports the ingresses in the order they are considered
+func (ings ingressHostGroup) MarshalJSON() ([]byte, error) {
+	strs := make([]map[string]interface{}, 0, len(ings))
+	for i := range ings {
+		strmap := ings[i].statusMap()
+		strmap["order"] = i
+		strs = append(strs, strmap)
+	}
+	return json.Marshal(strs)
 }
 
 // ingress rules is one specific path, and the backend it
@@ -101,6 +159,47 @@ type ingressRule struct {
 	pathType pathType
 	path     string
 	backend  serviceKey
+	resource *resourceKey
+	match    *matchConditions
+	mirror   *mirrorTarget
+	rewrite  *pathRewrite
+	split    *trafficSplit
+
+	requestHeaders  *headerPolicy
+	responseHeaders *headerPolicy
+}
+
+// resourceKey is a non-service backend, we track these so that
+// matching behaves as the ingress describes, but we cannot serve
+// traffic for them.
+type resourceKey struct {
+	namespace string
+	apiGroup  string
+	kind      string
+	name      string
+}
+
+func (rk resourceKey) String() string {
+	if rk.apiGroup == "" {
+		return fmt.Sprintf("%s/%s/%s", rk.kind, rk.namespace, rk.name)
+	}
+	return fmt.Sprintf("%s.%s/%s/%s", rk.kind, rk.apiGroup, rk.namespace, rk.name)
+}
+
+func (rk resourceKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rk.String())
+}
+
+func backendToResourceKey(namespace string, ref *corev1.TypedLocalObjectReference) *resourceKey {
+	rk := &resourceKey{
+		namespace: namespace,
+		kind:      ref.Kind,
+		name:      ref.Name,
+	}
+	if ref.APIGroup != nil {
+		rk.apiGroup = *ref.APIGroup
+	}
+	return rk
 }
 
 func (ir ingressRule) MarshalJSON() ([]byte, error) {
@@ -110,6 +209,27 @@ func (ir ingressRule) MarshalJSON() ([]byte, error) {
 		"pathType": ir.pathType,
 		"host":     ir.host,
 	}
+	if ir.resource != nil {
+		strmap["backend"] = ir.resource
+	}
+	if ir.match != nil {
+		strmap["match"] = ir.match
+	}
+	if ir.mirror != nil {
+		strmap["mirror"] = ir.mirror
+	}
+	if ir.rewrite != nil {
+		strmap["rewrite"] = ir.rewrite
+	}
+	if ir.split != nil {
+		strmap["trafficSplit"] = ir.split
+	}
+	if ir.requestHeaders != nil {
+		strmap["requestHeaders"] = ir.requestHeaders
+	}
+	if ir.responseHeaders != nil {
+		strmap["responseHeaders"] = ir.responseHeaders
+	}
 	if ir.host == "" {
 		strmap["host"] = "*"
 	}
@@ -125,12 +245,13 @@ func (g ingressGroupByPriority) Swap(i, j int) {
 }
 
 func (g ingressGroupByPriority) Less(i, j int) bool {
+	// ingresses with no priority are handled last
 	if g[i].priority == nil && g[j].priority != nil {
-		return true
+		return false
 	}
 
 	if g[i].priority != nil && g[j].priority == nil {
-		return false
+		return true
 	}
 
 	if g[i].priority != nil &&
@@ -145,6 +266,12 @@ func (g ingressGroupByPriority) Less(i, j int) bool {
 		return false
 	}
 
+	// at the same priority, ingresses with match conditions are considered
+	// first, so that they can take traffic from those without.
+	if (g[i].match != nil) != (g[j].match != nil) {
+		return g[i].match != nil
+	}
+
 	if g[i].name < g[j].name {
 		return true
 	}
@@ -160,7 +287,17 @@ func (g ingressGroupByPriority) Less(i, j int) bool {
 	return false
 }
 
+// matchRule checks if the request matches the rule, returning the length
+// of the matched path, and whether the match was exact.
 func (ir *ingressRule) matchRule(r *http.Request) (int, bool) {
+	l, exact := ir.matchPath(r)
+	if l == 0 || !ir.match.match(r) {
+		return 0, false
+	}
+	return l, exact
+}
+
+func (ir *ingressRule) matchPath(r *http.Request) (int, bool) {
 	if ir.host != "" && ir.host != r.Host {
 		// This should /probably/ check if ir.host is a wildcard, but
 		// it's a little ambigious from the docs if they are supported here.
@@ -236,34 +373,46 @@ func (ings ingressHostGroup) matchRule(r *http.Request) (*ingress, *ingressRule)
 	return ing, matched
 }
 
-func (is *ingressSet) matchRule(r *http.Request) (*ingress, *ingressRule) {
-	is.RLock()
-	defer is.RUnlock()
+// defaultBackend returns the first ingress in the group that has a
+// default backend, and whose match conditions the request meets.
+func (ings ingressHostGroup) defaultBackend(r *http.Request) *ingress {
+	for i := range ings {
+		if ings[i].defaultBackend != nil && ings[i].match.match(r) {
+			return &ings[i]
+		}
+	}
+	return nil
+}
 
+// matchRule finds the ingress, and rule that should handle this request. If
+// the request is to be handled by an ingress default backend, the returned
+// rule will be nil.
+func (is *ingressSet) matchRule(r *http.Request) (*ingress, *ingressRule) {
 	if is == nil {
 		return nil, nil
 	}
 
-	ings, _ := is.set[r.Host]
-
-	ing, rule := ings.matchRule(r)
-	if ing != nil {
-		return ing, rule
-	}
+	is.RLock()
+	defer is.RUnlock()
 
+	hosts := []string{r.Host}
 	if len(r.Host) > 0 {
 		name := strings.Split(r.Host, ".")
 		name[0] = "*"
-		wildcardName := strings.Join(name, ".")
-		ings, _ := is.set[wildcardName]
-		ing, rule = ings.matchRule(r)
-		if ing != nil {
+		hosts = append(hosts, strings.Join(name, "."), "")
+	}
+
+	for _, h := range hosts {
+		ings, _ := is.set[h]
+		if ing, rule := ings.matchRule(r); ing != nil {
 			return ing, rule
 		}
+		if ing := ings.defaultBackend(r); ing != nil {
+			return ing, nil
+		}
 	}
 
-	ings, _ = is.set[""]
-	return ings.matchRule(r)
+	return nil, nil
 }
 
 func (is *ingressSet) update(name, namespace string, newset map[string]ingressHostGroup) {
@@ -314,45 +463,62 @@ type ingUpdater struct {
 	c *Controller
 }
 
-func (c *Controller) ourClass(ing *networkingv1beta1.Ingress) bool {
-	class, _ := ing.ObjectMeta.Annotations["kubernetes.io/ingress.class"]
-
+// ourClass checks if we should handle this ingress, and returns the name
+// of the class it belongs to. An ingressClassName must refer to an
+// IngressClass with our controller name. The legacy annotation is matched
+// against our configured class. Ingresses with no class are ours if one of
+// our IngressClasses is the cluster default, or we have no class set.
+func (c *Controller) ourClass(ing *networkingv1.Ingress) (string, bool) {
 	if ing.Spec.IngressClassName != nil {
-		// TODO: not really how we should use this, there
-		// should be an IngressClass object
-		class = *ing.Spec.IngressClassName
+		class := *ing.Spec.IngressClassName
+		return class, c.classes.ours(class)
 	}
 
+	class, _ := ing.ObjectMeta.Annotations["kubernetes.io/ingress.class"]
+
 	switch {
-	// If we have a class set, only match our own.
-	case c.class != "" && class != c.class:
-		return false
-	// If we have no class set, only ingresses with no class.
-	case c.class == "" && class != "":
-		return false
+	case class != "":
+		return class, class == c.class
 	default:
-		return true
+		if def, ok := c.classes.defaultClass(); ok {
+			return def, true
+		}
+		return "", c.class == ""
 	}
 }
 
 func (u *ingUpdater) addItem(obj interface{}) error {
-	ing, ok := obj.(*networkingv1beta1.Ingress)
-	if !ok {
-		return fmt.Errorf("interface was not an ingress %T", obj)
+	ing, err := toIngressV1(obj)
+	if err != nil {
+		return err
 	}
 
-	if !u.c.ourClass(ing) {
+	name := fmt.Sprintf("%s/%s", ing.ObjectMeta.Namespace, ing.ObjectMeta.Name)
+
+	// Our status may need adding or removing.
+	u.c.status.enqueue(name)
+
+	class, ours := u.c.ourClass(ing)
+	if !ours {
+		// This may have previously been ours
+		u.c.ings.clear(ing.ObjectMeta.Name, ing.ObjectMeta.Namespace)
+		u.c.certMap.updateIngress(ingressKey{namespace: ing.Namespace, name: ing.Name}, nil)
+		u.c.acme.updateIngress(nil, ingressKey{namespace: ing.Namespace, name: ing.Name}, nil)
+		u.c.clientAuth.updateIngress(nil, ingressKey{namespace: ing.Namespace, name: ing.Name}, nil, nil)
 		return nil
 	}
 
-	name := fmt.Sprintf("%s/%s", ing.ObjectMeta.Namespace, ing.ObjectMeta.Name)
-
 	// we'll collate  alist of hosts incase the TLS list
 	// doesn't include one
 	var hosts []string
 
 	redirAnn := "ingress.kubernetes.io/ssl-redirect"
 	doRedir := u.c.defaultHTTPRedir
+	var priority *int
+	var match *matchConditions
+	var mirror *mirrorTarget
+	var rewrite *pathRewrite
+	var requestHeaders, responseHeaders *headerPolicy
 	for k, v := range ing.GetAnnotations() {
 		switch k {
 		case redirAnn:
@@ -362,28 +528,178 @@ func (u *ingUpdater) addItem(obj interface{}) error {
 			}
 			doRedir = redir
 			continue
+		case annPriority:
+			p, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				klog.Errorf("invalid annotation value for %q on %v, should be an integer", annPriority, name)
+				u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidPriority", "invalid value %q for %s, should be an integer, ignoring", v, annPriority)
+				continue
+			}
+			priority = &p
+			continue
+		case annMatch:
+			mc, err := parseMatchConditions(v)
+			if err == nil {
+				err = mc.checkPaths(ingressPaths(ing))
+			}
+			if err != nil {
+				// Ignoring the conditions could send traffic to the
+				// wrong backend, so we ignore the whole ingress.
+				klog.Errorf("invalid annotation value for %q on %v, %v", annMatch, name, err)
+				u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidMatch", "%v, ignoring the ingress", err)
+				u.c.ings.clear(ing.ObjectMeta.Name, ing.ObjectMeta.Namespace)
+				u.c.certMap.updateIngress(ingressKey{namespace: ing.Namespace, name: ing.Name}, nil)
+				u.c.acme.updateIngress(nil, ingressKey{namespace: ing.Namespace, name: ing.Name}, nil)
+				u.c.clientAuth.updateIngress(nil, ingressKey{namespace: ing.Namespace, name: ing.Name}, nil, nil)
+				return nil
+			}
+			match = mc
+			continue
+		case annMirror:
+			mt, err := parseMirrorTarget(v)
+			if err != nil {
+				klog.Errorf("invalid annotation value for %q on %v, %v", annMirror, name, err)
+				u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidMirror", "%v, not mirroring", err)
+				continue
+			}
+			mirror = mt
+			continue
+		case annStripPrefix:
+			strip, err := strconv.ParseBool(v)
+			if err != nil {
+				klog.Errorf("invalid annotation value for %q on %v, should be true or false", annStripPrefix, name)
+				u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidRewrite", "invalid value %q for %s, should be true or false, ignoring", v, annStripPrefix)
+				continue
+			}
+			if strip && rewrite == nil {
+				rewrite = &pathRewrite{}
+			}
+			continue
+		case annRewriteTarget:
+			rewrite = &pathRewrite{target: v}
+			continue
+		case annRequestHeaders, annResponseHeaders:
+			hp, err := parseHeaderPolicy(v)
+			if err == nil {
+				err = hp.checkPaths(ingressPaths(ing))
+			}
+			if err != nil {
+				klog.Errorf("invalid annotation value for %q on %v, %v", k, name, err)
+				u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidHeaders", "invalid value for %s, %v, ignoring", k, err)
+				continue
+			}
+			if k == annRequestHeaders {
+				requestHeaders = hp
+			} else {
+				responseHeaders = hp
+			}
+			continue
 		}
 	}
+
+	balancer, affinity, errs := parseBalancerAnnotations(ing.GetAnnotations())
+	for _, err := range errs {
+		klog.Errorf("invalid load balancer annotations on %v, %v", name, err)
+		u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidLoadBalancer", "%v, using the default", err)
+	}
+
+	split, err := parseTrafficSplit(ing.GetAnnotations())
+	if err == nil {
+		err = split.checkBackends(ingressServices(ing))
+	}
+	if err != nil {
+		split = nil
+		klog.Errorf("invalid traffic split on %v, %v", name, err)
+		u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidTrafficSplit", "%v, sending all traffic to the rule backends", err)
+	}
+
+	redirect, err := parseRedirectConfig(ing.GetAnnotations())
+	if err != nil {
+		klog.Errorf("invalid redirect on %v, %v", name, err)
+		u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidRedirect", "%v, not redirecting", err)
+	}
+
+	accessLog, err := parseAccessLogPolicy(ing.GetAnnotations())
+	if err != nil {
+		klog.Errorf("invalid access log settings on %v, %v", name, err)
+		u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidAccessLog", "%v, using the defaults", err)
+	}
+
+	var useACME bool
+	if v, ok := ing.GetAnnotations()[annACME]; ok {
+		useACME, err = strconv.ParseBool(strings.TrimSpace(v))
+		switch {
+		case err != nil:
+			klog.Errorf("invalid annotation value for %q on %v, should be true or false", annACME, name)
+			u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidACME", "invalid value %q for %s, should be true or false, ignoring", v, annACME)
+		case useACME && u.c.acme == nil:
+			klog.Errorf("acme requested for %v, but acme is not enabled", name)
+			u.c.recordEventf(obj, corev1.EventTypeWarning, "ACMEDisabled", "acme is not enabled, ignoring %s", annACME)
+			useACME = false
+		}
+	}
+
+	clientAuth, err := parseClientAuth(ing.Namespace, ing.GetAnnotations())
+	if err != nil {
+		klog.Errorf("invalid client auth settings on %v, %v", name, err)
+		u.c.recordEventf(obj, corev1.EventTypeWarning, "InvalidClientAuth", "%v, refusing all client certificates", err)
+	}
+
+	var defaultBackend *serviceKey
+	if ing.Spec.DefaultBackend != nil {
+		if ing.Spec.DefaultBackend.Service != nil {
+			key := backendToServiceKey(ing.ObjectMeta.Namespace, ing.Spec.DefaultBackend)
+			defaultBackend = &key
+		} else {
+			klog.Errorf("ingress %s, ignoring non-service default backend", name)
+		}
+	}
+
+	var defaultSplit *trafficSplit
+	if defaultBackend != nil {
+		defaultSplit = split.forBackend(defaultBackend.name)
+	}
+
+	// the settings shared by the ingress for each host
+	base := ingress{
+		name:            ing.ObjectMeta.Name,
+		namespace:       ing.ObjectMeta.Namespace,
+		class:           class,
+		priority:        priority,
+		httpRedir:       doRedir,
+		balancer:        balancer,
+		affinity:        affinity,
+		match:           match,
+		split:           defaultSplit,
+		redirect:        redirect,
+		requestHeaders:  requestHeaders,
+		responseHeaders: responseHeaders,
+		accessLog:       accessLog,
+		defaultBackend:  defaultBackend,
+	}
+
 	newset := make(map[string]ingressHostGroup)
+	if len(ing.Spec.Rules) == 0 && defaultBackend != nil {
+		// An ingress with only a default backend catches everything
+		newset[""] = ingressHostGroup{base}
+	}
+
 	for i, ingr := range ing.Spec.Rules {
-		ning := ingress{
-			name:      ing.ObjectMeta.Name,
-			namespace: ing.ObjectMeta.Namespace,
-			httpRedir: doRedir,
-		}
-		if ing.Spec.Backend != nil {
-			key := backendToServiceKey(ing.ObjectMeta.Namespace, ing.Spec.Backend)
-			ning.defaultBackend = &key
+		ning := base
+
+		var paths []networkingv1.HTTPIngressPath
+		if ingr.HTTP != nil {
+			paths = ingr.HTTP.Paths
 		}
 
-		for j, ingp := range ingr.HTTP.Paths {
+		for j, ingp := range paths {
 			var re *regexp.Regexp
 			var pathType pathType
 			path := ingp.Path
 
 			if ingp.PathType != nil {
 				switch *ingp.PathType {
-				case networkingv1beta1.PathTypePrefix:
+				case networkingv1.PathTypePrefix:
 					if path == "" {
 						path = "/"
 					}
@@ -392,12 +708,12 @@ func (u *ingUpdater) addItem(obj interface{}) error {
 					if len(path) > 1 && path[len(path)-1] == '/' {
 						path = path[0 : len(path)-1]
 					}
-				case networkingv1beta1.PathTypeExact:
+				case networkingv1.PathTypeExact:
 					pathType = exact
 					if path == "" {
 						path = "/"
 					}
-				case networkingv1beta1.PathTypeImplementationSpecific, "re":
+				case networkingv1.PathTypeImplementationSpecific, "re":
 					pathType = re2
 					if path == "" {
 						path = "/"
@@ -438,9 +754,30 @@ func (u *ingUpdater) addItem(obj interface{}) error {
 				re:       re,
 				backend:  backendToServiceKey(ing.ObjectMeta.Namespace, &ingp.Backend),
 				pathType: pathType,
+				match:    match.forRule(ingp.Path),
+				mirror:   mirror,
+				rewrite:  rewrite,
+
+				requestHeaders:  requestHeaders.forRule(ingp.Path),
+				responseHeaders: responseHeaders.forRule(ingp.Path),
+			}
+			if ingp.Backend.Resource != nil {
+				nir.resource = backendToResourceKey(ing.ObjectMeta.Namespace, ingp.Backend.Resource)
+			} else {
+				nir.split = split.forBackend(nir.backend.name)
 			}
 			ning.rules = append(ning.rules, nir)
 		}
+		if len(paths) == 0 && redirect != nil {
+			// A rule with no paths on a redirecting ingress redirects
+			// everything, no backend is needed.
+			ning.rules = append(ning.rules, ingressRule{
+				host:     ingr.Host,
+				path:     "/",
+				pathType: prefix,
+				match:    match,
+			})
+		}
 		old, _ := newset[ingr.Host]
 		newset[ingr.Host] = append(old, ning)
 		if ingr.Host != "" {
@@ -448,17 +785,42 @@ func (u *ingUpdater) addItem(obj interface{}) error {
 		}
 	}
 
+	ingKey := ingressKey{namespace: ing.Namespace, name: ing.Name}
+	var certs []*certMapEntry
+	var acmeCerts map[secretKey][]string
 	for _, t := range ing.Spec.TLS {
-		var certHosts []string
-		if len(t.Hosts) == 0 {
+		certHosts := t.Hosts
+		if len(certHosts) == 0 {
 			certHosts = hosts
 		}
 
 		secKey := secretKey{namespace: ing.Namespace, name: t.SecretName}
-		ingKey := ingressKey{namespace: ing.Namespace, name: ing.Name}
+		cert, err := u.c.secs.getCert(secKey)
+		if useACME && len(certHosts) > 0 {
+			if acmeCerts == nil {
+				acmeCerts = map[secretKey][]string{}
+			}
+			acmeCerts[secKey] = certHosts
+		}
 
-		u.c.certMap.updateIngress(ingKey, secKey, certHosts)
+		certs = append(certs, &certMapEntry{
+			sec:   secKey,
+			ing:   ingKey,
+			hosts: certHosts,
+			cert:  cert,
+			err:   err,
+		})
 	}
+	u.c.certMap.updateIngress(ingKey, certs)
+	u.c.acme.updateIngress(obj, ingKey, acmeCerts)
+	for _, cme := range certs {
+		cme.RLock()
+		cert, err := cme.cert, cme.err
+		cme.RUnlock()
+		u.c.checkCertificate(obj, cme.sec, cme.hosts, cert, err)
+	}
+	u.c.clientAuth.updateIngress(obj, ingKey, hosts, clientAuth)
+	u.c.clientAuth.checkIngress(obj, clientAuth)
 
 	u.c.ings.update(ing.ObjectMeta.Name, ing.ObjectMeta.Namespace, newset)
 	klog.Infof("ingress %s updated", name)
@@ -467,14 +829,17 @@ func (u *ingUpdater) addItem(obj interface{}) error {
 }
 
 func (u *ingUpdater) delItem(obj interface{}) error {
-	ing, ok := obj.(*networkingv1beta1.Ingress)
-	if !ok {
-		return fmt.Errorf("interface was not an ingress %T", obj)
+	ing, err := toIngressV1(obj)
+	if err != nil {
+		return err
 	}
 
 	klog.Infof("ingress removed, %s/%s", ing.GetNamespace(), ing.GetName())
 
 	u.c.ings.clear(ing.ObjectMeta.Name, ing.ObjectMeta.Namespace)
+	u.c.certMap.updateIngress(ingressKey{namespace: ing.Namespace, name: ing.Name}, nil)
+	u.c.acme.updateIngress(nil, ingressKey{namespace: ing.Namespace, name: ing.Name}, nil)
+	u.c.clientAuth.updateIngress(nil, ingressKey{namespace: ing.Namespace, name: ing.Name}, nil, nil)
 
 	return nil
 }
@@ -482,23 +847,44 @@ func (u *ingUpdater) delItem(obj interface{}) error {
 func (c *Controller) setupIngProcess(ctx context.Context) error {
 	upd := &ingUpdater{c}
 
-	c.ingProc = makeProcessor(
-		&cache.ListWatch{
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = c.selector.String()
+			return c.client.NetworkingV1beta1().Ingresses(c.namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = c.selector.String()
+			return c.client.NetworkingV1beta1().Ingresses(c.namespace).Watch(ctx, options)
+		},
+	}
+	var obj runtime.Object = &networkingv1beta1.Ingress{}
+
+	if c.ingV1 {
+		lw = &cache.ListWatch{
 			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
 				options.LabelSelector = c.selector.String()
-				return c.client.NetworkingV1beta1().Ingresses(c.namespace).List(ctx, options)
+				return c.client.NetworkingV1().Ingresses(c.namespace).List(ctx, options)
 			},
 			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
 				options.LabelSelector = c.selector.String()
-				return c.client.NetworkingV1beta1().Ingresses(c.namespace).Watch(ctx, options)
+				return c.client.NetworkingV1().Ingresses(c.namespace).Watch(ctx, options)
 			},
-		},
-		&networkingv1beta1.Ingress{},
+		}
+		obj = &networkingv1.Ingress{}
+	}
+
+	c.ingProc = makeProcessor(
+		lw,
+		obj,
 		c.refresh,
 		upd,
 	)
 
-	c.ingList = listnetworkingv1beta1.NewIngressLister(c.ingProc.informer.GetIndexer())
+	// Events are only recorded by the leader, so a new leader needs to
+	// revisit the ingresses.
+	c.leader.addTask(func(ctx context.Context) {
+		c.requeueIngresses()
+	})
 
 	return nil
 }
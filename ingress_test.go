@@ -2,8 +2,11 @@ package minke
 
 import (
 	"net/http"
+	"reflect"
 	"regexp"
 	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
 )
 
 func TestIngressHostGroup_matchRule(t *testing.T) {
@@ -312,3 +315,305 @@ func BenchmarkIngressHostGroup_matchRule(b *testing.B) {
 		})
 	}
 }
+
+func TestController_ourClass(t *testing.T) {
+	strptr := func(s string) *string { return &s }
+	tests := []struct {
+		name      string
+		class     string
+		classes   map[string]ingressClass
+		className *string
+		annClass  string
+		expClass  string
+		expOurs   bool
+	}{
+		{
+			name:     "annotation matches",
+			class:    "minke",
+			annClass: "minke",
+			expClass: "minke",
+			expOurs:  true,
+		},
+		{
+			name:     "annotation does not match",
+			class:    "minke",
+			annClass: "other",
+			expClass: "other",
+			expOurs:  false,
+		},
+		{
+			name:    "no class, no default",
+			class:   "minke",
+			expOurs: false,
+		},
+		{
+			name:    "no class, no class set",
+			class:   "",
+			expOurs: true,
+		},
+		{
+			name:  "no class, our default",
+			class: "minke",
+			classes: map[string]ingressClass{
+				"mine": {name: "mine", isDefault: true},
+			},
+			expClass: "mine",
+			expOurs:  true,
+		},
+		{
+			name:  "class name, ours",
+			class: "minke",
+			classes: map[string]ingressClass{
+				"mine": {name: "mine"},
+			},
+			className: strptr("mine"),
+			expClass:  "mine",
+			expOurs:   true,
+		},
+		{
+			name:      "class name, not ours",
+			class:     "minke",
+			className: strptr("minke"),
+			expClass:  "minke",
+			expOurs:   false,
+		},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			c := &Controller{
+				class:   st.class,
+				classes: &classSet{set: st.classes},
+			}
+			ing := &networkingv1.Ingress{
+				Spec: networkingv1.IngressSpec{
+					IngressClassName: st.className,
+				},
+			}
+			if st.annClass != "" {
+				ing.Annotations = map[string]string{"kubernetes.io/ingress.class": st.annClass}
+			}
+
+			class, ours := c.ourClass(ing)
+			if class != st.expClass || ours != st.expOurs {
+				t.Fatalf("expected (%q, %v), got (%q, %v)", st.expClass, st.expOurs, class, ours)
+			}
+		})
+	}
+}
+
+func TestIngressSet_priority(t *testing.T) {
+	intptr := func(i int) *int { return &i }
+	type ing struct {
+		name      string
+		namespace string
+		priority  *int
+	}
+	tests := []struct {
+		name     string
+		ings     []ing
+		expOrder []string
+	}{
+		{
+			name: "no priorities",
+			ings: []ing{
+				{name: "b", namespace: "ns1"},
+				{name: "a", namespace: "ns2"},
+				{name: "a", namespace: "ns1"},
+			},
+			expOrder: []string{"ns1/a", "ns2/a", "ns1/b"},
+		},
+		{
+			name: "priority before name",
+			ings: []ing{
+				{name: "a", namespace: "ns1", priority: intptr(2)},
+				{name: "b", namespace: "ns2", priority: intptr(1)},
+			},
+			expOrder: []string{"ns2/b", "ns1/a"},
+		},
+		{
+			name: "unset priority last",
+			ings: []ing{
+				{name: "a", namespace: "ns1"},
+				{name: "z", namespace: "ns2", priority: intptr(10)},
+			},
+			expOrder: []string{"ns2/z", "ns1/a"},
+		},
+		{
+			name: "negative priority first",
+			ings: []ing{
+				{name: "a", namespace: "ns1", priority: intptr(0)},
+				{name: "b", namespace: "ns1", priority: intptr(-1)},
+			},
+			expOrder: []string{"ns1/b", "ns1/a"},
+		},
+		{
+			name: "interleaved namespaces",
+			ings: []ing{
+				{name: "web", namespace: "team-b", priority: intptr(1)},
+				{name: "api", namespace: "team-a"},
+				{name: "web", namespace: "team-a", priority: intptr(1)},
+				{name: "api", namespace: "team-b", priority: intptr(2)},
+				{name: "catchall", namespace: "team-a"},
+			},
+			expOrder: []string{"team-a/web", "team-b/web", "team-b/api", "team-a/api", "team-a/catchall"},
+		},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			is := &ingressSet{}
+			for _, i := range st.ings {
+				is.update(i.name, i.namespace, map[string]ingressHostGroup{
+					"host": {
+						{
+							name:      i.name,
+							namespace: i.namespace,
+							priority:  i.priority,
+							rules: []ingressRule{
+								{pathType: prefix, path: "/", backend: serviceKey{namespace: i.namespace, name: i.name}},
+							},
+						},
+					},
+				})
+			}
+
+			var got []string
+			for _, ing := range is.set["host"] {
+				got = append(got, ing.namespace+"/"+ing.name)
+			}
+			if !reflect.DeepEqual(got, st.expOrder) {
+				t.Fatalf("expected order %v, got %v", st.expOrder, got)
+			}
+
+			req, _ := http.NewRequest("GET", "http://host/", nil)
+			ing, _ := is.matchRule(req)
+			if ing == nil {
+				t.Fatalf("expected a match")
+			}
+			if gotFirst := ing.namespace + "/" + ing.name; gotFirst != st.expOrder[0] {
+				t.Fatalf("expected %s to match, got %s", st.expOrder[0], gotFirst)
+			}
+		})
+	}
+}
+
+func TestIngressSet_defaultBackend(t *testing.T) {
+	hostDefault := serviceKey{namespace: "ns", name: "host-default"}
+	anyDefault := serviceKey{namespace: "ns", name: "any-default"}
+
+	is := &ingressSet{}
+	is.update("host", "ns", map[string]ingressHostGroup{
+		"host": {
+			{
+				name:           "host",
+				namespace:      "ns",
+				defaultBackend: &hostDefault,
+				rules: []ingressRule{
+					{pathType: prefix, path: "/path", backend: serviceKey{namespace: "ns", name: "path"}},
+				},
+			},
+		},
+	})
+	is.update("any", "ns", map[string]ingressHostGroup{
+		"": {
+			{
+				name:           "any",
+				namespace:      "ns",
+				defaultBackend: &anyDefault,
+			},
+		},
+	})
+
+	tests := []struct {
+		name       string
+		reqURL     string
+		expIngress string
+		expRule    bool
+	}{
+		{name: "rule", reqURL: "http://host/path", expIngress: "host", expRule: true},
+		{name: "host default", reqURL: "http://host/other", expIngress: "host"},
+		{name: "any default", reqURL: "http://other/path", expIngress: "any"},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", st.reqURL, nil)
+			ing, rule := is.matchRule(req)
+			if ing == nil {
+				t.Fatalf("expected a match")
+			}
+			if ing.name != st.expIngress {
+				t.Fatalf("expected ingress %s, got %s", st.expIngress, ing.name)
+			}
+			if (rule != nil) != st.expRule {
+				t.Fatalf("expected rule match %v, got %#v", st.expRule, rule)
+			}
+		})
+	}
+}
+
+func TestIngressSet_matchConditions(t *testing.T) {
+	canary, err := parseMatchConditions(`{"headers": [{"name": "x-canary", "value": "true"}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	posts, err := parseMatchConditions(`{"methods": ["post"], "query": [{"name": "v", "value": "^2", "type": "regex"}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	add := func(is *ingressSet, name string, match *matchConditions, path string) {
+		is.update(name, "ns", map[string]ingressHostGroup{
+			"host": {
+				{
+					name:      name,
+					namespace: "ns",
+					match:     match,
+					rules: []ingressRule{
+						{pathType: prefix, path: path, backend: serviceKey{namespace: "ns", name: name}, match: match},
+					},
+				},
+			},
+		})
+	}
+
+	is := &ingressSet{}
+	// "a-main" sorts before the others by name, the conditions should
+	// still be considered first.
+	add(is, "a-main", nil, "/")
+	add(is, "canary", canary, "/")
+	add(is, "posts", posts, "/api")
+
+	tests := []struct {
+		method  string
+		url     string
+		headers map[string]string
+		exp     string
+	}{
+		{method: "GET", url: "http://host/", exp: "a-main"},
+		{method: "GET", url: "http://host/", headers: map[string]string{"X-Canary": "true"}, exp: "canary"},
+		{method: "GET", url: "http://host/", headers: map[string]string{"X-Canary": "false"}, exp: "a-main"},
+		{method: "POST", url: "http://host/api?v=2.1", exp: "posts"},
+		{method: "POST", url: "http://host/api?v=1", exp: "a-main"},
+		{method: "GET", url: "http://host/api?v=2", exp: "a-main"},
+		{method: "POST", url: "http://host/api?v=2", headers: map[string]string{"X-Canary": "true"}, exp: "canary"},
+	}
+
+	for i, st := range tests {
+		req, _ := http.NewRequest(st.method, st.url, nil)
+		for k, v := range st.headers {
+			req.Header.Set(k, v)
+		}
+		ing, rule := is.matchRule(req)
+		if ing == nil || rule == nil {
+			t.Fatalf("%d: expected a match", i)
+		}
+		if rule.backend.name != st.exp {
+			t.Errorf("%d: %s %s expected %s, got %s", i, st.method, st.url, st.exp, rule.backend.name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package minke
+
+import (
+	"fmt"
+	"strconv"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ingressV1Available checks if the API server offers networking.k8s.io/v1
+// Ingresses, if it does not we fall back to networking.k8s.io/v1beta1.
+func ingressV1Available(client kubernetes.Interface) bool {
+	rs, err := client.Discovery().ServerResourcesForGroupVersion(networkingv1.SchemeGroupVersion.String())
+	if err != nil || rs == nil {
+		return false
+	}
+	for _, r := range rs.APIResources {
+		if r.Name == "ingresses" {
+			return true
+		}
+	}
+	return false
+}
+
+// toIngressV1 returns obj as a networking.k8s.io/v1 Ingress, converting
+// v1beta1 Ingresses as needed. All the ingress handling is done against
+// the v1 types.
+func toIngressV1(obj interface{}) (*networkingv1.Ingress, error) {
+	switch ing := obj.(type) {
+	case *networkingv1.Ingress:
+		return ing, nil
+	case *networkingv1beta1.Ingress:
+		return ingressV1beta1ToV1(ing), nil
+	default:
+		return nil, fmt.Errorf("interface was not an ingress %T", obj)
+	}
+}
+
+func ingressV1beta1ToV1(in *networkingv1beta1.Ingress) *networkingv1.Ingress {
+	out := &networkingv1.Ingress{
+		ObjectMeta: in.ObjectMeta,
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: in.Spec.IngressClassName,
+		},
+		Status: networkingv1.IngressStatus{
+			LoadBalancer: in.Status.LoadBalancer,
+		},
+	}
+	out.APIVersion = networkingv1.SchemeGroupVersion.String()
+	out.Kind = "Ingress"
+
+	if in.Spec.Backend != nil {
+		b := backendV1beta1ToV1(*in.Spec.Backend)
+		out.Spec.DefaultBackend = &b
+	}
+
+	for _, t := range in.Spec.TLS {
+		out.Spec.TLS = append(out.Spec.TLS, networkingv1.IngressTLS{
+			Hosts:      t.Hosts,
+			SecretName: t.SecretName,
+		})
+	}
+
+	for _, r := range in.Spec.Rules {
+		nr := networkingv1.IngressRule{
+			Host: r.Host,
+		}
+		if r.HTTP != nil {
+			nr.HTTP = &networkingv1.HTTPIngressRuleValue{}
+			for _, p := range r.HTTP.Paths {
+				np := networkingv1.HTTPIngressPath{
+					Path:    p.Path,
+					Backend: backendV1beta1ToV1(p.Backend),
+				}
+				if p.PathType != nil {
+					pt := networkingv1.PathType(*p.PathType)
+					np.PathType = &pt
+				}
+				nr.HTTP.Paths = append(nr.HTTP.Paths, np)
+			}
+		}
+		out.Spec.Rules = append(out.Spec.Rules, nr)
+	}
+
+	return out
+}
+
+func backendV1beta1ToV1(in networkingv1beta1.IngressBackend) networkingv1.IngressBackend {
+	if in.Resource != nil {
+		return networkingv1.IngressBackend{
+			Resource: in.Resource,
+		}
+	}
+
+	svc := &networkingv1.IngressServiceBackend{
+		Name: in.ServiceName,
+	}
+	if in.ServicePort.Type == intstr.Int {
+		svc.Port.Number = in.ServicePort.IntVal
+	} else {
+		svc.Port.Name = in.ServicePort.StrVal
+	}
+
+	return networkingv1.IngressBackend{
+		Service: svc,
+	}
+}
+
+// backendToServiceKey builds the key we use for looking up the endpoints for
+// a backend. Ports given by number are stored in the portName as the
+// number, and are resolved to the service's port name at request time,
+// (port names must contain a letter, so this is unambiguous).
+func backendToServiceKey(namespace string, b *networkingv1.IngressBackend) serviceKey {
+	if b.Service == nil {
+		return serviceKey{namespace: namespace}
+	}
+
+	key := serviceKey{
+		namespace: namespace,
+		name:      b.Service.Name,
+		portName:  b.Service.Port.Name,
+	}
+	if b.Service.Port.Number != 0 {
+		key.portName = strconv.Itoa(int(b.Service.Port.Number))
+	}
+
+	return key
+}
@@ -0,0 +1,187 @@
+package minke
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElection tracks whether we are the replica that should carry out
+// any work that writes to the cluster. If no lease is configured, every
+// replica considers itself the leader.
+type leaderElection struct {
+	namespace string
+	name      string
+	identity  string
+
+	leading int32
+	metric  GaugeMetric
+
+	mu      sync.Mutex
+	elector *leaderelection.LeaderElector
+	tasks   []func(ctx context.Context)
+}
+
+// WithLeaderElection is an option for enabling leader election using a
+// coordination.k8s.io Lease, in the form of NAMESPACE/NAME. Only the leader
+// will write to the cluster, every replica will continue to serve traffic.
+// If identity is empty, the hostname is used.
+func WithLeaderElection(lease, identity string) Option {
+	return func(c *Controller) error {
+		parts := strings.SplitN(lease, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("leader election lease should be in the form of NAMESPACE/NAME")
+		}
+
+		if identity == "" {
+			var err error
+			identity, err = os.Hostname()
+			if err != nil {
+				return fmt.Errorf("could not determine leader election identity, %w", err)
+			}
+		}
+
+		c.leader.namespace = parts[0]
+		c.leader.name = parts[1]
+		c.leader.identity = identity
+		return nil
+	}
+}
+
+// MarshalJSON lets us report the leader election status
+func (le *leaderElection) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{
+		"enabled": le.enabled(),
+		"leading": le.isLeader(),
+	}
+	if le.enabled() {
+		strmap["lease"] = fmt.Sprintf("%s/%s", le.namespace, le.name)
+		strmap["identity"] = le.identity
+
+		le.mu.Lock()
+		if le.elector != nil {
+			strmap["leader"] = le.elector.GetLeader()
+		}
+		le.mu.Unlock()
+	}
+	return json.Marshal(strmap)
+}
+
+func (le *leaderElection) enabled() bool {
+	return le.name != ""
+}
+
+func (le *leaderElection) isLeader() bool {
+	return atomic.LoadInt32(&le.leading) == 1
+}
+
+func (le *leaderElection) setLeader(leading bool) {
+	var v int32
+	if leading {
+		v = 1
+	}
+	atomic.StoreInt32(&le.leading, v)
+	if le.metric != nil {
+		le.metric.Set(float64(v))
+	}
+}
+
+// addTask registers a function to be called each time we become the
+// leader. The context is cancelled when we stop leading.
+func (le *leaderElection) addTask(f func(ctx context.Context)) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.tasks = append(le.tasks, f)
+}
+
+func (le *leaderElection) startTasks(ctx context.Context) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	for _, f := range le.tasks {
+		go f(ctx)
+	}
+}
+
+// IsLeader reports whether this replica is currently permitted to write
+// to the cluster.
+func (c *Controller) IsLeader() bool {
+	return c.leader.isLeader()
+}
+
+// runLeaderElection contends for leadership until stopCh is closed,
+// running the leader tasks whenever we hold the lease.
+func (c *Controller) runLeaderElection(stopCh <-chan struct{}) {
+	le := c.leader
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	if !le.enabled() {
+		le.setLeader(true)
+		le.startTasks(ctx)
+		<-ctx.Done()
+		return
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: le.namespace,
+			Name:      le.name,
+		},
+		Client: c.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      le.identity,
+			EventRecorder: c.recorder,
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Name:            le.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("became leader for lease %s/%s", le.namespace, le.name)
+				le.setLeader(true)
+				le.startTasks(ctx)
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("stopped leading for lease %s/%s", le.namespace, le.name)
+				le.setLeader(false)
+			},
+			OnNewLeader: func(identity string) {
+				klog.Infof("new leader for lease %s/%s, %s", le.namespace, le.name, identity)
+			},
+		},
+	})
+	if err != nil {
+		klog.Errorf("could not start leader election, %v", err)
+		return
+	}
+
+	le.mu.Lock()
+	le.elector = elector
+	le.mu.Unlock()
+
+	// Run returns when we lose the lease, so we keep contending
+	// until we are told to stop.
+	wait.UntilWithContext(ctx, elector.Run, 2*time.Second)
+}
@@ -0,0 +1,328 @@
+package minke
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// annMatch adds extra conditions that a request must meet to match the
+// rules of an Ingress. The value is a JSON object, for example:
+//
+//	{
+//	  "methods": ["POST", "PUT"],
+//	  "headers": [{"name": "X-Canary", "value": "true"}],
+//	  "query": [{"name": "version", "value": "^v2", "type": "regex"}]
+//	}
+//
+// All the conditions must be met. Values are matched exactly by default,
+// a type of "prefix" or "regex" can be given. A condition with no value
+// only requires that the header or query parameter is present.
+//
+// Conditions for individual rules can be given in "rules", keyed by the
+// path of the rule as written in the Ingress. They must be met as well as
+// those for the whole Ingress:
+//
+//	{"rules": {"/admin": {"headers": [{"name": "X-Admin", "value": "true"}]}}}
+var annMatch = annPrefix + "match"
+
+type matchType int
+
+const (
+	matchExact matchType = iota
+	matchPrefix
+	matchRegex
+)
+
+func (mt matchType) String() string {
+	switch mt {
+	case matchExact:
+		return "exact"
+	case matchPrefix:
+		return "prefix"
+	case matchRegex:
+		return "regex"
+	default:
+		return fmt.Sprintf("(unknown:%v)", int(mt))
+	}
+}
+
+// valueMatch matches a named header or query parameter.
+type valueMatch struct {
+	name      string
+	value     string
+	matchType matchType
+	re        *regexp.Regexp
+}
+
+func (vm valueMatch) matchValues(vs []string) bool {
+	if len(vs) == 0 {
+		return false
+	}
+	if vm.value == "" && vm.matchType != matchRegex {
+		return true
+	}
+	for _, v := range vs {
+		switch vm.matchType {
+		case matchExact:
+			if v == vm.value {
+				return true
+			}
+		case matchPrefix:
+			if strings.HasPrefix(v, vm.value) {
+				return true
+			}
+		case matchRegex:
+			if vm.re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (vm valueMatch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"name":  vm.name,
+		"value": vm.value,
+		"type":  vm.matchType.String(),
+	})
+}
+
+// matchConditions are the requirements, beyond the host and path, that a
+// request must meet to match a rule.
+type matchConditions struct {
+	methods []string
+	headers []valueMatch
+	query   []valueMatch
+	rules   map[string]*matchConditions
+}
+
+func (mc *matchConditions) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{}
+	if len(mc.methods) != 0 {
+		strmap["methods"] = mc.methods
+	}
+	if len(mc.headers) != 0 {
+		strmap["headers"] = mc.headers
+	}
+	if len(mc.query) != 0 {
+		strmap["query"] = mc.query
+	}
+	if len(mc.rules) != 0 {
+		strmap["rules"] = mc.rules
+	}
+	return json.Marshal(strmap)
+}
+
+// match reports whether the request meets all the conditions, a nil set
+// of conditions matches everything.
+func (mc *matchConditions) match(r *http.Request) bool {
+	if mc == nil {
+		return true
+	}
+
+	if len(mc.methods) != 0 {
+		found := false
+		for _, m := range mc.methods {
+			if r.Method == m {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, h := range mc.headers {
+		if !h.matchValues(r.Header.Values(h.name)) {
+			return false
+		}
+	}
+
+	if len(mc.query) != 0 {
+		q := r.URL.Query()
+		for _, p := range mc.query {
+			if !p.matchValues(q[p.name]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+type valueMatchJSON struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+type matchConditionsJSON struct {
+	Methods []string                        `json:"methods"`
+	Headers []valueMatchJSON                `json:"headers"`
+	Query   []valueMatchJSON                `json:"query"`
+	Rules   map[string]*matchConditionsJSON `json:"rules"`
+}
+
+func parseValueMatch(in valueMatchJSON, canonical bool) (valueMatch, error) {
+	if in.Name == "" {
+		return valueMatch{}, fmt.Errorf("condition has no name")
+	}
+	vm := valueMatch{
+		name:  in.Name,
+		value: in.Value,
+	}
+	if canonical {
+		vm.name = http.CanonicalHeaderKey(in.Name)
+	}
+
+	switch strings.ToLower(in.Type) {
+	case "", "exact":
+		vm.matchType = matchExact
+	case "prefix":
+		vm.matchType = matchPrefix
+	case "regex":
+		vm.matchType = matchRegex
+		re, err := regexp.Compile(in.Value)
+		if err != nil {
+			return valueMatch{}, fmt.Errorf("condition on %q has an invalid regex, %w", in.Name, err)
+		}
+		vm.re = re
+	default:
+		return valueMatch{}, fmt.Errorf("condition on %q has unknown type %q, should be exact, prefix or regex", in.Name, in.Type)
+	}
+
+	return vm, nil
+}
+
+// parseMatchConditions parses the value of the match annotation.
+func parseMatchConditions(str string) (*matchConditions, error) {
+	var in matchConditionsJSON
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, fmt.Errorf("invalid match conditions, %w", err)
+	}
+
+	mc, err := newMatchConditions(&in)
+	if err != nil {
+		return nil, err
+	}
+	for path, rin := range in.Rules {
+		if rin == nil {
+			return nil, fmt.Errorf("invalid match conditions, no conditions for rule %s", path)
+		}
+		if len(rin.Rules) != 0 {
+			return nil, fmt.Errorf("invalid match conditions, rule %s cannot have rules of its own", path)
+		}
+		rmc, err := newMatchConditions(rin)
+		if err != nil {
+			return nil, err
+		}
+		if len(mc.methods) != 0 && len(rmc.methods) != 0 {
+			rmc.methods = commonMethods(mc.methods, rmc.methods)
+			if len(rmc.methods) == 0 {
+				return nil, fmt.Errorf("invalid match conditions, rule %s has no methods in common with the ingress", path)
+			}
+		}
+		if mc.rules == nil {
+			mc.rules = map[string]*matchConditions{}
+		}
+		mc.rules[path] = rmc
+	}
+
+	if mc.empty() && len(mc.rules) == 0 {
+		return nil, nil
+	}
+
+	return mc, nil
+}
+
+func newMatchConditions(in *matchConditionsJSON) (*matchConditions, error) {
+	mc := &matchConditions{}
+	for _, m := range in.Methods {
+		mc.methods = append(mc.methods, strings.ToUpper(m))
+	}
+	for _, h := range in.Headers {
+		vm, err := parseValueMatch(h, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header match, %w", err)
+		}
+		mc.headers = append(mc.headers, vm)
+	}
+	for _, q := range in.Query {
+		vm, err := parseValueMatch(q, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query match, %w", err)
+		}
+		mc.query = append(mc.query, vm)
+	}
+
+	return mc, nil
+}
+
+func (mc *matchConditions) empty() bool {
+	return len(mc.methods) == 0 && len(mc.headers) == 0 && len(mc.query) == 0
+}
+
+// commonMethods returns the methods in both lists.
+func commonMethods(a, b []string) []string {
+	var res []string
+	for _, m := range b {
+		for _, n := range a {
+			if m == n {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// checkPaths verifies that the rules of the conditions name paths used by
+// the Ingress.
+func (mc *matchConditions) checkPaths(paths []string) error {
+	if mc == nil {
+		return nil
+	}
+	used := map[string]bool{}
+	for _, p := range paths {
+		used[p] = true
+	}
+	for path := range mc.rules {
+		if !used[path] {
+			return fmt.Errorf("invalid match conditions, rule %s is not a path of the ingress", path)
+		}
+	}
+	return nil
+}
+
+// forRule returns the conditions for the rule with the given path, those
+// for the whole Ingress along with any given for the rule.
+func (mc *matchConditions) forRule(path string) *matchConditions {
+	if mc == nil {
+		return nil
+	}
+	rmc := mc.rules[path]
+	if rmc == nil {
+		if mc.empty() {
+			return nil
+		}
+		return &matchConditions{methods: mc.methods, headers: mc.headers, query: mc.query}
+	}
+
+	res := &matchConditions{
+		methods: mc.methods,
+		headers: append(append([]valueMatch{}, mc.headers...), rmc.headers...),
+		query:   append(append([]valueMatch{}, mc.query...), rmc.query...),
+	}
+	if len(rmc.methods) != 0 {
+		// already narrowed to those allowed for the ingress
+		res.methods = rmc.methods
+	}
+	return res
+}
@@ -0,0 +1,159 @@
+package minke
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseMatchConditions(t *testing.T) {
+	tests := []struct {
+		str    string
+		expErr bool
+		expNil bool
+	}{
+		{str: `{}`, expNil: true},
+		{str: `{"methods": ["GET"]}`},
+		{str: `{"headers": [{"name": "X-A", "value": "b", "type": "prefix"}]}`},
+		{str: `{"query": [{"name": "a", "value": "^b$", "type": "regex"}]}`},
+		{str: `{"query": [{"name": "a", "value": "(", "type": "regex"}]}`, expErr: true},
+		{str: `{"headers": [{"value": "b"}]}`, expErr: true},
+		{str: `{"headers": [{"name": "X-A", "type": "glob"}]}`, expErr: true},
+		{str: `{"header": []}`, expErr: true},
+		{str: `not json`, expErr: true},
+	}
+
+	for _, st := range tests {
+		mc, err := parseMatchConditions(st.str)
+		if (err != nil) != st.expErr {
+			t.Errorf("%s: unexpected error state, %v", st.str, err)
+			continue
+		}
+		if !st.expErr && (mc == nil) != st.expNil {
+			t.Errorf("%s: expected nil %v, got %v", st.str, st.expNil, mc)
+		}
+	}
+}
+
+func TestMatchConditions_match(t *testing.T) {
+	mc, err := parseMatchConditions(`{
+		"methods": ["GET", "HEAD"],
+		"headers": [
+			{"name": "x-present"},
+			{"name": "x-prefix", "value": "abc", "type": "prefix"}
+		],
+		"query": [{"name": "q", "value": "yes"}]
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	req := func(method string, headers map[string]string, query string) *http.Request {
+		r, _ := http.NewRequest(method, "http://host/?"+query, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+	good := map[string]string{"X-Present": "", "X-Prefix": "abcdef"}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		exp  bool
+	}{
+		{name: "all met", req: req("HEAD", good, "q=yes"), exp: true},
+		{name: "wrong method", req: req("POST", good, "q=yes")},
+		{name: "missing header", req: req("GET", map[string]string{"X-Prefix": "abc"}, "q=yes")},
+		{name: "wrong prefix", req: req("GET", map[string]string{"X-Present": "1", "X-Prefix": "ab"}, "q=yes")},
+		{name: "repeated query", req: req("GET", good, "q=no&q=yes"), exp: true},
+		{name: "wrong query", req: req("GET", good, "q=no")},
+	}
+
+	for _, st := range tests {
+		if got := mc.match(st.req); got != st.exp {
+			t.Errorf("%s: expected %v, got %v", st.name, st.exp, got)
+		}
+	}
+
+	var none *matchConditions
+	if !none.match(req("POST", nil, "")) {
+		t.Errorf("nil conditions should match everything")
+	}
+}
+
+func TestMatchConditions_rules(t *testing.T) {
+	mc, err := parseMatchConditions(`{
+		"methods": ["GET", "POST"],
+		"headers": [{"name": "x-tenant", "value": "a"}],
+		"rules": {
+			"/admin": {
+				"methods": ["POST", "DELETE"],
+				"headers": [{"name": "x-admin", "value": "true"}]
+			},
+			"/search": {"query": [{"name": "q"}]}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err := mc.checkPaths([]string{"/admin", "/search", "/"}); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if err := mc.checkPaths([]string{"/admin"}); err == nil {
+		t.Fatalf("expected an error for a rule that is not a path of the ingress")
+	}
+
+	req := func(method, query string, headers ...string) *http.Request {
+		r, _ := http.NewRequest(method, "http://host/?"+query, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		path string
+		req  *http.Request
+		exp  bool
+	}{
+		{name: "other rule", path: "/", req: req("GET", "", "X-Tenant", "a"), exp: true},
+		{name: "other rule wrong method", path: "/", req: req("PUT", "", "X-Tenant", "a")},
+		{name: "other rule needs ingress header", path: "/", req: req("GET", "")},
+		{name: "admin all met", path: "/admin", req: req("POST", "", "X-Tenant", "a", "X-Admin", "true"), exp: true},
+		{name: "admin needs ingress header", path: "/admin", req: req("POST", "", "X-Admin", "true")},
+		{name: "admin needs rule header", path: "/admin", req: req("POST", "", "X-Tenant", "a")},
+		{name: "admin method not in rule", path: "/admin", req: req("GET", "", "X-Tenant", "a", "X-Admin", "true")},
+		{name: "admin method not in ingress", path: "/admin", req: req("DELETE", "", "X-Tenant", "a", "X-Admin", "true")},
+		{name: "search all met", path: "/search", req: req("GET", "q=x", "X-Tenant", "a"), exp: true},
+		{name: "search needs query", path: "/search", req: req("GET", "", "X-Tenant", "a")},
+	}
+
+	for _, st := range tests {
+		if got := mc.forRule(st.path).match(st.req); got != st.exp {
+			t.Errorf("%s: expected %v, got %v", st.name, st.exp, got)
+		}
+	}
+
+	for _, str := range []string{
+		`{"methods": ["GET"], "rules": {"/a": {"methods": ["POST"]}}}`,
+		`{"rules": {"/a": {"rules": {"/b": {}}}}}`,
+		`{"rules": {"/a": null}}`,
+	} {
+		if _, err := parseMatchConditions(str); err == nil {
+			t.Errorf("%s: expected an error", str)
+		}
+	}
+
+	// conditions only for rules still apply
+	mc, err = parseMatchConditions(`{"rules": {"/a": {"methods": ["POST"]}}}`)
+	if err != nil || mc == nil {
+		t.Fatalf("expected conditions, got %v, %v", mc, err)
+	}
+	if mc.forRule("/a").match(req("GET", "")) {
+		t.Errorf("expected the rule conditions to apply")
+	}
+	if mc.forRule("/b") != nil {
+		t.Errorf("expected no conditions for other rules")
+	}
+}
@@ -1,10 +1,19 @@
 package minke
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 )
@@ -29,6 +38,22 @@ type CounterMetric interface {
 	Inc()
 }
 
+// MirrorMetric counts the results of mirrored requests.
+type MirrorMetric interface {
+	Inc(ingress, result string)
+}
+
+// TrafficSplitMetric counts the requests sent to each variant of a
+// traffic split.
+type TrafficSplitMetric interface {
+	Inc(ingress, variant string)
+}
+
+// CertificateMetric counts failures to load TLS secrets.
+type CertificateMetric interface {
+	LoadError(secret string)
+}
+
 type MetricsProvider interface {
 	NewListsMetric(name string) cache.CounterMetric
 	NewListDurationMetric(name string) cache.SummaryMetric
@@ -48,13 +73,28 @@ type MetricsProvider interface {
 	NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric
 	NewWorkDurationMetric(name string) workqueue.HistogramMetric
 	NewRetriesMetric(name string) workqueue.CounterMetric
+	NewLeaderElectionMetric(name string) GaugeMetric
+	NewTrafficSplitMetric() TrafficSplitMetric
+	NewMirrorMetric() MirrorMetric
+	NewCertificateMetric(certs func() []CertificateInfo) CertificateMetric
+	NewHTTPDialMetrics(dial DialFunc) DialFunc
 	NewHTTPTransportMetrics(upstream http.RoundTripper) http.RoundTripper
 	NewHTTPServerMetrics(upstream http.Handler) http.Handler
+	NewTLSServerMetrics(cfg *tls.Config) *tls.Config
 }
 
+// DialFunc dials connections to backends.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 type prometheusMetricsProvider struct {
 	registry *prometheus.Registry
 
+	proxyLabels []string
+	limiter     *labelLimiter
+
+	connMetricsOnce sync.Once
+	connMetrics     *connectionMetrics
+
 	listsTotal        *prometheus.CounterVec
 	listsDuration     *prometheus.SummaryVec
 	itemsPerList      *prometheus.SummaryVec
@@ -65,7 +105,47 @@ type prometheusMetricsProvider struct {
 	listWatchError    *prometheus.GaugeVec
 }
 
-func NewPrometheusMetrics(r *prometheus.Registry) *prometheusMetricsProvider {
+// PrometheusOption configures the prometheus metrics provider.
+type PrometheusOption func(*prometheusMetricsProvider) error
+
+// ProxyMetricLabels is an option for choosing which of the "ingress",
+// "host" (of the matched rule) and "service" labels are added to the
+// proxy request metrics, all are used by default.
+func ProxyMetricLabels(labels ...string) PrometheusOption {
+	return func(p *prometheusMetricsProvider) error {
+		p.proxyLabels = nil
+		for _, l := range labels {
+			l = strings.TrimSpace(l)
+			switch l {
+			case "":
+				continue
+			case "ingress", "host", "service":
+				p.proxyLabels = append(p.proxyLabels, l)
+			default:
+				return fmt.Errorf("unknown proxy metric label %q", l)
+			}
+		}
+		return nil
+	}
+}
+
+// ProxyMetricMaxLabelSets is an option for bounding the number of distinct
+// ingress, host and service combinations tracked by the proxy request
+// metrics, further combinations are recorded with the value "other". Zero
+// disables the limit.
+func ProxyMetricMaxLabelSets(n int) PrometheusOption {
+	return func(p *prometheusMetricsProvider) error {
+		if n < 0 {
+			return fmt.Errorf("maximum label sets must not be negative, got %d", n)
+		}
+		p.limiter.max = n
+		return nil
+	}
+}
+
+const defaultMaxLabelSets = 1000
+
+func NewPrometheusMetrics(r *prometheus.Registry, opts ...PrometheusOption) (*prometheusMetricsProvider, error) {
 	listsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: reflectorSubsystem,
 		Name:      "lists_total",
@@ -124,7 +204,19 @@ func NewPrometheusMetrics(r *prometheus.Registry) *prometheusMetricsProvider {
 		watchDuration:     watchDuration,
 		itemsPerWatch:     itemsPerWatch,
 		listWatchError:    listWatchError,
+
+		proxyLabels: []string{"ingress", "host", "service"},
+		limiter: &labelLimiter{
+			max:  defaultMaxLabelSets,
+			seen: map[proxyLabels]struct{}{},
+		},
 	}
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+
 	p.registry.MustRegister(listsTotal)
 	p.registry.MustRegister(listsDuration)
 	p.registry.MustRegister(itemsPerList)
@@ -134,7 +226,7 @@ func NewPrometheusMetrics(r *prometheus.Registry) *prometheusMetricsProvider {
 	p.registry.MustRegister(itemsPerWatch)
 	p.registry.MustRegister(listWatchError)
 
-	return p
+	return p, nil
 }
 
 func (p *prometheusMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
@@ -267,63 +359,545 @@ func (p *prometheusMetricsProvider) NewListWatchErrorMetric(name string) cache.G
 	return p.listWatchError.WithLabelValues(name)
 }
 
+func (p *prometheusMetricsProvider) NewLeaderElectionMetric(name string) GaugeMetric {
+	leader := prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem:   "leader_election",
+		Name:        "is_leader",
+		Help:        "Whether this replica currently holds the leader election lease, always 1 if leader election is disabled.",
+		ConstLabels: prometheus.Labels{"name": name},
+	})
+	p.registry.MustRegister(leader)
+	return leader
+}
+
+type prometheusTrafficSplitMetric struct {
+	counter *prometheus.CounterVec
+}
+
+func (m prometheusTrafficSplitMetric) Inc(ingress, variant string) {
+	m.counter.WithLabelValues(ingress, variant).Inc()
+}
+
+func (p *prometheusMetricsProvider) NewTrafficSplitMetric() TrafficSplitMetric {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "traffic_split",
+		Name:      "requests_total",
+		Help:      "Requests sent to each variant of an ingress traffic split.",
+	}, []string{"ingress", "variant"})
+	p.registry.MustRegister(counter)
+	return prometheusTrafficSplitMetric{counter: counter}
+}
+
+type prometheusMirrorMetric struct {
+	counter *prometheus.CounterVec
+}
+
+func (m prometheusMirrorMetric) Inc(ingress, result string) {
+	m.counter.WithLabelValues(ingress, result).Inc()
+}
+
+func (p *prometheusMetricsProvider) NewMirrorMetric() MirrorMetric {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "mirror",
+		Name:      "requests_total",
+		Help:      "Mirrored requests by result, one of success, failure, dropped, body_too_large or incomplete.",
+	}, []string{"ingress", "result"})
+	p.registry.MustRegister(counter)
+	return prometheusMirrorMetric{counter: counter}
+}
+
+// certificateCollector reports the expiry of the currently loaded
+// certificates. Certificates are collected on each scrape so that those
+// no longer in use are not reported.
+type certificateCollector struct {
+	certs    func() []CertificateInfo
+	notAfter *prometheus.Desc
+}
+
+func (cc *certificateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cc.notAfter
+}
+
+func (cc *certificateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ci := range cc.certs() {
+		ch <- prometheus.MustNewConstMetric(
+			cc.notAfter,
+			prometheus.GaugeValue,
+			float64(ci.NotAfter.Unix()),
+			ci.Secret, strings.Join(ci.Hosts, ","))
+	}
+}
+
+type prometheusCertificateMetric struct {
+	loadErrors *prometheus.CounterVec
+}
+
+func (m prometheusCertificateMetric) LoadError(secret string) {
+	m.loadErrors.WithLabelValues(secret).Inc()
+}
+
+func (p *prometheusMetricsProvider) NewCertificateMetric(certs func() []CertificateInfo) CertificateMetric {
+	p.registry.MustRegister(&certificateCollector{
+		certs: certs,
+		notAfter: prometheus.NewDesc(
+			"tls_certificate_not_after_timestamp_seconds",
+			"The expiry time of each loaded certificate, in seconds since the epoch. Default certificates have no hosts.",
+			[]string{"secret", "hosts"}, nil),
+	})
+	loadErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "tls_certificate",
+		Name:      "load_errors_total",
+		Help:      "TLS secrets whose certificate or key could not be parsed.",
+	}, []string{"secret"})
+	p.registry.MustRegister(loadErrors)
+	return prometheusCertificateMetric{loadErrors: loadErrors}
+}
+
+// proxyLabels identifies the ingress and backend that handled a request.
+type proxyLabels struct {
+	ingress string
+	host    string
+	service string
+}
+
+// labelLimiter bounds the number of distinct label sets a metric may
+// have, once the limit is reached new sets are recorded as "other".
+type labelLimiter struct {
+	sync.Mutex
+	max  int
+	seen map[proxyLabels]struct{}
+}
+
+var otherLabels = proxyLabels{ingress: "other", host: "other", service: "other"}
+
+func (l *labelLimiter) limit(pl proxyLabels) proxyLabels {
+	if l.max <= 0 {
+		return pl
+	}
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.seen[pl]; ok {
+		return pl
+	}
+	if len(l.seen) >= l.max {
+		return otherLabels
+	}
+	l.seen[pl] = struct{}{}
+	return pl
+}
+
+// proxyLabelNames gives the names of the enabled labels, followed by any
+// extra names.
+func (p *prometheusMetricsProvider) proxyLabelNames(extra ...string) []string {
+	names := make([]string, 0, len(p.proxyLabels)+len(extra))
+	names = append(names, p.proxyLabels...)
+	return append(names, extra...)
+}
+
+// proxyLabelValues gives the values of the enabled labels, followed by any
+// extra values.
+func (p *prometheusMetricsProvider) proxyLabelValues(pl proxyLabels, extra ...string) []string {
+	pl = p.limiter.limit(pl)
+	vals := make([]string, 0, len(p.proxyLabels)+len(extra))
+	for _, l := range p.proxyLabels {
+		switch l {
+		case "ingress":
+			vals = append(vals, pl.ingress)
+		case "host":
+			vals = append(vals, pl.host)
+		case "service":
+			vals = append(vals, pl.service)
+		}
+	}
+	return append(vals, extra...)
+}
+
+// codeClass reduces a status code to its class, e.g. 2xx.
+func codeClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// exemplarLabels gives the trace ID of the request, if it is being traced.
+func exemplarLabels(ctx context.Context) prometheus.Labels {
+	sc := trace.SpanFromContext(ctx).SpanContext()
+	if !sc.TraceID.IsValid() || !sc.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": sc.TraceID.String()}
+}
+
+func observe(o prometheus.Observer, v float64, exemplar prometheus.Labels) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(v, exemplar)
+		return
+	}
+	o.Observe(v)
+}
+
+func inc(c prometheus.Counter, exemplar prometheus.Labels) {
+	if ea, ok := c.(prometheus.ExemplarAdder); ok && exemplar != nil {
+		ea.AddWithExemplar(1, exemplar)
+		return
+	}
+	c.Inc()
+}
+
+// connectionMetrics track connections to backends, they are shared by the
+// transport and dialer metrics.
+type connectionMetrics struct {
+	dnsDuration     *prometheus.HistogramVec
+	connectDuration *prometheus.HistogramVec
+	tlsDuration     *prometheus.HistogramVec
+	connections     *prometheus.CounterVec
+	dialErrors      *prometheus.CounterVec
+	open            *prometheus.GaugeVec
+	idle            *prometheus.GaugeVec
+
+	// conns holds the open metered connections by address, so that we
+	// can find them again under the transport's TLS wrapping.
+	conns sync.Map
+}
+
+func (p *prometheusMetricsProvider) connectionMetrics() *connectionMetrics {
+	p.connMetricsOnce.Do(func() {
+		cm := &connectionMetrics{
+			dnsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    "http_client_dns_duration_seconds",
+				Help:    "A histogram of DNS lookup latencies for backend connections.",
+				Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5},
+			}, []string{"service"}),
+			connectDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    "http_client_connect_duration_seconds",
+				Help:    "A histogram of TCP connect latencies for backend connections.",
+				Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+			}, []string{"service"}),
+			tlsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    "http_client_tls_duration_seconds",
+				Help:    "A histogram of TLS handshake latencies for backend connections.",
+				Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1},
+			}, []string{"service"}),
+			connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "http_client_connections_total",
+				Help: "Connections used for backend requests, by whether they were reused from the pool.",
+			}, []string{"service", "reused"}),
+			dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "http_client_dial_errors_total",
+				Help: "Failed attempts to connect to backends.",
+			}, []string{"service"}),
+			open: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "http_client_open_connections",
+				Help: "Open HTTP/1 connections to backends.",
+			}, []string{"service"}),
+			idle: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "http_client_idle_connections",
+				Help: "HTTP/1 connections to backends waiting in the idle pool.",
+			}, []string{"service"}),
+		}
+		p.registry.MustRegister(
+			cm.dnsDuration,
+			cm.connectDuration,
+			cm.tlsDuration,
+			cm.connections,
+			cm.dialErrors,
+			cm.open,
+			cm.idle,
+		)
+		p.connMetrics = cm
+	})
+	return p.connMetrics
+}
+
+// backendService gives the service a backend request, or connection, is
+// for.
+func backendService(ctx context.Context) string {
+	st, _ := ctx.Value(requestStateKey{}).(*requestState)
+	if st == nil {
+		return ""
+	}
+	return st.metricLabels().service
+}
+
+// meteredConn tracks whether a backend connection is open and idle.
+type meteredConn struct {
+	net.Conn
+	open  prometheus.Gauge
+	idle  prometheus.Gauge
+	conns *sync.Map
+
+	mu     sync.Mutex
+	closed bool
+	isIdle bool
+}
+
+func (c *meteredConn) setIdle(idle bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.isIdle == idle {
+		return
+	}
+	c.isIdle = idle
+	if idle {
+		c.idle.Inc()
+	} else {
+		c.idle.Dec()
+	}
+}
+
+func (c *meteredConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.open.Dec()
+		if c.isIdle {
+			c.idle.Dec()
+		}
+		c.conns.Delete(connKey(c))
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// connKey identifies a connection by its addresses, which are passed
+// through by any TLS wrapping.
+func connKey(conn net.Conn) string {
+	var local, remote string
+	if addr := conn.LocalAddr(); addr != nil {
+		local = addr.String()
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		remote = addr.String()
+	}
+	return local + "|" + remote
+}
+
+// meteredConn finds our connection under any TLS wrapping.
+func (cm *connectionMetrics) meteredConn(conn net.Conn) *meteredConn {
+	if mc, ok := conn.(*meteredConn); ok {
+		return mc
+	}
+	if v, ok := cm.conns.Load(connKey(conn)); ok {
+		return v.(*meteredConn)
+	}
+	return nil
+}
+
+func (p *prometheusMetricsProvider) NewHTTPDialMetrics(dial DialFunc) DialFunc {
+	cm := p.connectionMetrics()
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		svc := backendService(ctx)
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			cm.dialErrors.WithLabelValues(svc).Inc()
+			return nil, err
+		}
+		open := cm.open.WithLabelValues(svc)
+		open.Inc()
+		mc := &meteredConn{
+			Conn:  conn,
+			open:  open,
+			idle:  cm.idle.WithLabelValues(svc),
+			conns: &cm.conns,
+		}
+		cm.conns.Store(connKey(mc), mc)
+		return mc, nil
+	}
+}
+
+type transportMetrics struct {
+	p        *prometheusMetricsProvider
+	conns    *connectionMetrics
+	inFlight *prometheus.GaugeVec
+	counter  *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	next     http.RoundTripper
+}
+
+// clientTrace records the connection metrics for a single request.
+func (m *transportMetrics) clientTrace(svc string) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart time.Time
+	var conn *meteredConn
+
+	since := func(start *time.Time) float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return time.Since(*start).Seconds()
+	}
+	now := func(start *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*start = time.Now()
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { now(&dnsStart) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			m.conns.dnsDuration.WithLabelValues(svc).Observe(since(&dnsStart))
+		},
+		ConnectStart: func(string, string) { now(&connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				m.conns.connectDuration.WithLabelValues(svc).Observe(since(&connectStart))
+			}
+		},
+		TLSHandshakeStart: func() { now(&tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				m.conns.tlsDuration.WithLabelValues(svc).Observe(since(&tlsStart))
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			m.conns.connections.WithLabelValues(svc, strconv.FormatBool(info.Reused)).Inc()
+			mc := m.conns.meteredConn(info.Conn)
+			if mc == nil {
+				return
+			}
+			mc.setIdle(false)
+			mu.Lock()
+			conn = mc
+			mu.Unlock()
+		},
+		PutIdleConn: func(err error) {
+			mu.Lock()
+			mc := conn
+			mu.Unlock()
+			if err == nil && mc != nil {
+				mc.setIdle(true)
+			}
+		},
+	}
+}
+
+func (m *transportMetrics) RoundTrip(r *http.Request) (*http.Response, error) {
+	labels := getRequestState(r).metricLabels()
+
+	inFlight := m.inFlight.WithLabelValues(m.p.proxyLabelValues(labels)...)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), m.clientTrace(labels.service)))
+
+	start := time.Now()
+	resp, err := m.next.RoundTrip(r)
+	code := "error"
+	if err == nil {
+		code = codeClass(resp.StatusCode)
+	}
+
+	vals := m.p.proxyLabelValues(labels, code)
+	exemplar := exemplarLabels(r.Context())
+	inc(m.counter.WithLabelValues(vals...), exemplar)
+	observe(m.duration.WithLabelValues(vals...), time.Since(start).Seconds(), exemplar)
+
+	return resp, err
+}
+
 func (p *prometheusMetricsProvider) NewHTTPTransportMetrics(upstream http.RoundTripper) http.RoundTripper {
-	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+	inFlightGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "http_client_inflight_requests",
-		Help: "A gauge of in-flight requests for the wrapped client.",
-	})
+		Help: "A gauge of in-flight requests to backends.",
+	}, p.proxyLabels)
 
-	tlsLatencyVec := prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_client_tls_duration_seconds",
-			Help:    "Trace tls latency histogram.",
-			Buckets: []float64{.05, .1, .25, .5},
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_requests_total",
+			Help: "A counter of requests to backends.",
 		},
-		[]string{"event"},
+		p.proxyLabelNames("code"),
 	)
 
 	histVec := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "http_client_request_duration_seconds",
-			Help:    "A histogram of request latencies.",
+			Help:    "A histogram of backend latencies, until the response headers arrive.",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"code"},
+		p.proxyLabelNames("code"),
 	)
 
-	p.registry.MustRegister(tlsLatencyVec, histVec, inFlightGauge)
+	p.registry.MustRegister(counter, histVec, inFlightGauge)
 
-	trace := &promhttp.InstrumentTrace{
-		TLSHandshakeStart: func(t float64) {
-			tlsLatencyVec.WithLabelValues("tls_handshake_start")
-		},
-		TLSHandshakeDone: func(t float64) {
-			tlsLatencyVec.WithLabelValues("tls_handshake_done")
-		},
+	return &transportMetrics{
+		p:        p,
+		conns:    p.connectionMetrics(),
+		inFlight: inFlightGauge,
+		counter:  counter,
+		duration: histVec,
+		next:     upstream,
 	}
+}
 
-	// Wrap the default RoundTripper with middleware.
-	roundTripper := promhttp.InstrumentRoundTripperInFlight(inFlightGauge,
-		promhttp.InstrumentRoundTripperTrace(trace,
-			promhttp.InstrumentRoundTripperDuration(histVec, upstream),
-		),
-	)
-
-	return roundTripper
+func (p *prometheusMetricsProvider) NewTLSServerMetrics(cfg *tls.Config) *tls.Config {
+	handshakes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tls_server_handshakes_total",
+		Help: "Completed inbound TLS handshakes, by negotiated version, cipher suite and ALPN protocol.",
+	}, []string{"version", "cipher", "alpn"})
+
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tls_server_handshake_duration_seconds",
+		Help:    "A histogram of inbound TLS handshake latencies, from receiving the ClientHello.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"version"})
+
+	p.registry.MustRegister(handshakes, duration)
+
+	base := cfg.Clone()
+	getConfig := cfg.GetConfigForClient
+	verify := cfg.VerifyConnection
+
+	instrumented := cfg.Clone()
+	instrumented.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		start := time.Now()
+
+		conf := base
+		if getConfig != nil {
+			c, err := getConfig(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				conf = c
+			}
+		}
+
+		// Each handshake gets its own config, so that we can time it.
+		conf = conf.Clone()
+		conf.GetConfigForClient = nil
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			version := tlsVersionName(cs.Version)
+			alpn := cs.NegotiatedProtocol
+			if alpn == "" {
+				alpn = "none"
+			}
+			handshakes.WithLabelValues(version, tls.CipherSuiteName(cs.CipherSuite), alpn).Inc()
+			duration.WithLabelValues(version).Observe(time.Since(start).Seconds())
+			return nil
+		}
+		return conf, nil
+	}
+	return instrumented
 }
 
 func (p *prometheusMetricsProvider) NewHTTPServerMetrics(upstream http.Handler) http.Handler {
-	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+	inFlightGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "http_server_inflight_requests",
-		Help: "A gauge of requests currently being served by the wrapped handler.",
-	})
+		Help: "A gauge of requests currently being proxied, counted once they have been routed.",
+	}, p.proxyLabels)
 
 	counter := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_server_requests_total",
 			Help: "A counter for requests to the wrapped handler.",
 		},
-		[]string{"code"},
+		p.proxyLabelNames("code"),
 	)
 
 	histogramOpts := prometheus.HistogramOpts{
@@ -334,19 +908,36 @@ func (p *prometheusMetricsProvider) NewHTTPServerMetrics(upstream http.Handler)
 
 	reqDurVec := prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		p.proxyLabelNames("code"),
 	)
 
 	// Register all of the metrics in the standard registry.
 	p.registry.MustRegister(inFlightGauge, counter, reqDurVec)
 
-	chain := promhttp.InstrumentHandlerInFlight(inFlightGauge,
-		promhttp.InstrumentHandlerCounter(counter,
-			promhttp.InstrumentHandlerDuration(reqDurVec,
-				upstream,
-			),
-		),
-	)
-
-	return chain
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st, r := requestStateFor(r)
+
+		var inFlight prometheus.Gauge
+		st.routed = func() {
+			inFlight = inFlightGauge.WithLabelValues(p.proxyLabelValues(st.metricLabels())...)
+			inFlight.Inc()
+		}
+
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		upstream.ServeHTTP(rec, r)
+
+		if inFlight != nil {
+			inFlight.Dec()
+		}
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		vals := p.proxyLabelValues(st.metricLabels(), codeClass(status))
+		exemplar := exemplarLabels(r.Context())
+		inc(counter.WithLabelValues(vals...), exemplar)
+		observe(reqDurVec.WithLabelValues(vals...), time.Since(start).Seconds(), exemplar)
+	})
 }
@@ -0,0 +1,360 @@
+package minke
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/sdk/export/trace/tracetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	l := &labelLimiter{max: 2, seen: map[proxyLabels]struct{}{}}
+	a := proxyLabels{ingress: "default/a", host: "a", service: "default/a"}
+	b := proxyLabels{ingress: "default/b", host: "b", service: "default/b"}
+	c := proxyLabels{ingress: "default/c", host: "c", service: "default/c"}
+
+	for _, pl := range []proxyLabels{a, b, a} {
+		if got := l.limit(pl); got != pl {
+			t.Fatalf("expected %v, got %v", pl, got)
+		}
+	}
+	if got := l.limit(c); got != otherLabels {
+		t.Fatalf("expected %v once the limit is reached, got %v", otherLabels, got)
+	}
+}
+
+func TestProxyMetricLabels(t *testing.T) {
+	if _, err := NewPrometheusMetrics(prometheus.NewRegistry(), ProxyMetricLabels("ingress", "pod")); err == nil {
+		t.Fatalf("expected error for unknown label")
+	}
+
+	p, err := NewPrometheusMetrics(prometheus.NewRegistry(), ProxyMetricLabels("service", ""))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	vals := p.proxyLabelValues(proxyLabels{ingress: "default/a", host: "a", service: "default/app"}, "2xx")
+	if len(vals) != 2 || vals[0] != "default/app" || vals[1] != "2xx" {
+		t.Fatalf("unexpected label values %q", vals)
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "measured",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "app",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		},
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "http", Port: int32(port)}},
+				},
+			},
+		},
+	)
+
+	reg := prometheus.NewRegistry()
+	mp, err := NewPrometheusMetrics(reg)
+	if err != nil {
+		t.Fatalf("error creating metrics, err = %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(tracetest.NewInMemoryExporter()))
+
+	ctrl, err := New(clientset, WithMetricsProvider(mp), WithTracer(tp.Tracer("minke")))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	req, _ := http.NewRequest("GET", pts.URL+"/hello", nil)
+	req.Host = "blah"
+	resp, err := pts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics failed, %v", err)
+	}
+
+	expLabels := map[string]string{
+		"ingress": "default/measured",
+		"host":    "blah",
+		"service": "default/app",
+		"code":    "4xx",
+	}
+
+	for _, name := range []string{"http_server_requests_total", "http_client_requests_total"} {
+		t.Run(name, func(t *testing.T) {
+			for _, mf := range mfs {
+				if mf.GetName() != name {
+					continue
+				}
+				if len(mf.Metric) != 1 {
+					t.Fatalf("expected 1 series, got %d", len(mf.Metric))
+				}
+				m := mf.Metric[0]
+				for _, lp := range m.Label {
+					if exp := expLabels[lp.GetName()]; lp.GetValue() != exp {
+						t.Errorf("expected label %s=%q, got %q", lp.GetName(), exp, lp.GetValue())
+					}
+				}
+				if len(m.Label) != len(expLabels) {
+					t.Errorf("expected %d labels, got %d", len(expLabels), len(m.Label))
+				}
+				if m.Counter.GetValue() != 1 {
+					t.Errorf("expected count of 1, got %v", m.Counter.GetValue())
+				}
+				ex := m.Counter.GetExemplar()
+				if ex == nil || len(ex.Label) != 1 || ex.Label[0].GetName() != "trace_id" {
+					t.Errorf("expected a trace_id exemplar, got %v", ex)
+				}
+				return
+			}
+			t.Fatalf("metric not found")
+		})
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	reg := prometheus.NewRegistry()
+	mp, err := NewPrometheusMetrics(reg)
+	if err != nil {
+		t.Fatalf("error creating metrics, err = %v", err)
+	}
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	transport.DialContext = mp.NewHTTPDialMetrics((&net.Dialer{}).DialContext)
+	rt := mp.NewHTTPTransportMetrics(transport)
+
+	st := &requestState{backend: serviceKey{namespace: "default", name: "app"}}
+	ctx := context.WithValue(context.Background(), requestStateKey{}, st)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequestWithContext(ctx, "GET", backend.URL, nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// connections are returned to the pool asynchronously
+	time.Sleep(100 * time.Millisecond)
+
+	svc := map[string]string{"service": "default/app"}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		exp    float64
+	}{
+		{"http_client_connections_total", map[string]string{"service": "default/app", "reused": "false"}, 1},
+		{"http_client_connections_total", map[string]string{"service": "default/app", "reused": "true"}, 1},
+		{"http_client_open_connections", svc, 1},
+		{"http_client_idle_connections", svc, 1},
+		{"http_client_connect_duration_seconds", svc, 1},
+	}
+	for _, tt := range tests {
+		if got := gatherValue(t, reg, tt.name, tt.labels); got != tt.exp {
+			t.Errorf("expected %s%v to be %v, got %v", tt.name, tt.labels, tt.exp, got)
+		}
+	}
+
+	transport.CloseIdleConnections()
+	time.Sleep(100 * time.Millisecond)
+	if got := gatherValue(t, reg, "http_client_open_connections", svc); got != 0 {
+		t.Errorf("expected no open connections after closing idle connections, got %v", got)
+	}
+
+	// connections are found again under the transport's TLS wrapping
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer tlsBackend.Close()
+	tlsSt := &requestState{backend: serviceKey{namespace: "default", name: "secure"}}
+	tlsCtx := context.WithValue(context.Background(), requestStateKey{}, tlsSt)
+	req, _ := http.NewRequestWithContext(tlsCtx, "GET", tlsBackend.URL, nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	secure := map[string]string{"service": "default/secure"}
+	if got := gatherValue(t, reg, "http_client_idle_connections", secure); got != 1 {
+		t.Errorf("expected 1 idle TLS connection, got %v", got)
+	}
+	transport.CloseIdleConnections()
+	time.Sleep(100 * time.Millisecond)
+	if got := gatherValue(t, reg, "http_client_open_connections", secure); got != 0 {
+		t.Errorf("expected no open TLS connections after closing idle connections, got %v", got)
+	}
+
+	// dial errors
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	req, _ = http.NewRequestWithContext(ctx, "GET", "http://"+addr, nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if got := gatherValue(t, reg, "http_client_dial_errors_total", svc); got != 1 {
+		t.Errorf("expected 1 dial error, got %v", got)
+	}
+}
+
+func TestTLSServerMetrics(t *testing.T) {
+	// borrow the test certificate
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+
+	reg := prometheus.NewRegistry()
+	mp, err := NewPrometheusMetrics(reg)
+	if err != nil {
+		t.Fatalf("error creating metrics, err = %v", err)
+	}
+
+	cfg := mp.NewTLSServerMetrics(&tls.Config{
+		Certificates: certSrv.TLS.Certificates,
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+		MinVersion:         tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatalf("handshake failed, %v", err)
+	}
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	labels := map[string]string{
+		"version": "TLSv1.3",
+		"cipher":  tls.CipherSuiteName(conn.ConnectionState().CipherSuite),
+		"alpn":    "h2",
+	}
+	if got := gatherValue(t, reg, "tls_server_handshakes_total", labels); got != 1 {
+		t.Errorf("expected 1 handshake, got %v", got)
+	}
+	if got := gatherValue(t, reg, "tls_server_handshake_duration_seconds", map[string]string{"version": "TLSv1.3"}); got != 1 {
+		t.Errorf("expected 1 handshake duration, got %v", got)
+	}
+}
+
+// gatherValue returns the value of a counter or gauge, or the sample count
+// of a histogram, with the given labels.
+func gatherValue(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics failed, %v", err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if labels[lp.GetName()] != lp.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Counter != nil:
+				return m.Counter.GetValue()
+			case m.Gauge != nil:
+				return m.Gauge.GetValue()
+			case m.Histogram != nil:
+				return float64(m.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,337 @@
+package minke
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+// annMirror sends a copy of the requests matching the rules of an Ingress
+// to a shadow service, the responses are discarded. The value is a JSON
+// object, for example:
+//
+//	{"service": "app-v2", "port": "http", "percent": 10, "maxBodyBytes": 65536}
+//
+// The port defaults to that of the rule's backend, percent defaults to 100,
+// and maxBodyBytes to 64KiB. Requests with larger bodies are not mirrored.
+var annMirror = annPrefix + "mirror"
+
+const (
+	defaultMirrorMaxBody = 64 * 1024
+
+	// mirrorMaxInFlight limits the number of mirrored requests
+	// outstanding at once, further requests are dropped.
+	mirrorMaxInFlight = 100
+	mirrorTimeout     = 30 * time.Second
+)
+
+// Results of mirrored requests, reported to the MirrorMetric.
+const (
+	mirrorSuccess = "success"
+	mirrorFailure = "failure"
+	mirrorDropped = "dropped"
+	mirrorTooBig  = "body_too_large"
+
+	// mirrorIncomplete counts requests whose body was not read to the
+	// end, because the primary replied early or the client went away.
+	mirrorIncomplete = "incomplete"
+)
+
+type mirrorTarget struct {
+	service string
+	port    string
+	percent int
+	maxBody int64
+}
+
+func (mt *mirrorTarget) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"service":      mt.service,
+		"port":         mt.port,
+		"percent":      mt.percent,
+		"maxBodyBytes": mt.maxBody,
+	})
+}
+
+type mirrorTargetJSON struct {
+	Service      string `json:"service"`
+	Port         string `json:"port"`
+	Percent      *int   `json:"percent"`
+	MaxBodyBytes *int64 `json:"maxBodyBytes"`
+}
+
+// parseMirrorTarget parses the value of the mirror annotation.
+func parseMirrorTarget(str string) (*mirrorTarget, error) {
+	var in mirrorTargetJSON
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, fmt.Errorf("invalid mirror, %w", err)
+	}
+	if in.Service == "" {
+		return nil, fmt.Errorf("invalid mirror, no service given")
+	}
+
+	mt := &mirrorTarget{
+		service: in.Service,
+		port:    in.Port,
+		percent: 100,
+		maxBody: defaultMirrorMaxBody,
+	}
+	if in.Percent != nil {
+		if *in.Percent < 0 || *in.Percent > 100 {
+			return nil, fmt.Errorf("invalid mirror, percent should be between 0 and 100")
+		}
+		mt.percent = *in.Percent
+	}
+	if in.MaxBodyBytes != nil {
+		if *in.MaxBodyBytes < 0 {
+			return nil, fmt.Errorf("invalid mirror, maxBodyBytes should not be negative")
+		}
+		mt.maxBody = *in.MaxBodyBytes
+	}
+
+	return mt, nil
+}
+
+func (mt *mirrorTarget) backend(primary serviceKey) serviceKey {
+	key := serviceKey{
+		namespace: primary.namespace,
+		name:      mt.service,
+		portName:  mt.port,
+	}
+	if key.portName == "" {
+		key.portName = primary.portName
+	}
+	return key
+}
+
+func (mt *mirrorTarget) sample() bool {
+	return mt.percent >= 100 || rand.Intn(100) < mt.percent
+}
+
+// mirrorBody copies the body of the request as the primary backend reads
+// it. The mirrored request is only sent once the whole body has been
+// read, so that the primary is never held up.
+//
+// The transport may close the body while it is still being read, if the
+// backend replies early, so the copy is guarded by mu. If the body is
+// closed or fails before it has all been read, the copy is counted as
+// incomplete.
+type mirrorBody struct {
+	io.ReadCloser
+	max  int64
+	size int64 // expected size, or -1 if unknown
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	read    int64
+	reading bool // a Read is in progress
+
+	once       sync.Once
+	send       func(body []byte)
+	tooBig     func()
+	incomplete func()
+}
+
+func (mb *mirrorBody) Read(p []byte) (int, error) {
+	mb.mu.Lock()
+	mb.reading = true
+	mb.mu.Unlock()
+
+	n, err := mb.ReadCloser.Read(p)
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.reading = false
+	if n > 0 {
+		mb.read += int64(n)
+		if mb.read <= mb.max {
+			mb.buf.Write(p[:n])
+		}
+	}
+	switch {
+	case err == io.EOF || (mb.size >= 0 && mb.read == mb.size):
+		mb.finish()
+	case err != nil:
+		mb.abandon()
+	}
+	return n, err
+}
+
+func (mb *mirrorBody) Close() error {
+	err := mb.ReadCloser.Close()
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	switch {
+	case mb.size >= 0 && mb.read == mb.size:
+		mb.finish()
+	case !mb.reading:
+		// A Read in progress will finish or abandon the copy
+		// when it returns.
+		mb.abandon()
+	}
+	return err
+}
+
+// finish sends the copy, it must be called with mu held.
+func (mb *mirrorBody) finish() {
+	mb.once.Do(func() {
+		if mb.read > mb.max {
+			mb.tooBig()
+			return
+		}
+		mb.send(mb.buf.Bytes())
+	})
+}
+
+// abandon counts the copy as incomplete, unless it has already been sent,
+// it must be called with mu held.
+func (mb *mirrorBody) abandon() {
+	mb.once.Do(mb.incomplete)
+}
+
+func (c *Controller) countMirror(ingress, result string) {
+	if c.mirrorMetric == nil {
+		return
+	}
+	c.mirrorMetric.Inc(ingress, result)
+}
+
+// mirror arranges for a copy of the outbound request to be sent to the
+// mirror target of the matched rule, if there is one.
+func (c *Controller) mirror(st *requestState, req *http.Request) {
+	if st.rule == nil || st.rule.mirror == nil {
+		return
+	}
+	mt := st.rule.mirror
+	if !mt.sample() {
+		return
+	}
+	if req.Header.Get("Upgrade") != "" {
+		// we cannot mirror a connection
+		return
+	}
+
+	ingress := st.ingress.namespace + "/" + st.ingress.name
+
+	// the primary request will be modified further by the proxy, so
+	// we take our copy now. It keeps the trace, but must outlive the
+	// primary request.
+	mctx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(req.Context()))
+	mreq := req.Clone(mctx)
+	removeHopHeaders(mreq.Header)
+	key := mt.backend(st.rule.backend)
+
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		c.sendMirror(ingress, key, mreq, nil)
+		return
+	}
+
+	if req.ContentLength > mt.maxBody {
+		c.countMirror(ingress, mirrorTooBig)
+		return
+	}
+
+	req.Body = &mirrorBody{
+		ReadCloser: req.Body,
+		max:        mt.maxBody,
+		size:       req.ContentLength,
+		send:       func(body []byte) { c.sendMirror(ingress, key, mreq, body) },
+		tooBig:     func() { c.countMirror(ingress, mirrorTooBig) },
+		incomplete: func() { c.countMirror(ingress, mirrorIncomplete) },
+	}
+}
+
+// sendMirror sends the mirrored request in the background, if we already
+// have too many mirrored requests outstanding it is dropped.
+func (c *Controller) sendMirror(ingress string, key serviceKey, req *http.Request, body []byte) {
+	select {
+	case c.mirrorSem <- struct{}{}:
+	default:
+		c.countMirror(ingress, mirrorDropped)
+		return
+	}
+
+	go func() {
+		defer func() { <-c.mirrorSem }()
+
+		key := c.svc.resolvePort(key)
+		svcSpec, _ := c.svc.getBalancer(key)
+		spec := balancerSpec{}.withDefaults(svcSpec, c.zone)
+		ep, done := c.eps.pick(key, spec, req)
+		defer done()
+		if ep.addr == "" {
+			klog.V(2).Infof("no endpoints for mirror %v", key)
+			c.countMirror(ingress, mirrorFailure)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), mirrorTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+		req.URL.Host = net.JoinHostPort(ep.addr, strconv.Itoa(ep.port))
+		req.URL.Scheme = c.svc.getServicePortScheme(key)
+		req.ContentLength = int64(len(body))
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if len(body) == 0 {
+			req.Body = http.NoBody
+		}
+
+		resp, err := c.transport.RoundTrip(req)
+		if err != nil {
+			klog.V(2).Infof("mirror to %v failed, %v", key, err)
+			c.countMirror(ingress, mirrorFailure)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			c.countMirror(ingress, mirrorFailure)
+			return
+		}
+		c.countMirror(ingress, mirrorSuccess)
+	}()
+}
+
+// hopHeaders are removed from mirrored requests, as the ReverseProxy
+// does for proxied requests.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = strings.TrimSpace(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	for _, hh := range hopHeaders {
+		h.Del(hh)
+	}
+}
@@ -0,0 +1,403 @@
+package minke
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseMirrorTarget(t *testing.T) {
+	tests := []struct {
+		str    string
+		expErr bool
+	}{
+		{str: `{"service": "shadow"}`},
+		{str: `{"service": "shadow", "port": "http", "percent": 5, "maxBodyBytes": 0}`},
+		{str: `{"port": "http"}`, expErr: true},
+		{str: `{"service": "shadow", "percent": 101}`, expErr: true},
+		{str: `{"service": "shadow", "maxBodyBytes": -1}`, expErr: true},
+		{str: `{"service": "shadow", "sample": 1}`, expErr: true},
+	}
+
+	for _, st := range tests {
+		if _, err := parseMirrorTarget(st.str); (err != nil) != st.expErr {
+			t.Errorf("%s: unexpected error state, %v", st.str, err)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("OK"))
+	}))
+	defer primary.Close()
+
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		// a slow shadow should not hold up the primary
+		time.Sleep(500 * time.Millisecond)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	svc := func(name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		}
+	}
+	eps := func(name, rawurl string) *corev1.Endpoints {
+		u, _ := url.Parse(rawurl)
+		port, _ := strconv.Atoi(u.Port())
+		return &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "http", Port: int32(port)}},
+				},
+			},
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+					annMirror:                            `{"service": "shadow", "maxBodyBytes": 10}`,
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "primary",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		svc("primary"),
+		svc("shadow"),
+		eps("primary", primary.URL),
+		eps("shadow", shadow.URL),
+	)
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	post := func(body string) {
+		req, _ := http.NewRequest("POST", pts.URL+"/hello", strings.NewReader(body))
+		req.Host = "blah"
+		start := time.Now()
+		resp, err := pts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %v", resp.StatusCode)
+		}
+		if d := time.Since(start); d > 400*time.Millisecond {
+			t.Fatalf("primary request was held up by the mirror, took %v", d)
+		}
+	}
+
+	post("hello")
+	select {
+	case got := <-mirrored:
+		if exp := "POST /hello hello"; got != exp {
+			t.Fatalf("expected mirrored request %q, got %q", exp, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("request was not mirrored")
+	}
+
+	// bodies over the limit are not mirrored
+	post("this body is too long")
+	select {
+	case got := <-mirrored:
+		t.Fatalf("did not expect a mirrored request, got %q", got)
+	case <-time.After(1 * time.Second):
+	}
+}
+
+func TestMirror_earlyReply(t *testing.T) {
+	// the primary replies without reading the body, it is too big for
+	// the server to discard, so the transport may close the body while
+	// it is still copying it.
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer primary.Close()
+
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- string(body)
+	}))
+	defer shadow.Close()
+
+	svc := func(name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		}
+	}
+	eps := func(name, rawurl string) *corev1.Endpoints {
+		u, _ := url.Parse(rawurl)
+		port, _ := strconv.Atoi(u.Port())
+		return &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "http", Port: int32(port)}},
+				},
+			},
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+					annMirror:                            `{"service": "shadow", "maxBodyBytes": 1048576}`,
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "primary",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		svc("primary"),
+		svc("shadow"),
+		eps("primary", primary.URL),
+		eps("shadow", shadow.URL),
+	)
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	for i := 0; i < 10; i++ {
+		// the rest of the body is only sent once the primary has
+		// replied
+		body := &stallingBody{first: 1024, rest: 512 * 1024, wait: make(chan struct{})}
+		req, _ := http.NewRequest("POST", pts.URL+"/hello", body)
+		req.Host = "blah"
+		req.ContentLength = 1024 + 512*1024
+		time.AfterFunc(100*time.Millisecond, func() { close(body.wait) })
+
+		resp, err := pts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %v", resp.StatusCode)
+		}
+	}
+
+	// only whole bodies are mirrored
+	select {
+	case got := <-mirrored:
+		if len(got) != 1024+512*1024 {
+			t.Fatalf("expected a whole body to be mirrored, got %d bytes", len(got))
+		}
+	case <-time.After(1 * time.Second):
+	}
+}
+
+// stallingBody returns first bytes, then waits for wait to be closed
+// before returning the rest. If stalled is set it is closed once the
+// body starts waiting.
+type stallingBody struct {
+	first, rest int
+	wait        chan struct{}
+	stalled     chan struct{}
+}
+
+func (sb *stallingBody) Read(p []byte) (int, error) {
+	if sb.first == 0 {
+		if sb.stalled != nil {
+			close(sb.stalled)
+			sb.stalled = nil
+		}
+		<-sb.wait
+		if sb.rest == 0 {
+			return 0, io.EOF
+		}
+		sb.first, sb.rest = sb.rest, 0
+	}
+	n := len(p)
+	if n > sb.first {
+		n = sb.first
+	}
+	sb.first -= n
+	return n, nil
+}
+
+func TestMirrorBody_closeWhileReading(t *testing.T) {
+	// older transports close the body from the round trip while the
+	// write loop is still reading it, if the backend replies early.
+	sent := make(chan []byte, 1)
+	stalled := make(chan struct{})
+	body := &stallingBody{first: 1024, rest: 1024, wait: make(chan struct{}), stalled: stalled}
+	mb := &mirrorBody{
+		ReadCloser: ioutil.NopCloser(body),
+		max:        defaultMirrorMaxBody,
+		size:       2 * 1024,
+		send:       func(b []byte) { sent <- b },
+		tooBig:     func() {},
+		incomplete: func() { t.Errorf("body counted as incomplete") },
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ioutil.ReadAll(mb)
+	}()
+
+	<-stalled
+	time.AfterFunc(100*time.Millisecond, func() { close(body.wait) })
+	mb.Close()
+	<-done
+
+	select {
+	case b := <-sent:
+		if len(b) != 2*1024 {
+			t.Fatalf("expected the whole body to be mirrored, got %d bytes", len(b))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("body was not mirrored")
+	}
+}
+
+func TestMirrorBody_incomplete(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		read int  // bytes read before closing
+		err  bool // the read fails
+		exp  string
+	}{
+		{name: "whole body", size: 10, read: 10, exp: "sent"},
+		{name: "whole chunked body", size: -1, read: 10, exp: "sent"},
+		{name: "closed early", size: 10, read: 5, exp: "incomplete"},
+		{name: "chunked closed early", size: -1, read: 5, exp: "incomplete"},
+		{name: "closed unread", size: -1, read: 0, exp: "incomplete"},
+		{name: "read failed", size: -1, read: 5, err: true, exp: "incomplete"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			var r io.Reader = strings.NewReader("0123456789")
+			if tt.err {
+				r = io.MultiReader(r, failingReader{})
+			}
+			mb := &mirrorBody{
+				ReadCloser: ioutil.NopCloser(r),
+				max:        defaultMirrorMaxBody,
+				size:       tt.size,
+				send:       func([]byte) { got = append(got, "sent") },
+				tooBig:     func() { got = append(got, "too big") },
+				incomplete: func() { got = append(got, "incomplete") },
+			}
+
+			if tt.err || tt.read == 10 {
+				// a chunked body is only known to be complete at EOF
+				ioutil.ReadAll(mb)
+			} else {
+				io.ReadFull(mb, make([]byte, tt.read))
+			}
+			mb.Close()
+
+			if len(got) != 1 || got[0] != tt.exp {
+				t.Fatalf("expected %s, got %v", tt.exp, got)
+			}
+		})
+	}
+}
+
+// failingReader fails every read, as a body does if the client goes away.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("client went away")
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/tools/cache"
@@ -113,6 +114,19 @@ func (p *processor) processItem(key string) error {
 		return fmt.Errorf("failed calling the API, %w", err)
 	}
 	if !exists {
+		// The object is gone from the cache, so we give the updater
+		// an empty object carrying just the name and namespace.
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err != nil {
+			return err
+		}
+		obj := p.objType.DeepCopyObject()
+		m, err := meta.Accessor(obj)
+		if err != nil {
+			return err
+		}
+		m.SetNamespace(namespace)
+		m.SetName(name)
 		return p.delItem(obj)
 	}
 	return p.addItem(obj)
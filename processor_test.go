@@ -0,0 +1,43 @@
+package minke
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+type recordingUpdater struct {
+	added, deleted []interface{}
+}
+
+func (u *recordingUpdater) addItem(obj interface{}) error {
+	u.added = append(u.added, obj)
+	return nil
+}
+
+func (u *recordingUpdater) delItem(obj interface{}) error {
+	u.deleted = append(u.deleted, obj)
+	return nil
+}
+
+func TestProcessor_deleted(t *testing.T) {
+	upd := &recordingUpdater{}
+	p := makeProcessor(&cache.ListWatch{}, &corev1.Service{}, 0, upd)
+
+	// the key is not in the cache, as once the object has been deleted
+	if err := p.processItem("default/gone"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if len(upd.added) != 0 || len(upd.deleted) != 1 {
+		t.Fatalf("expected one deletion, got added %v, deleted %v", upd.added, upd.deleted)
+	}
+	svc, ok := upd.deleted[0].(*corev1.Service)
+	if !ok {
+		t.Fatalf("expected a *corev1.Service to be deleted, got %T", upd.deleted[0])
+	}
+	if svc.Namespace != "default" || svc.Name != "gone" {
+		t.Fatalf("expected default/gone to be deleted, got %s/%s", svc.Namespace, svc.Name)
+	}
+}
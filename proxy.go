@@ -1,27 +1,153 @@
 package minke
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"strconv"
+	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 )
 
 type httpError struct {
 	status     int
 	logMessage string
+	message    string // optional body to send to the client
 }
 
-type httpRedirect struct {
-	destination string
+// requestState records how a request was routed, it is created by the
+// handler and filled in by the director.
+type requestState struct {
+	ingress *ingress
+	rule    *ingressRule
+	backend serviceKey
+	variant string // the traffic split variant, if any
+
+	clientIP       string // resolved from trusted forwarding headers
+	peerTrusted    bool
+	forwardedProto string
+	forwardedHost  string
+	proxy          *ProxyHeader      // from the PROXY protocol, if used
+	clientCert     *x509.Certificate // verified client certificate, if any
+
+	endpoint serviceAddr
+	done     func()
+	cookies  []*http.Cookie // to be set on the response
+
+	upstreamStart    time.Time
+	upstreamDuration time.Duration // until the response headers arrived
+
+	routed func() // called once the request has been routed, if set
+}
+
+type requestStateKey struct{}
+
+// requestStateFor returns the state of the request, adding new state to
+// the request's context if it does not have any yet.
+func requestStateFor(r *http.Request) (*requestState, *http.Request) {
+	if st, ok := r.Context().Value(requestStateKey{}).(*requestState); ok {
+		return st, r
+	}
+	st := &requestState{}
+	return st, r.WithContext(context.WithValue(r.Context(), requestStateKey{}, st))
+}
+
+// metricLabels gives the labels used for the request in proxy metrics.
+func (st *requestState) metricLabels() proxyLabels {
+	var pl proxyLabels
+	if st.ingress != nil {
+		pl.ingress = st.ingress.namespace + "/" + st.ingress.name
+	}
+	if st.rule != nil {
+		pl.host = st.rule.host
+	}
+	if st.backend.name != "" {
+		pl.service = st.backend.namespace + "/" + st.backend.name
+	}
+	return pl
+}
+
+func getRequestState(r *http.Request) *requestState {
+	st, _ := r.Context().Value(requestStateKey{}).(*requestState)
+	if st == nil {
+		return &requestState{}
+	}
+	return st
+}
+
+// responseRecorder records the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes on to the underlying writer, so that streamed
+// responses are not held up.
+func (w *responseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows protocol upgrades, such as websockets, to take over the
+// underlying connection.
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// CloseNotify is used by the ReverseProxy of older Go releases to cancel
+// backend requests when the client goes away.
+func (w *responseRecorder) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	// never fires
+	return nil
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (c *Controller) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	st := getRequestState(r)
+	if !st.upstreamStart.IsZero() {
+		st.upstreamDuration = time.Since(st.upstreamStart)
+	}
+
 	if errors.Is(err, context.Canceled) {
 		klog.Infof("client cancelled: %#v", err)
 		return
@@ -31,15 +157,57 @@ func (c *Controller) errorHandler(w http.ResponseWriter, r *http.Request, err er
 	w.WriteHeader(http.StatusBadGateway)
 }
 
+func (c *Controller) modifyResponse(resp *http.Response) error {
+	st := getRequestState(resp.Request)
+	st.upstreamDuration = time.Since(st.upstreamStart)
+	c.applyResponseHeaders(st, resp)
+	for _, cookie := range st.cookies {
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+	return nil
+}
+
 func (c *Controller) handler(w http.ResponseWriter, req *http.Request) {
+	st, req := requestStateFor(req)
+	st.proxy = ProxyHeaderFromContext(req.Context())
+	c.resolveClient(st, req)
+	defer func() {
+		trace.SpanFromContext(req.Context()).SetAttributes(st.traceAttributes()...)
+	}()
+
+	if c.accessLogFunc != nil {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		w = rec
+		var body *countingBody
+		if req.Body != nil && req.Body != http.NoBody {
+			body = &countingBody{ReadCloser: req.Body}
+			req.Body = body
+		}
+		defer c.logAccess(st, req, rec, body, start)
+	}
+	defer func() {
+		if st.done != nil {
+			st.done()
+		}
+	}()
+
 	defer func() {
 		if err := recover(); err != nil {
 			switch err := err.(type) {
 			case httpRedirect:
-				http.Redirect(w, req, err.destination, http.StatusMovedPermanently)
+				status := err.status
+				if status == 0 {
+					status = http.StatusMovedPermanently
+				}
+				http.Redirect(w, req, err.destination, status)
 				return
 			case httpError:
 				klog.Errorf("proxy: %v", err.logMessage)
+				if err.message != "" {
+					http.Error(w, err.message, err.status)
+					return
+				}
 				w.WriteHeader(err.status)
 				return
 			default:
@@ -50,6 +218,10 @@ func (c *Controller) handler(w http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
+	if c.acme.serveHTTP01(w, req) {
+		return
+	}
+
 	if c.setquicheaders != nil {
 		c.setquicheaders(w.Header())
 	}
@@ -57,38 +229,143 @@ func (c *Controller) handler(w http.ResponseWriter, req *http.Request) {
 }
 
 func (c *Controller) getTarget(req *http.Request) (serviceAddr, string) {
+	st := getRequestState(req)
 	ing, rule := c.ings.matchRule(req)
 	if ing == nil {
-		panic(httpError{status: http.StatusNotFound, logMessage: "no service for thing"})
+		return c.getDefaultTarget(st, req)
 	}
+	st.ingress = ing
+	st.rule = rule
 
-	if ing.httpRedir && req.TLS == nil {
+	if ing.httpRedir && st.scheme(req) != "https" {
 		req.URL.Scheme = "https"
 		req.URL.Host = req.Host
 		panic(httpRedirect{destination: req.URL.String()})
 	}
 
-	port := c.svc.getServicePortScheme(rule.backend)
+	c.redirect(ing, rule, req)
+
+	if rule != nil && rule.resource != nil {
+		panic(httpError{
+			status:     http.StatusBadGateway,
+			logMessage: fmt.Sprintf("resource backend %v is not supported", rule.resource)})
+	}
 
-	ep := c.eps.getNextAddr(rule.backend)
+	backend := ing.defaultBackend
+	split := ing.split
+	if rule != nil {
+		backend = &rule.backend
+		split = rule.split
+	}
+
+	target := *backend
+	if split != nil {
+		var cookie *http.Cookie
+		target, cookie = split.pick(*backend, req)
+		if cookie != nil {
+			st.cookies = append(st.cookies, cookie)
+		}
+		st.variant = target.name
+		if c.splitMetric != nil {
+			c.splitMetric.Inc(ing.namespace+"/"+ing.name, target.name)
+		}
+	}
+
+	ep, scheme := c.getBackendTarget(st, target, ing.balancer, ing.affinity, req)
 	if ep.addr == "" {
 		panic(httpError{
 			status:     http.StatusBadGateway,
-			logMessage: fmt.Sprintf("no active endpoints for %v", rule.backend)})
+			logMessage: fmt.Sprintf("no active endpoints for %v", st.backend)})
+	}
+	return ep, scheme
+}
+
+// getDefaultTarget picks an endpoint of the global default backend, for
+// requests that did not match any ingress.
+func (c *Controller) getDefaultTarget(st *requestState, req *http.Request) (serviceAddr, string) {
+	if c.defaultBackendName == "" {
+		panic(httpError{
+			status:     http.StatusNotFound,
+			logMessage: fmt.Sprintf("no ingress for %s%s", req.Host, req.URL.Path),
+			message:    "no ingress matched the request",
+		})
+	}
+
+	backend := serviceKey{
+		namespace: c.defaultBackendNamespace,
+		name:      c.defaultBackendName,
+		portName:  c.defaultBackendPort,
 	}
-	return ep, port
+
+	ep, scheme := c.getBackendTarget(st, backend, balancerSpec{}, "", req)
+	if ep.addr == "" {
+		panic(httpError{
+			status:     http.StatusServiceUnavailable,
+			logMessage: fmt.Sprintf("no active endpoints for default backend %v", st.backend),
+			message:    "no default backend available",
+		})
+	}
+	return ep, scheme
+}
+
+// getBackendTarget picks an endpoint for the backend, using the given
+// balancer and affinity settings, or those set on the service.
+func (c *Controller) getBackendTarget(st *requestState, backend serviceKey, spec balancerSpec, affinity string, req *http.Request) (serviceAddr, string) {
+	backend = c.svc.resolvePort(backend)
+	st.backend = backend
+	scheme := c.svc.getServicePortScheme(backend)
+
+	svcSpec, svcAffinity := c.svc.getBalancer(backend)
+	spec = spec.withDefaults(svcSpec, c.zone)
+	if affinity == "" {
+		affinity = svcAffinity
+	}
+
+	if affinity != "" {
+		if ep, ok := c.affinityFromCookie(affinity, backend, req); ok {
+			st.endpoint = ep
+			st.done = c.eps.acquire(backend, spec, ep)
+			return ep, scheme
+		}
+	}
+
+	ep, done := c.eps.pick(backend, spec, req)
+	st.endpoint = ep
+	st.done = done
+
+	if affinity != "" && ep.addr != "" {
+		st.cookies = append(st.cookies, c.affinityCookie(affinity, backend, ep, req))
+	}
+
+	return ep, scheme
 }
 
 func (c *Controller) director(req *http.Request) {
 	target, scheme := c.getTarget(req)
 
+	st := getRequestState(req)
+	if st.routed != nil {
+		st.routed()
+	}
+
+	c.verifyClient(st, req)
+
 	req.URL.Host = net.JoinHostPort(target.addr, strconv.Itoa(target.port))
 	req.URL.Scheme = scheme
 
+	c.setForwardedHeaders(st, req)
+	c.setClientCertHeaders(st, req)
+	c.applyRequestHeaders(st, req)
+	c.rewrite(st, req)
+
 	if _, ok := req.Header["User-Agent"]; !ok {
 		// explicitly disable User-Agent so it's not set to default value
 		req.Header.Set("User-Agent", "")
 	}
+
+	c.mirror(st, req)
+
+	st.upstreamStart = time.Now()
 }
 
 // GetCertificate selects a cert from an ingress if one is available.
@@ -97,6 +374,10 @@ func (c *Controller) GetCertificate(info *tls.ClientHelloInfo) (*tls.Certificate
 		return nil, nil
 	}
 
+	if cert, err := c.acme.getChallengeCertificate(info); cert != nil || err != nil {
+		return cert, err
+	}
+
 	return c.certMap.GetCertificate(info)
 }
 
@@ -0,0 +1,385 @@
+package minke
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol TLV types, from the PROXY protocol specification.
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+	ProxyTLVAWS       = 0xEA
+	ProxyTLVAzure     = 0xEE
+
+	proxyAWSVPCEndpointID = 0x01
+	proxyAzurePrivateLink = 0x01
+
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLength   = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyTLV is a type-length-value field from a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader holds the details sent in a PROXY protocol header.
+type ProxyHeader struct {
+	Version     int
+	Source      net.Addr // nil for LOCAL or UNKNOWN connections
+	Destination net.Addr
+	TLVs        []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of type t.
+func (h *ProxyHeader) TLV(t byte) ([]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Authority returns the host name the client connected to, usually the
+// SNI of a TLS connection terminated by the proxy.
+func (h *ProxyHeader) Authority() string {
+	v, _ := h.TLV(ProxyTLVAuthority)
+	return string(v)
+}
+
+// AWSVPCEndpointID returns the ID of the AWS VPC endpoint the connection
+// came through, if any.
+func (h *ProxyHeader) AWSVPCEndpointID() string {
+	v, ok := h.TLV(ProxyTLVAWS)
+	if !ok || len(v) < 1 || v[0] != proxyAWSVPCEndpointID {
+		return ""
+	}
+	return string(v[1:])
+}
+
+// AzurePrivateLinkID returns the LINKID of the Azure private endpoint the
+// connection came through, if any.
+func (h *ProxyHeader) AzurePrivateLinkID() string {
+	v, ok := h.TLV(ProxyTLVAzure)
+	if !ok || len(v) != 5 || v[0] != proxyAzurePrivateLink {
+		return ""
+	}
+	return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(v[1:])), 10)
+}
+
+// ProxyProtocolListener accepts connections that may start with a PROXY
+// protocol header.
+type ProxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocolListener wraps l so that connections from the given
+// CIDRs may start with a PROXY protocol v1 or v2 header. The source address
+// from the header becomes the RemoteAddr of the connection. Connections from
+// other addresses are passed through untouched. The header is read when the
+// connection is first used, so Accept does not block.
+func NewProxyProtocolListener(l net.Listener, cidrs []string) (*ProxyProtocolListener, error) {
+	pl := &ProxyProtocolListener{Listener: l}
+	for _, str := range cidrs {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol source %q, %w", str, err)
+		}
+		pl.trusted = append(pl.trusted, n)
+	}
+	return pl, nil
+}
+
+func (pl *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return c, nil
+	}
+	for _, n := range pl.trusted {
+		if n.Contains(addr.IP) {
+			return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+		}
+	}
+	return c, nil
+}
+
+// proxyConn reads the PROXY protocol header, if there is one, on first use.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+
+	tlsConn     *tls.Conn                 // the TLS connection wrapping us, if any
+	tlsListener *ProxyProtocolTLSListener // the listener tracking tlsConn
+}
+
+func (pc *proxyConn) init() {
+	pc.once.Do(func() {
+		pc.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		pc.header, pc.err = readProxyHeader(pc.r)
+		pc.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.init()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.r.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.init()
+	if pc.header != nil && pc.header.Source != nil {
+		return pc.header.Source
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.init()
+	if pc.header != nil && pc.header.Destination != nil {
+		return pc.header.Destination
+	}
+	return pc.Conn.LocalAddr()
+}
+
+func (pc *proxyConn) Close() error {
+	if pc.tlsConn != nil {
+		pc.tlsListener.conns.Delete(pc.tlsConn)
+	}
+	return pc.Conn.Close()
+}
+
+// ProxyHeader returns the PROXY protocol header read from the connection,
+// or nil if there was none.
+func (pc *proxyConn) ProxyHeader() *ProxyHeader {
+	pc.init()
+	return pc.header
+}
+
+// readProxyHeader reads a PROXY protocol header, if the stream starts with
+// one.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case 'P':
+		if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, nil
+		}
+		return readProxyV1(r)
+	case '\r':
+		if b, err := r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return nil, nil
+		}
+		return readProxyV2(r)
+	default:
+		return nil, nil
+	}
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY v1 header, %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	sport, serr := strconv.ParseUint(fields[4], 10, 16)
+	dport, derr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || serr != nil || derr != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return h, nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header, %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	cmd := hdr[12] & 0x0f
+	fam := hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header, %w", err)
+	}
+
+	h := &ProxyHeader{Version: 2}
+
+	var addrLen int
+	switch fam >> 4 {
+	case 0x1: // IPv4
+		addrLen = 12
+	case 0x2: // IPv6
+		addrLen = 36
+	case 0x3: // unix
+		addrLen = 216
+	}
+	if len(body) < addrLen {
+		return nil, errors.New("PROXY v2 header too short for address")
+	}
+
+	// LOCAL connections are from the proxy itself, and we only know
+	// about stream addresses.
+	if cmd == 0x1 && fam&0x0f == 0x1 {
+		switch fam >> 4 {
+		case 0x1:
+			h.Source = &net.TCPAddr{IP: net.IP(append([]byte{}, body[0:4]...)), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(append([]byte{}, body[4:8]...)), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		case 0x2:
+			h.Source = &net.TCPAddr{IP: net.IP(append([]byte{}, body[0:16]...)), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(append([]byte{}, body[16:32]...)), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		}
+	} else if cmd > 0x1 {
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", cmd)
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, errors.New("truncated PROXY v2 TLV")
+		}
+		l := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+l {
+			return nil, errors.New("truncated PROXY v2 TLV")
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+l]})
+		tlvs = tlvs[3+l:]
+	}
+
+	return h, nil
+}
+
+// ProxyProtocolTLSListener is like the listener from tls.NewListener, but
+// keeps track of the PROXY protocol connections from a
+// ProxyProtocolListener under each TLS connection, so that its ConnContext
+// can find them.
+type ProxyProtocolTLSListener struct {
+	net.Listener
+	config *tls.Config
+
+	conns sync.Map // *tls.Conn to the *proxyConn it wraps
+}
+
+// NewProxyProtocolTLSListener creates a ProxyProtocolTLSListener accepting
+// connections from l.
+func NewProxyProtocolTLSListener(l net.Listener, config *tls.Config) *ProxyProtocolTLSListener {
+	return &ProxyProtocolTLSListener{Listener: l, config: config}
+}
+
+func (pl *ProxyProtocolTLSListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Server(c, pl.config)
+	if pc, ok := c.(*proxyConn); ok {
+		pc.tlsConn = tc
+		pc.tlsListener = pl
+		pl.conns.Store(tc, pc)
+	}
+	return tc, nil
+}
+
+type proxyConnKey struct{}
+
+// ConnContext is intended for use as the ConnContext of an http.Server
+// serving this listener, it makes the PROXY header available to the
+// handlers.
+func (pl *ProxyProtocolListener) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if pc, ok := c.(*proxyConn); ok {
+		return context.WithValue(ctx, proxyConnKey{}, pc)
+	}
+	return ctx
+}
+
+// ConnContext is intended for use as the ConnContext of an http.Server
+// serving this listener, it makes the PROXY header available to the
+// handlers.
+func (pl *ProxyProtocolTLSListener) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	if pc, ok := pl.conns.Load(tc); ok {
+		return context.WithValue(ctx, proxyConnKey{}, pc)
+	}
+	return ctx
+}
+
+// ProxyHeaderFromContext returns the PROXY protocol header of the
+// connection a request arrived on, or nil if there was none.
+func ProxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	pc, ok := ctx.Value(proxyConnKey{}).(*proxyConn)
+	if !ok {
+		return nil
+	}
+	return pc.ProxyHeader()
+}
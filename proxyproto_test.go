@@ -0,0 +1,284 @@
+package minke
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(src, dst *net.TCPAddr, tlvs ...ProxyTLV) []byte {
+	var body bytes.Buffer
+	body.Write(src.IP.To4())
+	body.Write(dst.IP.To4())
+	binary.Write(&body, binary.BigEndian, uint16(src.Port))
+	binary.Write(&body, binary.BigEndian, uint16(dst.Port))
+	for _, tlv := range tlvs {
+		body.WriteByte(tlv.Type)
+		binary.Write(&body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x21) // v2, PROXY
+	buf.WriteByte(0x11) // TCP over IPv4
+	binary.Write(&buf, binary.BigEndian, uint16(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+
+	// a header claiming more TLV data than it holds
+	trunc := proxyV2Header(src, dst, ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("x")})
+	trunc[len(trunc)-2] = 0x05
+
+	tests := []struct {
+		name      string
+		input     []byte
+		expErr    bool
+		expSrc    string
+		expAuth   string
+		expVPCE   string
+		expRemain string
+	}{
+		{
+			name:      "no header",
+			input:     []byte("POST / HTTP/1.1\r\n"),
+			expRemain: "POST / HTTP/1.1\r\n",
+		},
+		{
+			name:      "v1 tcp4",
+			input:     []byte("PROXY TCP4 192.0.2.10 10.0.0.1 51000 443\r\nGET / HTTP/1.1\r\n"),
+			expSrc:    "192.0.2.10:51000",
+			expRemain: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:      "v1 tcp6",
+			input:     []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\nGET"),
+			expSrc:    "[2001:db8::1]:51000",
+			expRemain: "GET",
+		},
+		{
+			name:      "v1 unknown",
+			input:     []byte("PROXY UNKNOWN\r\nGET"),
+			expRemain: "GET",
+		},
+		{
+			name:   "v1 bad port",
+			input:  []byte("PROXY TCP4 192.0.2.10 10.0.0.1 99999 443\r\nGET"),
+			expErr: true,
+		},
+		{
+			name:   "v1 too long",
+			input:  []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+			expErr: true,
+		},
+		{
+			name: "v2 with tlvs",
+			input: append(proxyV2Header(src, dst,
+				ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("www.example.com")},
+				ProxyTLV{Type: ProxyTLVAWS, Value: []byte("\x01vpce-08d2bf15fac5001c9")},
+			), []byte("GET")...),
+			expSrc:    "192.0.2.10:51000",
+			expAuth:   "www.example.com",
+			expVPCE:   "vpce-08d2bf15fac5001c9",
+			expRemain: "GET",
+		},
+		{
+			name:   "v2 truncated tlv",
+			input:  trunc,
+			expErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.input))
+			h, err := readProxyHeader(r)
+			if err != nil {
+				if !tt.expErr {
+					t.Fatalf("unexpected error, %v", err)
+				}
+				return
+			}
+			if tt.expErr {
+				t.Fatalf("expected error")
+			}
+
+			src := ""
+			if h != nil && h.Source != nil {
+				src = h.Source.String()
+			}
+			if src != tt.expSrc {
+				t.Errorf("expected source %q, got %q", tt.expSrc, src)
+			}
+			if got := h.Authority(); got != tt.expAuth {
+				t.Errorf("expected authority %q, got %q", tt.expAuth, got)
+			}
+			if got := h.AWSVPCEndpointID(); got != tt.expVPCE {
+				t.Errorf("expected vpce id %q, got %q", tt.expVPCE, got)
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != tt.expRemain {
+				t.Errorf("expected remaining %q, got %q", tt.expRemain, rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		header  bool
+		expAddr string
+		expAuth string
+	}{
+		{
+			name:    "trusted",
+			cidrs:   []string{"127.0.0.0/8"},
+			header:  true,
+			expAddr: "192.0.2.10:51000",
+			expAuth: "www.example.com",
+		},
+		{
+			name:    "trusted without header",
+			cidrs:   []string{"127.0.0.0/8"},
+			expAddr: "127.0.0.1",
+		},
+		{
+			name:    "untrusted",
+			cidrs:   []string{"10.0.0.0/8"},
+			expAddr: "127.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen failed, %v", err)
+			}
+			pl, err := NewProxyProtocolListener(l, tt.cidrs)
+			if err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+
+			srv := &http.Server{
+				ConnContext: pl.ConnContext,
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, "%s %s", r.RemoteAddr, ProxyHeaderFromContext(r.Context()).Authority())
+				}),
+			}
+			go srv.Serve(pl)
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("dial failed, %v", err)
+			}
+			defer conn.Close()
+
+			if tt.header {
+				conn.Write(proxyV2Header(
+					&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51000},
+					&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80},
+					ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("www.example.com")},
+				))
+			}
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("reading response failed, %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			fields := strings.SplitN(string(body), " ", 2)
+			addr := fields[0]
+			if !tt.header {
+				addr, _, _ = net.SplitHostPort(addr)
+			}
+			if addr != tt.expAddr {
+				t.Errorf("expected remote addr %q, got %q", tt.expAddr, addr)
+			}
+			if fields[1] != tt.expAuth {
+				t.Errorf("expected authority %q, got %q", tt.expAuth, fields[1])
+			}
+		})
+	}
+}
+
+func TestProxyProtocolTLSListener(t *testing.T) {
+	crt, key := testCertificate(t, []string{"www.example.com"}, time.Now().Add(time.Hour))
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatalf("loading certificate, %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed, %v", err)
+	}
+	pl, err := NewProxyProtocolListener(l, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	tl := NewProxyProtocolTLSListener(pl, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	srv := &http.Server{
+		ConnContext: tl.ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %t %s", r.RemoteAddr, r.TLS != nil, ProxyHeaderFromContext(r.Context()).Authority())
+		}),
+	}
+	go srv.Serve(tl)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed, %v", err)
+	}
+	conn.Write(proxyV2Header(
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 51000},
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+		ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("www.example.com")},
+	))
+	tc := tls.Client(conn, &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+	fmt.Fprintf(tc, "GET / HTTP/1.1\r\nHost: www.example.com\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatalf("reading response failed, %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	tc.Close()
+
+	if exp := "192.0.2.10:51000 true www.example.com"; string(body) != exp {
+		t.Errorf("expected %q, got %q", exp, string(body))
+	}
+
+	// connections are forgotten once closed
+	time.Sleep(100 * time.Millisecond)
+	tl.conns.Range(func(k, v interface{}) bool {
+		t.Errorf("expected no tracked connections, got %v", k)
+		return false
+	})
+}
+
+func TestNewProxyProtocolListener_invalid(t *testing.T) {
+	if _, err := NewProxyProtocolListener(nil, []string{"not-a-cidr"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,222 @@
+package minke
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// annRedirectTo redirects requests matching the rules of an Ingress to a
+// URL template. The template may use $scheme, $host, $path, $query,
+// $request_uri (the path and query), and $rest (the path after the part the
+// rule matched). For re2 rules the capture groups of the path are also
+// available, as $1 or ${name}.
+var annRedirectTo = annPrefix + "redirect-to"
+
+// annRedirectCode sets the status used for redirects, one of 301, 302, 307
+// or 308. The default is 301.
+var annRedirectCode = annPrefix + "redirect-code"
+
+// annCanonicalHost redirects requests to the canonical form of the host,
+// "www" adds a www. prefix, "apex" removes it.
+var annCanonicalHost = annPrefix + "canonical-host"
+
+// annTrailingSlash normalises the trailing slash of paths, "add" adds a
+// slash to paths that do not appear to name a file, "remove" removes it.
+var annTrailingSlash = annPrefix + "trailing-slash"
+
+const (
+	canonicalWWW  = "www"
+	canonicalApex = "apex"
+
+	trailingSlashAdd    = "add"
+	trailingSlashRemove = "remove"
+)
+
+type httpRedirect struct {
+	destination string
+	status      int
+}
+
+// redirectConfig describes the redirects an Ingress issues.
+type redirectConfig struct {
+	target        string
+	code          int
+	canonicalHost string
+	trailingSlash string
+}
+
+func (rc *redirectConfig) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{
+		"code": rc.code,
+	}
+	if rc.target != "" {
+		strmap["target"] = rc.target
+	}
+	if rc.canonicalHost != "" {
+		strmap["canonicalHost"] = rc.canonicalHost
+	}
+	if rc.trailingSlash != "" {
+		strmap["trailingSlash"] = rc.trailingSlash
+	}
+	return json.Marshal(strmap)
+}
+
+// parseRedirectConfig reads the redirect annotations, nil is returned if
+// no redirects are configured.
+func parseRedirectConfig(anns map[string]string) (*redirectConfig, error) {
+	rc := &redirectConfig{
+		target:        anns[annRedirectTo],
+		code:          http.StatusMovedPermanently,
+		canonicalHost: anns[annCanonicalHost],
+		trailingSlash: anns[annTrailingSlash],
+	}
+
+	if str, ok := anns[annRedirectCode]; ok {
+		code, err := strconv.Atoi(strings.TrimSpace(str))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, should be 301, 302, 307 or 308", annRedirectCode, str)
+		}
+		switch code {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("invalid %s %q, should be 301, 302, 307 or 308", annRedirectCode, str)
+		}
+		rc.code = code
+	}
+
+	switch rc.canonicalHost {
+	case "", canonicalWWW, canonicalApex:
+	default:
+		return nil, fmt.Errorf("invalid %s %q, should be www or apex", annCanonicalHost, rc.canonicalHost)
+	}
+
+	switch rc.trailingSlash {
+	case "", trailingSlashAdd, trailingSlashRemove:
+	default:
+		return nil, fmt.Errorf("invalid %s %q, should be add or remove", annTrailingSlash, rc.trailingSlash)
+	}
+
+	if rc.target == "" && rc.canonicalHost == "" && rc.trailingSlash == "" {
+		return nil, nil
+	}
+
+	return rc, nil
+}
+
+// normalise returns the URL the request should be redirected to, to
+// canonicalise the host and trailing slash, or "" if no redirect is
+// needed.
+func (rc *redirectConfig) normalise(scheme string, r *http.Request) string {
+	host := r.Host
+	switch rc.canonicalHost {
+	case canonicalWWW:
+		if !strings.HasPrefix(host, "www.") {
+			host = "www." + host
+		}
+	case canonicalApex:
+		host = strings.TrimPrefix(host, "www.")
+	}
+
+	p := r.URL.Path
+	switch rc.trailingSlash {
+	case trailingSlashAdd:
+		if !strings.HasSuffix(p, "/") && !strings.Contains(path.Base(p), ".") {
+			p += "/"
+		}
+	case trailingSlashRemove:
+		if len(p) > 1 && strings.HasSuffix(p, "/") {
+			p = strings.TrimRight(p, "/")
+			if p == "" {
+				p = "/"
+			}
+		}
+	}
+
+	if host == r.Host && p == r.URL.Path {
+		return ""
+	}
+
+	u := *r.URL
+	u.Scheme = scheme
+	u.Host = host
+	u.Path = p
+	u.RawPath = ""
+	return u.String()
+}
+
+// expandTarget fills in the redirect template for a request matching
+// rule, which may be nil for a default backend.
+func (rc *redirectConfig) expandTarget(scheme string, rule *ingressRule, r *http.Request) string {
+	p := r.URL.Path
+	rest := p
+	var groups []string
+	var names []string
+	if rule != nil {
+		n, ms := rule.matchedPart(p)
+		if n <= len(p) {
+			rest = p[n:]
+		}
+		if ms != nil {
+			names = rule.re.SubexpNames()
+			for i := 0; i+1 < len(ms); i += 2 {
+				if ms[i] < 0 {
+					groups = append(groups, "")
+					continue
+				}
+				groups = append(groups, p[ms[i]:ms[i+1]])
+			}
+		}
+	}
+
+	return os.Expand(rc.target, func(name string) string {
+		switch name {
+		case "scheme":
+			return scheme
+		case "host":
+			return r.Host
+		case "path":
+			return p
+		case "query":
+			return r.URL.RawQuery
+		case "request_uri":
+			return r.URL.RequestURI()
+		case "rest":
+			return rest
+		}
+		if i, err := strconv.Atoi(name); err == nil {
+			if i >= 0 && i < len(groups) {
+				return groups[i]
+			}
+			return ""
+		}
+		for i, n := range names {
+			if n == name && i < len(groups) {
+				return groups[i]
+			}
+		}
+		return ""
+	})
+}
+
+// redirect issues any redirect configured for the matched ingress.
+func (c *Controller) redirect(ing *ingress, rule *ingressRule, req *http.Request) {
+	rc := ing.redirect
+	if rc == nil {
+		return
+	}
+
+	scheme := getRequestState(req).scheme(req)
+
+	if dest := rc.normalise(scheme, req); dest != "" {
+		panic(httpRedirect{destination: dest, status: rc.code})
+	}
+
+	if rc.target != "" {
+		panic(httpRedirect{destination: rc.expandTarget(scheme, rule, req), status: rc.code})
+	}
+}
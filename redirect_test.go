@@ -0,0 +1,147 @@
+package minke
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRedirectConfig_normalise(t *testing.T) {
+	tests := []struct {
+		name  string
+		anns  map[string]string
+		url   string
+		exp   string
+		tls   bool
+		isNil bool
+	}{
+		{name: "none", anns: map[string]string{}, isNil: true},
+		{name: "to www", anns: map[string]string{annCanonicalHost: "www"}, url: "http://example.com/a?b=c", exp: "http://www.example.com/a?b=c"},
+		{name: "already www", anns: map[string]string{annCanonicalHost: "www"}, url: "http://www.example.com/a", exp: ""},
+		{name: "to apex", anns: map[string]string{annCanonicalHost: "apex"}, url: "http://www.example.com/a", tls: true, exp: "https://example.com/a"},
+		{name: "add slash", anns: map[string]string{annTrailingSlash: "add"}, url: "http://example.com/a", exp: "http://example.com/a/"},
+		{name: "add slash file", anns: map[string]string{annTrailingSlash: "add"}, url: "http://example.com/a.css", exp: ""},
+		{name: "remove slash", anns: map[string]string{annTrailingSlash: "remove"}, url: "http://example.com/a//", exp: "http://example.com/a"},
+		{name: "remove slash root", anns: map[string]string{annTrailingSlash: "remove"}, url: "http://example.com/", exp: ""},
+		{name: "host and slash", anns: map[string]string{annCanonicalHost: "apex", annTrailingSlash: "add"}, url: "http://www.example.com/a", exp: "http://example.com/a/"},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			rc, err := parseRedirectConfig(st.anns)
+			if err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+			if (rc == nil) != st.isNil {
+				t.Fatalf("expected nil %v, got %v", st.isNil, rc)
+			}
+			if rc == nil {
+				return
+			}
+			req, _ := http.NewRequest("GET", st.url, nil)
+			scheme := "http"
+			if st.tls {
+				scheme = "https"
+			}
+			if got := rc.normalise(scheme, req); got != st.exp {
+				t.Fatalf("expected %q, got %q", st.exp, got)
+			}
+		})
+	}
+}
+
+func TestParseRedirectConfig_errors(t *testing.T) {
+	for _, anns := range []map[string]string{
+		{annRedirectTo: "/", annRedirectCode: "200"},
+		{annRedirectTo: "/", annRedirectCode: "moved"},
+		{annCanonicalHost: "mixed"},
+		{annTrailingSlash: "sometimes"},
+	} {
+		if _, err := parseRedirectConfig(anns); err == nil {
+			t.Errorf("expected an error for %v", anns)
+		}
+	}
+}
+
+func TestRedirectConfig_expandTarget(t *testing.T) {
+	rule := &ingressRule{pathType: re2, path: "^/old/(?P<section>[a-z]+)"}
+	rule.re = regexp.MustCompile(rule.path)
+	rc := &redirectConfig{target: "https://new.example.com/${section}$rest?$query"}
+
+	req, _ := http.NewRequest("GET", "http://example.com/old/docs/intro?x=1", nil)
+	exp := "https://new.example.com/docs/intro?x=1"
+	if got := rc.expandTarget("http", rule, req); got != exp {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+
+	rule = &ingressRule{pathType: prefix, path: "/blog"}
+	rc = &redirectConfig{target: "$scheme://blog.$host$rest"}
+	req, _ = http.NewRequest("GET", "http://example.com/blog/post", nil)
+	exp = "http://blog.example.com/post"
+	if got := rc.expandTarget("http", rule, req); got != exp {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "www",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+					annCanonicalHost:                     "apex",
+					annRedirectCode:                      "308",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{Host: "www.example.com"},
+				},
+			},
+		},
+	)
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	client := pts.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	req, _ := http.NewRequest("POST", pts.URL+"/some/path?q=1", nil)
+	req.Host = "www.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		t.Fatalf("expected status 308, got %v", resp.StatusCode)
+	}
+	exp := "http://example.com/some/path?q=1"
+	if got := resp.Header.Get("Location"); got != exp {
+		t.Fatalf("expected location %q, got %q", exp, got)
+	}
+}
@@ -0,0 +1,98 @@
+package minke
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// annStripPrefix, if "true", removes the part of the path matched by a
+// rule before the request is passed to the backend.
+var annStripPrefix = annPrefix + "strip-prefix"
+
+// annRewriteTarget replaces the part of the path matched by a rule. For
+// re2 rules the target is a template, and may refer to capture groups
+// from the path, e.g. /api/$1 or /api/${name}.
+var annRewriteTarget = annPrefix + "rewrite-target"
+
+// pathRewrite describes how the matched part of a path is replaced.
+type pathRewrite struct {
+	target string // replaces the matched prefix, empty to strip it
+}
+
+func (pr *pathRewrite) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"target": pr.target})
+}
+
+// matchedPart returns the length of the prefix of the path that the rule
+// matched, and for re2 rules, the submatch indexes. The paths of re2 rules
+// are anchored at the start when the ingress is loaded.
+func (ir *ingressRule) matchedPart(path string) (int, []int) {
+	switch ir.pathType {
+	case glob:
+		if strings.HasSuffix(ir.path, "/*") {
+			return len(ir.path) - 2, nil
+		}
+		return len(ir.path), nil
+	case prefix:
+		if ir.path == "/" {
+			return 0, nil
+		}
+		return len(ir.path), nil
+	case exact:
+		return len(path), nil
+	case re2:
+		ms := ir.re.FindStringSubmatchIndex(path)
+		if ms == nil {
+			return 0, nil
+		}
+		return ms[1], ms
+	}
+	return 0, nil
+}
+
+// joinPath joins two parts of a path, without doubling the slash
+// between them.
+func joinPath(a, b string) string {
+	if strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/") {
+		return a + b[1:]
+	}
+	return a + b
+}
+
+// rewritePath applies the rule's rewrite to the path, returning the new
+// path and the prefix that was removed.
+func (ir *ingressRule) rewritePath(path string) (string, string) {
+	end, ms := ir.matchedPart(path)
+	if end > len(path) {
+		end = len(path)
+	}
+	removed, rest := path[:end], path[end:]
+
+	target := ir.rewrite.target
+	if ms != nil {
+		target = string(ir.re.ExpandString(nil, target, path, ms))
+	}
+
+	newPath := joinPath(target, rest)
+	if !strings.HasPrefix(newPath, "/") {
+		newPath = "/" + newPath
+	}
+
+	return newPath, strings.TrimSuffix(removed, "/")
+}
+
+// rewrite updates the path of the outbound request as configured for the
+// matched rule. The removed prefix is passed on in X-Forwarded-Prefix.
+func (c *Controller) rewrite(st *requestState, req *http.Request) {
+	if st.rule == nil || st.rule.rewrite == nil {
+		return
+	}
+
+	path, removed := st.rule.rewritePath(req.URL.Path)
+	req.URL.Path = path
+	req.URL.RawPath = ""
+	if removed != "" {
+		req.Header.Set("X-Forwarded-Prefix", removed)
+	}
+}
@@ -0,0 +1,63 @@
+package minke
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestIngressRule_rewritePath(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      ingressRule
+		target    string
+		reqPath   string
+		expPath   string
+		expPrefix string
+	}{
+		{name: "glob strip", rule: ingressRule{pathType: glob, path: "/app/*"}, reqPath: "/app/x/y", expPath: "/x/y", expPrefix: "/app"},
+		{name: "glob strip base", rule: ingressRule{pathType: glob, path: "/app/*"}, reqPath: "/app", expPath: "/", expPrefix: "/app"},
+		{name: "glob root", rule: ingressRule{pathType: glob, path: "/*"}, reqPath: "/x", expPath: "/x"},
+		{name: "glob no star", rule: ingressRule{pathType: glob, path: "/app"}, reqPath: "/app/", expPath: "/", expPrefix: "/app"},
+		{name: "glob replace", rule: ingressRule{pathType: glob, path: "/app/*"}, target: "/v2", reqPath: "/app/x", expPath: "/v2/x", expPrefix: "/app"},
+
+		{name: "prefix strip", rule: ingressRule{pathType: prefix, path: "/app"}, reqPath: "/app/x", expPath: "/x", expPrefix: "/app"},
+		{name: "prefix strip base", rule: ingressRule{pathType: prefix, path: "/app"}, reqPath: "/app", expPath: "/", expPrefix: "/app"},
+		{name: "prefix root", rule: ingressRule{pathType: prefix, path: "/"}, reqPath: "/x", expPath: "/x"},
+		{name: "prefix replace", rule: ingressRule{pathType: prefix, path: "/app"}, target: "/v2/", reqPath: "/app/x", expPath: "/v2/x", expPrefix: "/app"},
+		{name: "prefix replace base", rule: ingressRule{pathType: prefix, path: "/app"}, target: "/v2", reqPath: "/app", expPath: "/v2", expPrefix: "/app"},
+
+		{name: "exact strip", rule: ingressRule{pathType: exact, path: "/app/x"}, reqPath: "/app/x", expPath: "/", expPrefix: "/app/x"},
+		{name: "exact replace", rule: ingressRule{pathType: exact, path: "/app/x"}, target: "/y", reqPath: "/app/x", expPath: "/y", expPrefix: "/app/x"},
+
+		{name: "re2 strip", rule: ingressRule{pathType: re2, path: "^/app/v[0-9]+"}, reqPath: "/app/v1/x", expPath: "/x", expPrefix: "/app/v1"},
+		{name: "re2 template", rule: ingressRule{pathType: re2, path: "^/app/([a-z]+)/(.*)"}, target: "/$2/${1}", reqPath: "/app/users/42", expPath: "/42/users", expPrefix: "/app/users/42"},
+		{name: "re2 named", rule: ingressRule{pathType: re2, path: "^/u/(?P<id>[0-9]+)"}, target: "/users/$id", reqPath: "/u/7/posts", expPath: "/users/7/posts", expPrefix: "/u/7"},
+		{name: "re2 whole path", rule: ingressRule{pathType: re2, path: "^/docs/legacy$"}, target: "/docs/current", reqPath: "/docs/legacy", expPath: "/docs/current", expPrefix: "/docs/legacy"},
+	}
+
+	for _, st := range tests {
+		st := st
+		t.Run(st.name, func(t *testing.T) {
+			rule := st.rule
+			if rule.pathType == re2 {
+				rule.re = regexp.MustCompile(rule.path)
+			}
+			rule.rewrite = &pathRewrite{target: st.target}
+
+			req, _ := http.NewRequest("GET", "http://host"+st.reqPath, nil)
+			if l, _ := rule.matchRule(req); l == 0 {
+				t.Fatalf("rule did not match %s", st.reqPath)
+			}
+
+			c := &Controller{}
+			c.rewrite(&requestState{rule: &rule}, req)
+			if req.URL.Path != st.expPath {
+				t.Errorf("expected path %q, got %q", st.expPath, req.URL.Path)
+			}
+			if got := req.Header.Get("X-Forwarded-Prefix"); got != st.expPrefix {
+				t.Errorf("expected prefix %q, got %q", st.expPrefix, got)
+			}
+		})
+	}
+}
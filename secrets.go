@@ -8,7 +8,9 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -31,13 +33,20 @@ type secretKey struct {
 	namespace, name string
 }
 
+func (k secretKey) String() string {
+	return k.namespace + "/" + k.name
+}
+
+var errSecretNotFound = errors.New("secret not found")
+
 type certMapEntry struct {
 	sync.RWMutex
-	cert *tls.Certificate
-	raw  []byte
-	sec  secretKey
-	ing  ingressKey
-	err  error
+	cert  *tls.Certificate
+	raw   []byte
+	sec   secretKey
+	ing   ingressKey
+	hosts []string
+	err   error
 }
 
 // a map of host names to certificates.
@@ -66,6 +75,9 @@ func (cme *certMapEntry) MarshalJSON() ([]byte, error) {
 		"ingress": fmt.Sprintf("%s/%s", cme.ing.namespace, cme.ing.name),
 		"secret":  fmt.Sprintf("%s/%s", cme.sec.namespace, cme.sec.name),
 	}
+	if len(cme.hosts) > 0 {
+		strmap["hosts"] = cme.hosts
+	}
 
 	if cme.cert != nil {
 		strmap["notBefore"] = cme.cert.Leaf.NotBefore
@@ -86,17 +98,14 @@ func (cme *certMapEntry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(strmap)
 }
 
-func (cm *certMap) updateIngress(key ingressKey, sec secretKey, hosts []string) {
-	cert, err := cm.secs.getCert(sec)
-	cmapEntry := &certMapEntry{
-		sec:  sec,
-		ing:  key,
-		cert: cert,
-		err:  err,
-	}
-	newset := make(map[string][]*certMapEntry, len(hosts))
-	for _, h := range hosts {
-		newset[h] = [](*certMapEntry){cmapEntry}
+// updateIngress replaces the certificates used by an ingress, passing no
+// entries removes them.
+func (cm *certMap) updateIngress(key ingressKey, cmes []*certMapEntry) {
+	newset := make(map[string][]*certMapEntry)
+	for _, cme := range cmes {
+		for _, h := range cme.hosts {
+			newset[h] = append(newset[h], cme)
+		}
 	}
 
 	cm.Lock()
@@ -114,6 +123,9 @@ func (cm *certMap) updateIngress(key ingressKey, sec secretKey, hosts []string)
 			}
 		}
 		cm.set[h] = cm.set[h][:n]
+		if n == 0 {
+			delete(cm.set, h)
+		}
 	}
 
 	for h, cmes := range newset {
@@ -121,6 +133,76 @@ func (cm *certMap) updateIngress(key ingressKey, sec secretKey, hosts []string)
 	}
 }
 
+// ingressesFor lists the ingresses using the given secret.
+func (cm *certMap) ingressesFor(sec secretKey) []ingressKey {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	seen := map[ingressKey]struct{}{}
+	var ings []ingressKey
+	for _, cmes := range cm.set {
+		for _, cme := range cmes {
+			if cme.sec != sec {
+				continue
+			}
+			if _, ok := seen[cme.ing]; ok {
+				continue
+			}
+			seen[cme.ing] = struct{}{}
+			ings = append(ings, cme.ing)
+		}
+	}
+	return ings
+}
+
+// CertificateInfo describes a loaded certificate, and the hosts it is
+// used for. Default certificates have no hosts.
+type CertificateInfo struct {
+	Secret   string
+	Hosts    []string
+	NotAfter time.Time
+}
+
+// certificates lists the currently loaded certificates, certificates
+// shared by several ingresses for the same hosts are listed once.
+func (cm *certMap) certificates() []CertificateInfo {
+	cm.RLock()
+	defer cm.RUnlock()
+
+	seen := map[string]struct{}{}
+	var infos []CertificateInfo
+	add := func(cme *certMapEntry) {
+		cme.RLock()
+		defer cme.RUnlock()
+		if cme.cert == nil || cme.cert.Leaf == nil {
+			return
+		}
+		hosts := append([]string(nil), cme.hosts...)
+		sort.Strings(hosts)
+		id := cme.sec.String() + " " + strings.Join(hosts, ",")
+		if _, ok := seen[id]; ok {
+			return
+		}
+		seen[id] = struct{}{}
+		infos = append(infos, CertificateInfo{
+			Secret:   cme.sec.String(),
+			Hosts:    hosts,
+			NotAfter: cme.cert.Leaf.NotAfter,
+		})
+	}
+
+	for _, cmes := range cm.set {
+		for _, cme := range cmes {
+			add(cme)
+		}
+	}
+	for _, cme := range cm.defaults {
+		add(cme)
+	}
+
+	return infos
+}
+
 func (cm *certMap) updateSecret(key secretKey, cert *tls.Certificate, err error) {
 	cm.RLock()
 	defer cm.RUnlock()
@@ -132,6 +214,7 @@ func (cm *certMap) updateSecret(key secretKey, cert *tls.Certificate, err error)
 				defer cme.Unlock()
 				if cme.sec == key {
 					cme.cert = cert
+					cme.err = err
 				}
 			}()
 		}
@@ -143,6 +226,7 @@ func (cm *certMap) updateSecret(key secretKey, cert *tls.Certificate, err error)
 			defer cme.Unlock()
 			if cme.sec == key {
 				cme.cert = cert
+				cme.err = err
 			}
 		}()
 	}
@@ -270,11 +354,78 @@ type secUpdater struct {
 	mu      sync.RWMutex
 	secrets map[secretKey]map[string][]byte
 	certMap *certMap
+
+	pending map[secretKey]bool // secrets left in the first pass of the worker
+	primed  bool               // the first pass is complete
+}
+
+// startFirstPass records the secrets the worker must process before we
+// trust our cache enough to report secrets as missing.
+func (u *secUpdater) startFirstPass(keys []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending = make(map[secretKey]bool)
+	for _, k := range keys {
+		namespace, name, err := cache.SplitMetaNamespaceKey(k)
+		if err != nil {
+			continue
+		}
+		u.pending[secretKey{namespace, name}] = true
+	}
+	if len(u.pending) == 0 {
+		u.pending = nil
+		u.primed = true
+	}
+}
+
+// processed notes that the worker has handled a secret. Once the first
+// pass is complete, all the ingresses are reprocessed so that missing
+// secrets are reported.
+func (u *secUpdater) processed(key secretKey) {
+	u.mu.Lock()
+	if u.pending == nil {
+		u.mu.Unlock()
+		return
+	}
+	delete(u.pending, key)
+	done := len(u.pending) == 0
+	if done {
+		u.pending = nil
+		u.primed = true
+	}
+	u.mu.Unlock()
+
+	if done {
+		u.c.requeueIngresses()
+	}
+}
+
+// ready reports if the first pass of the worker is complete.
+func (u *secUpdater) ready() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.primed
 }
 
 func (u *secUpdater) updateCert(key secretKey) {
 	sec, err := u.getCert(key)
+	if err != nil && u.c.certMetric != nil {
+		u.c.certMetric.LoadError(key.String())
+	}
 	u.certMap.updateSecret(key, sec, err)
+
+	// The ingresses using this secret are reprocessed so that any
+	// problems with the new certificate are reported against them.
+	u.requeueIngresses(key)
+}
+
+func (u *secUpdater) requeueIngresses(key secretKey) {
+	if u.c.ingProc == nil {
+		return
+	}
+	for _, ing := range u.certMap.ingressesFor(key) {
+		u.c.ingProc.queue.Add(ing.namespace + "/" + ing.name)
+	}
 }
 
 func (u *secUpdater) addItem(obj interface{}) error {
@@ -283,6 +434,11 @@ func (u *secUpdater) addItem(obj interface{}) error {
 		return nil
 	}
 
+	defer u.processed(secretKey{sobj.Namespace, sobj.Name})
+
+	u.c.acme.accountSecretUpdated(sobj)
+	defer u.c.clientAuth.secretUpdated(secretKey{sobj.Namespace, sobj.Name})
+
 	if sobj.Data == nil {
 		return nil
 	}
@@ -310,11 +466,18 @@ func (u *secUpdater) delItem(obj interface{}) error {
 		return nil
 	}
 
-	u.mu.Lock()
-	defer u.mu.Unlock()
+	u.c.acme.accountSecretUpdated(&corev1.Secret{ObjectMeta: sobj.ObjectMeta})
 
+	key := secretKey{sobj.Namespace, sobj.Name}
+	defer u.processed(key)
+	u.mu.Lock()
 	klog.Infof("secret deleted, %s/%s", sobj.GetNamespace(), sobj.GetName())
-	delete(u.secrets, secretKey{sobj.Namespace, sobj.Name})
+	delete(u.secrets, key)
+	u.mu.Unlock()
+
+	u.c.clientAuth.secretUpdated(key)
+
+	u.requeueIngresses(key)
 	return nil
 }
 
@@ -338,6 +501,9 @@ func (u *secUpdater) getSecret(namespace, name string) map[string][]byte {
 
 func (u *secUpdater) getCert(key secretKey) (*tls.Certificate, error) {
 	sec := u.getSecret(key.namespace, key.name)
+	if sec == nil {
+		return nil, errSecretNotFound
+	}
 	certBytes := sec[`tls.crt`]
 	if len(certBytes) == 0 {
 		// key or cert not specified
@@ -363,6 +529,47 @@ func (u *secUpdater) getCert(key secretKey) (*tls.Certificate, error) {
 	return &newcert, nil
 }
 
+// checkCertificate records events against an ingress if the certificate
+// in its TLS secret cannot be used for the given hosts.
+func (c *Controller) checkCertificate(obj interface{}, sec secretKey, hosts []string, cert *tls.Certificate, err error) {
+	switch {
+	case err == errSecretNotFound && (!c.secs.ready() || c.acme.manages(sec)):
+		// The secret may just not be in our cache yet, or be one we
+		// have yet to issue.
+		return
+	case err == errSecretNotFound:
+		klog.Errorf("tls secret %s not found", sec)
+		c.recordEventf(obj, corev1.EventTypeWarning, "MissingTLSSecret", "tls secret %s not found", sec)
+		return
+	case err != nil:
+		klog.Errorf("invalid tls secret %s, %v", sec, err)
+		c.recordEventf(obj, corev1.EventTypeWarning, "InvalidTLSSecret", "invalid tls secret %s, %v", sec, err)
+		return
+	case cert == nil || cert.Leaf == nil:
+		return
+	}
+
+	if cert.Leaf.NotAfter.Before(time.Now()) {
+		klog.Errorf("certificate in tls secret %s expired at %v", sec, cert.Leaf.NotAfter)
+		c.recordEventf(obj, corev1.EventTypeWarning, "ExpiredTLSCertificate", "certificate in tls secret %s expired at %v", sec, cert.Leaf.NotAfter)
+	} else {
+		// Check again just after it expires, rather than waiting for
+		// the ingress or secret to change.
+		c.requeueIngressAt(obj, cert.Leaf.NotAfter.Add(time.Second))
+	}
+
+	var uncovered []string
+	for _, h := range hosts {
+		if cert.Leaf.VerifyHostname(h) != nil {
+			uncovered = append(uncovered, h)
+		}
+	}
+	if len(uncovered) > 0 {
+		klog.Errorf("certificate in tls secret %s does not cover %s", sec, strings.Join(uncovered, ", "))
+		c.recordEventf(obj, corev1.EventTypeWarning, "TLSCertificateMismatch", "certificate in tls secret %s does not cover %s", sec, strings.Join(uncovered, ", "))
+	}
+}
+
 func (c *Controller) setupSecretProcess(ctx context.Context) error {
 	upd := &secUpdater{
 		c:       c,
@@ -0,0 +1,302 @@
+package minke
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// testCertificate creates a self signed certificate and key for the
+// given hosts, PEM encoded.
+func testCertificate(t *testing.T, hosts []string, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key, %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate, %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key, %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertificateChecks(t *testing.T) {
+	tlsSecret := func(name string, crt, key []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				"tls.crt": crt,
+				"tls.key": key,
+			},
+		}
+	}
+
+	ingress := func(name, host, secret string, tlsHosts []string) *networkingv1beta1.Ingress {
+		return &networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": "minke",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				TLS: []networkingv1beta1.IngressTLS{
+					{Hosts: tlsHosts, SecretName: secret},
+				},
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: host,
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "app",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	future := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	goodCrt, goodKey := testCertificate(t, []string{"good.example.com", "alt.example.com"}, future)
+	expiredCrt, expiredKey := testCertificate(t, []string{"expired.example.com"}, time.Now().Add(-time.Hour))
+	otherCrt, otherKey := testCertificate(t, []string{"other.example.com"}, future)
+
+	clientset := fake.NewSimpleClientset(
+		tlsSecret("good", goodCrt, goodKey),
+		tlsSecret("expired", expiredCrt, expiredKey),
+		tlsSecret("other", otherCrt, otherKey),
+		tlsSecret("garbage", []byte("not a cert"), []byte("not a key")),
+		ingress("good", "good.example.com", "good", []string{"good.example.com", "alt.example.com"}),
+		ingress("missing", "missing.example.com", "nosuch", nil),
+		ingress("invalid", "invalid.example.com", "garbage", nil),
+		ingress("expired", "expired.example.com", "expired", nil),
+		ingress("mismatch", "wrong.example.com", "other", nil),
+	)
+
+	reg := prometheus.NewRegistry()
+	mp, err := NewPrometheusMetrics(reg)
+	if err != nil {
+		t.Fatalf("error creating metrics, %v", err)
+	}
+
+	ctrl, err := New(clientset, WithMetricsProvider(mp))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	recorder := record.NewFakeRecorder(100)
+	ctrl.recorder = recorder
+	ctrl.leader.setLeader(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	events := map[string]bool{}
+	for done := false; !done; {
+		select {
+		case ev := <-recorder.Events:
+			events[strings.Fields(ev)[1]] = true
+		default:
+			done = true
+		}
+	}
+	for _, reason := range []string{"MissingTLSSecret", "InvalidTLSSecret", "ExpiredTLSCertificate", "TLSCertificateMismatch"} {
+		if !events[reason] {
+			t.Errorf("expected a %s event, got %v", reason, events)
+		}
+	}
+
+	// Hosts listed in the TLS section should be served the certificate.
+	for _, host := range []string{"good.example.com", "alt.example.com"} {
+		cert, err := ctrl.certMap.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        host,
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS13},
+		})
+		if err != nil || cert == nil {
+			t.Fatalf("expected a certificate for %s, got %v, %v", host, cert, err)
+		}
+		if cert.Leaf.Subject.CommonName != "good.example.com" {
+			t.Errorf("expected the good certificate for %s, got %s", host, cert.Leaf.Subject.CommonName)
+		}
+	}
+
+	var secrets []string
+	for _, ci := range ctrl.certMap.certificates() {
+		secrets = append(secrets, ci.Secret)
+		if ci.Secret == "default/good" && strings.Join(ci.Hosts, ",") != "alt.example.com,good.example.com" {
+			t.Errorf("unexpected hosts for default/good, %v", ci.Hosts)
+		}
+	}
+	sort.Strings(secrets)
+	if exp := "default/expired,default/good,default/other"; strings.Join(secrets, ",") != exp {
+		t.Errorf("expected certificates %s, got %v", exp, secrets)
+	}
+
+	if v := gatherValue(t, reg, "tls_certificate_not_after_timestamp_seconds", map[string]string{
+		"secret": "default/good",
+		"hosts":  "alt.example.com,good.example.com",
+	}); v != float64(future.Unix()) {
+		t.Errorf("expected not after of %d, got %v", future.Unix(), v)
+	}
+	if v := gatherValue(t, reg, "tls_certificate_load_errors_total", map[string]string{"secret": "default/garbage"}); v < 1 {
+		t.Errorf("expected load errors for default/garbage, got %v", v)
+	}
+}
+
+func TestCheckCertificate_missing(t *testing.T) {
+	ctrl, err := New(fake.NewSimpleClientset())
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	ctrl.recorder = recorder
+	ctrl.leader.setLeader(true)
+
+	ing := &networkingv1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "missing", Namespace: "default"},
+	}
+	sec := secretKey{namespace: "default", name: "nosuch"}
+
+	missingEvent := func() bool {
+		ctrl.checkCertificate(ing, sec, []string{"missing.example.com"}, nil, errSecretNotFound)
+		select {
+		case ev := <-recorder.Events:
+			if reason := strings.Fields(ev)[1]; reason != "MissingTLSSecret" {
+				t.Fatalf("unexpected event %s", ev)
+			}
+			return true
+		default:
+			return false
+		}
+	}
+
+	// the secrets worker has yet to see everything in the cache
+	ctrl.secs.startFirstPass([]string{"default/other"})
+	if missingEvent() {
+		t.Fatalf("did not expect a missing secret to be reported before the first pass")
+	}
+
+	ctrl.secs.processed(secretKey{namespace: "default", name: "other"})
+	if !missingEvent() {
+		t.Fatalf("expected a missing secret to be reported after the first pass")
+	}
+
+	// secrets we are to issue are not reported
+	ctrl.acme = &acmeManager{certs: map[secretKey]*acmeCert{sec: {}}}
+	if missingEvent() {
+		t.Fatalf("did not expect a missing acme secret to be reported")
+	}
+}
+
+func TestCheckCertificate_expiry(t *testing.T) {
+	// the certificate expires shortly after the ingress is processed
+	notAfter := time.Now().Add(2 * time.Second)
+	crt, key := testCertificate(t, []string{"soon.example.com"}, notAfter)
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "soon", Namespace: "default"},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				"tls.crt": crt,
+				"tls.key": key,
+			},
+		},
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "soon",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class": "minke",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				TLS: []networkingv1beta1.IngressTLS{
+					{Hosts: []string{"soon.example.com"}, SecretName: "soon"},
+				},
+			},
+		},
+	)
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	recorder := record.NewFakeRecorder(100)
+	ctrl.recorder = recorder
+	ctrl.leader.setLeader(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+
+	expired := func() bool {
+		for {
+			select {
+			case ev := <-recorder.Events:
+				if strings.Fields(ev)[1] == "ExpiredTLSCertificate" {
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}
+
+	time.Sleep(1 * time.Second)
+	if expired() {
+		t.Fatalf("did not expect the certificate to be reported as expired yet")
+	}
+
+	// nothing changes, the ingress should be checked again once the
+	// certificate has expired
+	time.Sleep(time.Until(notAfter) + 2*time.Second)
+	if !expired() {
+		t.Fatalf("expected the certificate to be reported as expired")
+	}
+}
@@ -3,6 +3,8 @@ package minke
 import (
 	"context"
 	"encoding/json"
+	"reflect"
+	"strconv"
 	"sync"
 
 	corev1 "k8s.io/api/core/v1"
@@ -22,6 +24,22 @@ type svcKey struct {
 type svcItem struct {
 	svc       *corev1.Service
 	appProtos map[string]string
+	balancer  balancerSpec
+	affinity  string
+	weights   endpointWeights
+}
+
+// endpointWeights maps pod names or IPs to weights.
+type endpointWeights map[string]int
+
+func (ws endpointWeights) weight(addr serviceAddr) int {
+	if w, ok := ws[addr.target]; ok && addr.target != "" {
+		return w
+	}
+	if w, ok := ws[addr.addr]; ok {
+		return w
+	}
+	return 1
 }
 
 type svcUpdater struct {
@@ -57,15 +75,43 @@ func (u *svcUpdater) addItem(obj interface{}) error {
 		}
 	}
 
-	u.svcs[svcKey{sobj.Namespace, sobj.Name}] = svcItem{
+	balancer, affinity, errs := parseBalancerAnnotations(sobj.Annotations)
+	for _, err := range errs {
+		klog.Errorf("invalid load balancer annotations on service %s/%s, %v", sobj.Namespace, sobj.Name, err)
+		u.c.recordEventf(sobj, corev1.EventTypeWarning, "InvalidLoadBalancer", "%v, using the default", err)
+	}
+
+	var weights endpointWeights
+	if weightsJSON, ok := sobj.Annotations[annEndpointWeights]; ok {
+		if err := json.Unmarshal([]byte(weightsJSON), &weights); err != nil {
+			klog.Errorf("invalid annotation value for %q on service %s/%s, %v", annEndpointWeights, sobj.Namespace, sobj.Name, err)
+			u.c.recordEventf(sobj, corev1.EventTypeWarning, "InvalidEndpointWeights", "invalid endpoint weights, %v", err)
+		}
+	}
+
+	key := svcKey{sobj.Namespace, sobj.Name}
+	old := u.svcs[key]
+	u.svcs[key] = svcItem{
 		svc:       sobj,
 		appProtos: appProtos,
+		balancer:  balancer,
+		affinity:  affinity,
+		weights:   weights,
 	}
+
+	// The weights are applied to the endpoints as they are
+	// processed.
+	if !reflect.DeepEqual(old.weights, weights) {
+		u.c.requeueEndpoints(sobj.Namespace, sobj.Name)
+	}
+
+	u.c.status.serviceUpdated(sobj)
+
 	return nil
 }
 
 func (u *svcUpdater) delItem(obj interface{}) error {
-	sobj, ok := obj.(*corev1.Secret)
+	sobj, ok := obj.(*corev1.Service)
 	if !ok {
 		return nil
 	}
@@ -75,11 +121,58 @@ func (u *svcUpdater) delItem(obj interface{}) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
-	klog.Infof("secret deleted, %s/%s", sobj.GetNamespace(), sobj.GetName())
 	delete(u.svcs, svcKey{sobj.Namespace, sobj.Name})
 	return nil
 }
 
+// resolvePort maps a backend that refers to a service port by number on to
+// the name of that port, which is how the endpoints are keyed. A backend
+// with no port is mapped to the only port of a single port service.
+func (u *svcUpdater) resolvePort(key serviceKey) serviceKey {
+	num, err := strconv.Atoi(key.portName)
+	if err != nil && key.portName != "" {
+		return key
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	v, ok := u.svcs[svcKey{key.namespace, key.name}]
+	if !ok {
+		return key
+	}
+
+	if key.portName == "" {
+		if len(v.svc.Spec.Ports) == 1 {
+			key.portName = v.svc.Spec.Ports[0].Name
+		}
+		return key
+	}
+
+	for _, p := range v.svc.Spec.Ports {
+		if int(p.Port) == num {
+			key.portName = p.Name
+			return key
+		}
+	}
+
+	return key
+}
+
+// getBalancer returns the load balancing strategy and affinity cookie set
+// on the service, if any.
+func (u *svcUpdater) getBalancer(key serviceKey) (balancerSpec, string) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	v := u.svcs[svcKey{key.namespace, key.name}]
+	return v.balancer, v.affinity
+}
+
+func (u *svcUpdater) getEndpointWeights(namespace, name string) endpointWeights {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.svcs[svcKey{namespace, name}].weights
+}
+
 func (u *svcUpdater) getServicePortScheme(key serviceKey) string {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
@@ -0,0 +1,34 @@
+package minke
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServices_delItem(t *testing.T) {
+	svc := func(name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		}
+	}
+
+	u := &svcUpdater{
+		svcs: map[svcKey]svcItem{
+			{"default", "first"}:  {svc: svc("first")},
+			{"default", "second"}: {svc: svc("second")},
+		},
+	}
+
+	if err := u.delItem(svc("first")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if _, ok := u.svcs[svcKey{"default", "first"}]; ok {
+		t.Errorf("expected default/first to be removed")
+	}
+	if _, ok := u.svcs[svcKey{"default", "second"}]; !ok {
+		t.Errorf("expected default/second to be kept")
+	}
+}
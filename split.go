@@ -0,0 +1,279 @@
+package minke
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// annTrafficSplit sends a share of the traffic for the rules of an
+// Ingress to other services. The value is a JSON list of variants, for
+// example:
+//
+//	[{"backend": "app", "service": "app-v2", "port": "http", "weight": 5}]
+//
+// Each variant takes traffic from the rules whose backend is the named
+// service, backend may only be left out if the Ingress uses a single
+// service. Weights are percentages, the backend given in the rule
+// receives whatever is left. If the port is not given, the port of the
+// rule's backend is used.
+var annTrafficSplit = annPrefix + "traffic-split"
+
+// annTrafficSplitSticky pins a client to a variant, it can be
+// cookie:NAME, in which case the variant first picked is recorded in the
+// named cookie, or header:NAME, in which case the variant is chosen by
+// hashing the value of the header.
+var annTrafficSplitSticky = annPrefix + "traffic-split-sticky"
+
+type splitVariant struct {
+	from    string // the rule backend this variant takes traffic from
+	service string
+	port    string
+	weight  int
+}
+
+func (sv splitVariant) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{
+		"service": sv.service,
+		"port":    sv.port,
+		"weight":  sv.weight,
+	}
+	if sv.from != "" {
+		strmap["backend"] = sv.from
+	}
+	return json.Marshal(strmap)
+}
+
+// trafficSplit describes how requests are split between the backend of
+// a rule and the variants.
+type trafficSplit struct {
+	variants []splitVariant
+	cookie   string
+	header   string
+}
+
+func (ts *trafficSplit) MarshalJSON() ([]byte, error) {
+	strmap := map[string]interface{}{
+		"variants": ts.variants,
+	}
+	if ts.cookie != "" {
+		strmap["stickyCookie"] = ts.cookie
+	}
+	if ts.header != "" {
+		strmap["stickyHeader"] = ts.header
+	}
+	return json.Marshal(strmap)
+}
+
+type splitVariantJSON struct {
+	Backend string `json:"backend"`
+	Service string `json:"service"`
+	Port    string `json:"port"`
+	Weight  int    `json:"weight"`
+}
+
+// parseTrafficSplit reads the traffic split annotations, nil is returned
+// if no split is configured.
+func parseTrafficSplit(anns map[string]string) (*trafficSplit, error) {
+	str, ok := anns[annTrafficSplit]
+	if !ok {
+		return nil, nil
+	}
+
+	var in []splitVariantJSON
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, fmt.Errorf("invalid %s, %w", annTrafficSplit, err)
+	}
+
+	ts := &trafficSplit{}
+	var total int
+	totals := map[string]int{}
+	for _, v := range in {
+		if v.Service == "" {
+			return nil, fmt.Errorf("invalid %s, variant has no service", annTrafficSplit)
+		}
+		if v.Weight < 0 || v.Weight > 100 {
+			return nil, fmt.Errorf("invalid %s, weight for %s should be between 0 and 100", annTrafficSplit, v.Service)
+		}
+		if v.Backend == "" {
+			total += v.Weight
+		} else {
+			totals[v.Backend] += v.Weight
+		}
+		ts.variants = append(ts.variants, splitVariant{
+			from:    v.Backend,
+			service: v.Service,
+			port:    v.Port,
+			weight:  v.Weight,
+		})
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("invalid %s, weights add up to %d, more than 100", annTrafficSplit, total)
+	}
+	for backend, t := range totals {
+		if total+t > 100 {
+			return nil, fmt.Errorf("invalid %s, weights for %s add up to %d, more than 100", annTrafficSplit, backend, total+t)
+		}
+	}
+
+	if sticky, ok := anns[annTrafficSplitSticky]; ok {
+		parts := strings.SplitN(sticky, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %s %q, should be cookie:NAME or header:NAME", annTrafficSplitSticky, sticky)
+		}
+		switch parts[0] {
+		case "cookie":
+			if !validCookieName(parts[1]) {
+				return nil, fmt.Errorf("invalid %s, bad cookie name %q", annTrafficSplitSticky, parts[1])
+			}
+			ts.cookie = parts[1]
+		case "header":
+			ts.header = http.CanonicalHeaderKey(parts[1])
+		default:
+			return nil, fmt.Errorf("invalid %s %q, should be cookie:NAME or header:NAME", annTrafficSplitSticky, sticky)
+		}
+	}
+
+	return ts, nil
+}
+
+// checkBackends verifies the variants against the services used by the
+// rules of the Ingress. A variant that names no backend would take
+// traffic from every rule, so that is only allowed if there is just one
+// service.
+func (ts *trafficSplit) checkBackends(services []string) error {
+	if ts == nil {
+		return nil
+	}
+	used := map[string]bool{}
+	for _, s := range services {
+		used[s] = true
+	}
+	for _, v := range ts.variants {
+		switch {
+		case v.from == "" && len(used) > 1:
+			return fmt.Errorf("invalid %s, variant %s must name the backend it takes traffic from, the ingress has several", annTrafficSplit, v.service)
+		case v.from != "" && !used[v.from]:
+			return fmt.Errorf("invalid %s, variant %s names backend %s, which no rule uses", annTrafficSplit, v.service, v.from)
+		}
+	}
+	return nil
+}
+
+// ingressServices lists the services used as backends by an Ingress.
+func ingressServices(ing *networkingv1.Ingress) []string {
+	var services []string
+	if b := ing.Spec.DefaultBackend; b != nil && b.Service != nil {
+		services = append(services, b.Service.Name)
+	}
+	for _, r := range ing.Spec.Rules {
+		if r.HTTP == nil {
+			continue
+		}
+		for _, p := range r.HTTP.Paths {
+			if p.Backend.Service != nil {
+				services = append(services, p.Backend.Service.Name)
+			}
+		}
+	}
+	return services
+}
+
+// forBackend returns the split for rules whose backend is the named
+// service, nil is returned if no variant applies.
+func (ts *trafficSplit) forBackend(service string) *trafficSplit {
+	if ts == nil {
+		return nil
+	}
+	var variants []splitVariant
+	for _, v := range ts.variants {
+		if v.from == "" || v.from == service {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) == 0 {
+		return nil
+	}
+	return &trafficSplit{
+		variants: variants,
+		cookie:   ts.cookie,
+		header:   ts.header,
+	}
+}
+
+// backend returns the service key for the variant, the primary backend
+// supplies the namespace, and the port if the variant has none.
+func (sv splitVariant) backend(primary serviceKey) serviceKey {
+	key := serviceKey{
+		namespace: primary.namespace,
+		name:      sv.service,
+		portName:  sv.port,
+	}
+	if key.portName == "" {
+		key.portName = primary.portName
+	}
+	return key
+}
+
+// variantByName finds the live variant with the given name, the name of
+// the primary backend is also accepted.
+func (ts *trafficSplit) variantByName(primary serviceKey, name string) (serviceKey, bool) {
+	if name == primary.name {
+		return primary, true
+	}
+	for _, v := range ts.variants {
+		if v.service == name && v.weight > 0 {
+			return v.backend(primary), true
+		}
+	}
+	return serviceKey{}, false
+}
+
+// variantForBucket picks the backend for a bucket in the range [0,100).
+func (ts *trafficSplit) variantForBucket(primary serviceKey, bucket int) serviceKey {
+	for _, v := range ts.variants {
+		if bucket < v.weight {
+			return v.backend(primary)
+		}
+		bucket -= v.weight
+	}
+	return primary
+}
+
+// pick selects the backend to use for a request, and any cookie that
+// should be set to pin the client to it.
+func (ts *trafficSplit) pick(primary serviceKey, r *http.Request) (serviceKey, *http.Cookie) {
+	if ts.header != "" {
+		if v := r.Header.Get(ts.header); v != "" {
+			return ts.variantForBucket(primary, int(hash64(v)%100)), nil
+		}
+	}
+
+	if ts.cookie != "" {
+		if c, err := r.Cookie(ts.cookie); err == nil {
+			if key, ok := ts.variantByName(primary, c.Value); ok {
+				return key, nil
+			}
+		}
+	}
+
+	key := ts.variantForBucket(primary, rand.Intn(100))
+
+	if ts.cookie == "" {
+		return key, nil
+	}
+	return key, &http.Cookie{
+		Name:     ts.cookie,
+		Value:    key.name,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
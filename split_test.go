@@ -0,0 +1,261 @@
+package minke
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseTrafficSplit(t *testing.T) {
+	tests := []struct {
+		anns   map[string]string
+		expErr bool
+		expNil bool
+	}{
+		{anns: map[string]string{}, expNil: true},
+		{anns: map[string]string{annTrafficSplit: `[{"service": "v2", "weight": 5}]`}},
+		{anns: map[string]string{annTrafficSplit: `[{"service": "v2", "weight": 60}, {"service": "v3", "weight": 50}]`}, expErr: true},
+		{anns: map[string]string{annTrafficSplit: `[{"service": "v2", "weight": -1}]`}, expErr: true},
+		{anns: map[string]string{annTrafficSplit: `[{"weight": 5}]`}, expErr: true},
+		{anns: map[string]string{annTrafficSplit: `{}`}, expErr: true},
+		{anns: map[string]string{annTrafficSplit: `[]`, annTrafficSplitSticky: "cookie:variant"}},
+		{anns: map[string]string{annTrafficSplit: `[]`, annTrafficSplitSticky: "header:x-user"}},
+		{anns: map[string]string{annTrafficSplit: `[]`, annTrafficSplitSticky: "cookie:bad name"}, expErr: true},
+		{anns: map[string]string{annTrafficSplit: `[]`, annTrafficSplitSticky: "query:user"}, expErr: true},
+		{anns: map[string]string{annTrafficSplit: `[{"backend": "v1", "service": "v2", "weight": 60}, {"backend": "w1", "service": "w2", "weight": 60}]`}},
+		{anns: map[string]string{annTrafficSplit: `[{"backend": "v1", "service": "v2", "weight": 60}, {"service": "v3", "weight": 50}]`}, expErr: true},
+	}
+
+	for i, st := range tests {
+		ts, err := parseTrafficSplit(st.anns)
+		if (err != nil) != st.expErr {
+			t.Errorf("%d: unexpected error state, %v", i, err)
+			continue
+		}
+		if !st.expErr && (ts == nil) != st.expNil {
+			t.Errorf("%d: expected nil %v, got %v", i, st.expNil, ts)
+		}
+	}
+}
+
+func TestTrafficSplit_pick(t *testing.T) {
+	primary := serviceKey{namespace: "ns", name: "v1", portName: "http"}
+	ts, err := parseTrafficSplit(map[string]string{
+		annTrafficSplit:       `[{"service": "v2", "weight": 20}, {"service": "v3", "port": "alt", "weight": 10}]`,
+		annTrafficSplitSticky: "cookie:variant",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	counts := map[serviceKey]int{}
+	for i := 0; i < 10000; i++ {
+		r, _ := http.NewRequest("GET", "http://host/", nil)
+		key, cookie := ts.pick(primary, r)
+		counts[key]++
+		if cookie == nil || cookie.Value != key.name {
+			t.Fatalf("expected a cookie naming %s, got %v", key.name, cookie)
+		}
+
+		// the cookie should pin us to the same variant
+		r.AddCookie(cookie)
+		if again, c := ts.pick(primary, r); again != key || c != nil {
+			t.Fatalf("expected to stick to %v, got %v", key, again)
+		}
+	}
+
+	exp := map[serviceKey]int{
+		primary: 7000,
+		{namespace: "ns", name: "v2", portName: "http"}: 2000,
+		{namespace: "ns", name: "v3", portName: "alt"}:  1000,
+	}
+	for k, v := range exp {
+		if counts[k] < v*9/10 || counts[k] > v*11/10 {
+			t.Errorf("expected about %d requests to %v, got %d", v, k, counts[k])
+		}
+	}
+
+	// cookies for unknown variants are replaced
+	r, _ := http.NewRequest("GET", "http://host/", nil)
+	r.AddCookie(&http.Cookie{Name: "variant", Value: "v0"})
+	if _, cookie := ts.pick(primary, r); cookie == nil {
+		t.Errorf("expected an unknown variant cookie to be replaced")
+	}
+}
+
+func TestTrafficSplit_pickHeader(t *testing.T) {
+	primary := serviceKey{namespace: "ns", name: "v1"}
+	ts, err := parseTrafficSplit(map[string]string{
+		annTrafficSplit:       `[{"service": "v2", "weight": 50}]`,
+		annTrafficSplitSticky: "header:x-user",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		r, _ := http.NewRequest("GET", "http://host/", nil)
+		r.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		key, cookie := ts.pick(primary, r)
+		if cookie != nil {
+			t.Fatalf("did not expect a cookie")
+		}
+		for j := 0; j < 3; j++ {
+			if again, _ := ts.pick(primary, r); again != key {
+				t.Fatalf("user-%d moved from %v to %v", i, key, again)
+			}
+		}
+		counts[key.name]++
+	}
+	if counts["v1"] < 400 || counts["v2"] < 400 {
+		t.Errorf("poor spread between variants, %v", counts)
+	}
+}
+
+func TestTrafficSplit_checkBackends(t *testing.T) {
+	tests := []struct {
+		split    string
+		services []string
+		expErr   bool
+	}{
+		{split: `[{"service": "v2", "weight": 5}]`, services: []string{"v1", "v1"}},
+		{split: `[{"service": "v2", "weight": 5}]`, services: []string{"v1", "w1"}, expErr: true},
+		{split: `[{"backend": "v1", "service": "v2", "weight": 5}]`, services: []string{"v1", "w1"}},
+		{split: `[{"backend": "x1", "service": "v2", "weight": 5}]`, services: []string{"v1", "w1"}, expErr: true},
+	}
+
+	for i, st := range tests {
+		ts, err := parseTrafficSplit(map[string]string{annTrafficSplit: st.split})
+		if err != nil {
+			t.Fatalf("%d: unexpected error, %v", i, err)
+		}
+		if err := ts.checkBackends(st.services); (err != nil) != st.expErr {
+			t.Errorf("%d: unexpected error state, %v", i, err)
+		}
+	}
+}
+
+func TestTrafficSplit_rules(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	api, apiV2, web := backend("api"), backend("api-v2"), backend("web")
+	defer api.Close()
+	defer apiV2.Close()
+	defer web.Close()
+
+	svc := func(name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		}
+	}
+	eps := func(name, rawurl string) *corev1.Endpoints {
+		u, _ := url.Parse(rawurl)
+		port, _ := strconv.Atoi(u.Port())
+		return &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "http", Port: int32(port)}},
+				},
+			},
+		}
+	}
+	path := func(path, service string) networkingv1beta1.HTTPIngressPath {
+		return networkingv1beta1.HTTPIngressPath{
+			Path: path,
+			Backend: networkingv1beta1.IngressBackend{
+				ServiceName: service,
+				ServicePort: intstr.FromString("http"),
+			},
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "first",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+					annTrafficSplit:                      `[{"backend": "api", "service": "api-v2", "weight": 100}]`,
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									path("/api/*", "api"),
+									path("/web/*", "web"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		svc("api"),
+		svc("api-v2"),
+		svc("web"),
+		eps("api", api.URL),
+		eps("api-v2", apiV2.URL),
+		eps("web", web.URL),
+	)
+
+	ctrl, err := New(clientset)
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	get := func(path string) string {
+		req, _ := http.NewRequest("GET", pts.URL+path, nil)
+		req.Host = "blah"
+		resp, err := pts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// only the rule using the named backend is split
+	for i := 0; i < 10; i++ {
+		if got := get("/api/x"); got != "api-v2" {
+			t.Fatalf("expected /api to reach api-v2, got %q", got)
+		}
+		if got := get("/web/x"); got != "web" {
+			t.Fatalf("expected /web to reach web, got %q", got)
+		}
+	}
+}
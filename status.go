@@ -0,0 +1,345 @@
+package minke
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/klog/v2"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// annStatusOwner is set on the ingresses whose status we publish, so that
+// we can remove the addresses once we no longer claim them, even if they
+// have changed since, or were published by an earlier leader.
+var annStatusOwner = annPrefix + "status-owner"
+
+// statusUpdater publishes our load balancer addresses into the status of
+// the ingresses we claim. Ingresses are queued for update by every replica,
+// but only the leader writes the updates.
+type statusUpdater struct {
+	c       *Controller
+	queue   workqueue.RateLimitingInterface
+	retries int
+
+	service *svcKey
+	static  []corev1.LoadBalancerIngress
+	owner   string // value of annStatusOwner on ingresses we publish
+
+	mu       sync.RWMutex
+	known    bool // false until we have seen the status service
+	addrs    []corev1.LoadBalancerIngress
+	previous [][]corev1.LoadBalancerIngress // addresses we published before
+}
+
+// statusHistory is how many previous sets of addresses we remember, so that
+// we can remove them from ingresses we no longer claim.
+const statusHistory = 10
+
+// WithStatusService is an option for setting a Service, in the form of
+// NAMESPACE/NAME, whose load balancer addresses will be published in the
+// status of the ingresses we claim.
+func WithStatusService(str string) Option {
+	return func(c *Controller) error {
+		if str == "" {
+			return nil
+		}
+		parts := strings.SplitN(str, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("status service should be in the form of NAMESPACE/NAME")
+		}
+		c.statusService = &svcKey{namespace: parts[0], name: parts[1]}
+		return nil
+	}
+}
+
+// WithStatusAddresses is an option for setting static IP addresses or
+// hostnames to publish in the status of the ingresses we claim.
+func WithStatusAddresses(addrs ...string) Option {
+	return func(c *Controller) error {
+		for _, addr := range addrs {
+			if addr == "" {
+				continue
+			}
+			if net.ParseIP(addr) != nil {
+				c.statusAddresses = append(c.statusAddresses, corev1.LoadBalancerIngress{IP: addr})
+				continue
+			}
+			c.statusAddresses = append(c.statusAddresses, corev1.LoadBalancerIngress{Hostname: addr})
+		}
+		return nil
+	}
+}
+
+// MarshalJSON lets us report the addresses we are publishing
+func (u *statusUpdater) MarshalJSON() ([]byte, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return json.Marshal(u.addrs)
+}
+
+func (c *Controller) setupStatusProcess(ctx context.Context) error {
+	if c.statusService == nil && len(c.statusAddresses) == 0 {
+		return nil
+	}
+
+	sortLoadBalancerIngress(c.statusAddresses)
+	c.status = &statusUpdater{
+		c:       c,
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultItemBasedRateLimiter(), "status"),
+		retries: 5,
+		service: c.statusService,
+		static:  c.statusAddresses,
+		owner:   c.controllerName + "/" + c.class,
+		known:   c.statusService == nil,
+		addrs:   c.statusAddresses,
+	}
+
+	// Items queued while we were not the leader will have been dropped.
+	c.leader.addTask(func(ctx context.Context) {
+		c.status.enqueueAll()
+	})
+
+	return nil
+}
+
+// enqueue requests that the status for an ingress be brought up to date.
+func (u *statusUpdater) enqueue(key string) {
+	if u == nil {
+		return
+	}
+	u.queue.Add(key)
+}
+
+// enqueueAll requests that the status of every ingress be brought up
+// to date.
+func (u *statusUpdater) enqueueAll() {
+	if u == nil {
+		return
+	}
+	for _, key := range u.c.ingProc.informer.GetStore().ListKeys() {
+		u.queue.Add(key)
+	}
+}
+
+// serviceUpdated is called when a service changes, if it is the one we are
+// publishing the address of, we update all the ingresses.
+func (u *statusUpdater) serviceUpdated(svc *corev1.Service) {
+	if u == nil || u.service == nil {
+		return
+	}
+	if svc.Namespace != u.service.namespace || svc.Name != u.service.name {
+		return
+	}
+
+	addrs := append([]corev1.LoadBalancerIngress{}, u.static...)
+	addrs = append(addrs, svc.Status.LoadBalancer.Ingress...)
+	for _, ip := range svc.Spec.ExternalIPs {
+		addrs = append(addrs, corev1.LoadBalancerIngress{IP: ip})
+	}
+	sortLoadBalancerIngress(addrs)
+
+	u.mu.Lock()
+	changed := !reflect.DeepEqual(u.addrs, addrs)
+	if changed && len(u.addrs) > 0 {
+		u.previous = append(u.previous, u.addrs)
+		if len(u.previous) > statusHistory {
+			u.previous = u.previous[1:]
+		}
+	}
+	wasKnown := u.known
+	u.known = true
+	u.addrs = addrs
+	u.mu.Unlock()
+
+	if changed || !wasKnown {
+		klog.Infof("status addresses updated from service %s/%s", svc.Namespace, svc.Name)
+		u.enqueueAll()
+	}
+}
+
+// getAddrs returns the addresses to publish, and whether they are known
+// yet.
+func (u *statusUpdater) getAddrs() ([]corev1.LoadBalancerIngress, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.addrs, u.known
+}
+
+// published reports whether addrs is a set of addresses we are
+// publishing, or have published before.
+func (u *statusUpdater) published(addrs []corev1.LoadBalancerIngress) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if reflect.DeepEqual(addrs, u.addrs) {
+		return true
+	}
+	for _, prev := range u.previous {
+		if reflect.DeepEqual(addrs, prev) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortLoadBalancerIngress(addrs []corev1.LoadBalancerIngress) {
+	sort.Slice(addrs, func(i, j int) bool {
+		if addrs[i].IP != addrs[j].IP {
+			return addrs[i].IP < addrs[j].IP
+		}
+		return addrs[i].Hostname < addrs[j].Hostname
+	})
+}
+
+// run processes status updates until stopCh is closed. Updates are only
+// written if we are the leader.
+func (u *statusUpdater) run(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		u.queue.ShutDown()
+	}()
+
+	for u.processNextItem() {
+	}
+}
+
+func (u *statusUpdater) processNextItem() bool {
+	key, quit := u.queue.Get()
+	if quit {
+		return false
+	}
+	defer u.queue.Done(key)
+
+	err := u.processItem(key.(string))
+
+	if err == nil {
+		u.queue.Forget(key)
+	} else if u.queue.NumRequeues(key) < u.retries {
+		u.queue.AddRateLimited(key)
+	} else {
+		u.queue.Forget(key)
+		utilruntime.HandleError(err)
+	}
+
+	return true
+}
+
+func (u *statusUpdater) processItem(key string) error {
+	obj, exists, err := u.c.ingProc.informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return fmt.Errorf("failed calling the API, %w", err)
+	}
+	if !exists || !u.c.IsLeader() {
+		return nil
+	}
+
+	ing, err := toIngressV1(obj)
+	if err != nil {
+		return err
+	}
+
+	addrs, known := u.getAddrs()
+	if !known {
+		// We would clear the status of every ingress, only to publish
+		// it again once the service turns up. Everything is queued
+		// again when it does.
+		return nil
+	}
+
+	current := append([]corev1.LoadBalancerIngress{}, ing.Status.LoadBalancer.Ingress...)
+	sortLoadBalancerIngress(current)
+
+	_, ours := u.c.ourClass(ing)
+	owned := ing.Annotations[annStatusOwner] == u.owner
+
+	var want []corev1.LoadBalancerIngress
+	switch {
+	case ours:
+		want = addrs
+	case owned:
+		// We published the status, whatever it is now.
+	case len(current) == 0 || !u.published(current):
+		// Not ours, and not a status we published.
+		return nil
+	}
+
+	ctx := context.Background()
+
+	// The owner is recorded before the status is written, and removed
+	// after it is cleared, so that we never leave a status behind that
+	// we do not know to be ours.
+	if ours && !owned {
+		if obj, err = u.setOwner(ctx, obj, true); err != nil {
+			return fmt.Errorf("failed recording status owner of ingress %s, %w", key, err)
+		}
+	}
+
+	if (len(current) != 0 || len(want) != 0) && !reflect.DeepEqual(current, want) {
+		klog.Infof("updating status of ingress %s to %v", key, want)
+		if obj, err = u.setStatus(ctx, obj, want); err != nil {
+			return fmt.Errorf("failed updating status of ingress %s, %w", key, err)
+		}
+	}
+
+	if !ours && owned {
+		if _, err = u.setOwner(ctx, obj, false); err != nil {
+			return fmt.Errorf("failed removing status owner of ingress %s, %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// setOwner adds or removes our annStatusOwner annotation on an ingress,
+// returning the updated ingress.
+func (u *statusUpdater) setOwner(ctx context.Context, obj interface{}, owned bool) (interface{}, error) {
+	setAnn := func(meta *metav1.ObjectMeta) {
+		if !owned {
+			delete(meta.Annotations, annStatusOwner)
+			return
+		}
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[annStatusOwner] = u.owner
+	}
+
+	switch obj := obj.(type) {
+	case *networkingv1.Ingress:
+		ning := obj.DeepCopy()
+		setAnn(&ning.ObjectMeta)
+		return u.c.client.NetworkingV1().Ingresses(ning.Namespace).Update(ctx, ning, metav1.UpdateOptions{})
+	case *networkingv1beta1.Ingress:
+		ning := obj.DeepCopy()
+		setAnn(&ning.ObjectMeta)
+		return u.c.client.NetworkingV1beta1().Ingresses(ning.Namespace).Update(ctx, ning, metav1.UpdateOptions{})
+	}
+	return nil, fmt.Errorf("unexpected ingress type %T", obj)
+}
+
+// setStatus writes the load balancer addresses in the status of an ingress,
+// returning the updated ingress.
+func (u *statusUpdater) setStatus(ctx context.Context, obj interface{}, addrs []corev1.LoadBalancerIngress) (interface{}, error) {
+	switch obj := obj.(type) {
+	case *networkingv1.Ingress:
+		ning := obj.DeepCopy()
+		ning.Status.LoadBalancer.Ingress = addrs
+		return u.c.client.NetworkingV1().Ingresses(ning.Namespace).UpdateStatus(ctx, ning, metav1.UpdateOptions{})
+	case *networkingv1beta1.Ingress:
+		ning := obj.DeepCopy()
+		ning.Status.LoadBalancer.Ingress = addrs
+		return u.c.client.NetworkingV1beta1().Ingresses(ning.Namespace).UpdateStatus(ctx, ning, metav1.UpdateOptions{})
+	}
+	return nil, fmt.Errorf("unexpected ingress type %T", obj)
+}
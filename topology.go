@@ -0,0 +1,106 @@
+package minke
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annTopologyAware enables zone aware balancing, if set to "true" on an
+// Ingress or Service, endpoints in our own zone are preferred. A value set
+// on the Ingress, "true" or "false", overrides that of the Service.
+var annTopologyAware = annPrefix + "topology-aware"
+
+const (
+	zoneLabel       = "topology.kubernetes.io/zone"
+	legacyZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+
+	// zoneMinCapacity is the fraction of its fair share of endpoints that
+	// our zone must have before we stop sending traffic to other zones.
+	zoneMinCapacity = 0.5
+)
+
+// WithZone is an option for setting the topology zone minke is running in,
+// for use by zone aware balancing.
+func WithZone(zone string) Option {
+	return func(c *Controller) error {
+		c.zone = zone
+		return nil
+	}
+}
+
+// WithNodeName is an option for setting the name of the node minke is
+// running on. If no zone has been set, it is read from the topology labels
+// of the node.
+func WithNodeName(name string) Option {
+	return func(c *Controller) error {
+		c.nodeName = name
+		return nil
+	}
+}
+
+// lookupZone reads our zone from the labels of the node.
+func (c *Controller) lookupZone(ctx context.Context) (string, error) {
+	node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not read node %s, %w", c.nodeName, err)
+	}
+	if zone, ok := node.Labels[zoneLabel]; ok {
+		return zone, nil
+	}
+	return node.Labels[legacyZoneLabel], nil
+}
+
+// zoneBalancer passes only the endpoints in the local zone on to the
+// underlying balancer, unless the zone has too little capacity, in which
+// case all endpoints are used.
+type zoneBalancer struct {
+	zone string
+	balancer
+}
+
+// localAddrs returns the addresses in zone, or nil if the zone lacks the
+// capacity to take its share of traffic.
+func localAddrs(zone string, addrs []serviceAddr) []serviceAddr {
+	var local []serviceAddr
+	zones := map[string]struct{}{}
+	total, localTotal := 0, 0
+	for _, a := range addrs {
+		w := a.weight
+		if w <= 0 {
+			w = 1
+		}
+		zones[a.zone] = struct{}{}
+		total += w
+		if a.zone == zone {
+			local = append(local, a)
+			localTotal += w
+		}
+	}
+
+	if len(local) == 0 {
+		return nil
+	}
+
+	fairShare := float64(total) / float64(len(zones))
+	if float64(localTotal) < fairShare*zoneMinCapacity {
+		return nil
+	}
+
+	return local
+}
+
+func (b *zoneBalancer) update(addrs []serviceAddr) {
+	if local := localAddrs(b.zone, addrs); local != nil {
+		addrs = local
+	}
+	b.balancer.update(addrs)
+}
+
+func (b *zoneBalancer) acquire(addr serviceAddr) func() {
+	if a, ok := b.balancer.(acquirer); ok {
+		return a.acquire(addr)
+	}
+	return noop
+}
@@ -2,10 +2,126 @@ package minke
 
 import (
 	"net/http"
+	"strconv"
 
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv"
 	"go.opentelemetry.io/otel/trace"
 )
 
-func addInboundTracing(ot trace.Tracer, next http.Handler) http.Handler {
-	return next
+const tracingServerName = "minke"
+
+// defaultPropagator accepts and sends both W3C tracecontext and B3 headers.
+func defaultPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.B3{InjectEncoding: b3.B3MultipleHeader | b3.B3SingleHeader},
+	)
+}
+
+// WithPropagator is an option for setting how trace context is read from
+// requests and passed on to backends. The default supports W3C tracecontext
+// and B3.
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(c *Controller) error {
+		c.propagator = p
+		return nil
+	}
+}
+
+// addInboundTracing starts a server span for each request, continuing any
+// trace the client propagated.
+func addInboundTracing(ot trace.Tracer, prop propagation.TextMapPropagator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := prop.Extract(r.Context(), r.Header)
+		opts := []trace.SpanOption{
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.NetAttributesFromHTTPRequest("tcp", r)...),
+			trace.WithAttributes(semconv.EndUserAttributesFromHTTPRequest(r)...),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(tracingServerName, "", r)...),
+		}
+		ctx, span := ot.Start(ctx, "HTTP "+r.Method, opts...)
+		defer span.End()
+
+		sw := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(status))
+	})
+}
+
+// traceAttributes describes how the request was routed.
+func (st *requestState) traceAttributes() []label.KeyValue {
+	var attrs []label.KeyValue
+	if st.ingress != nil {
+		attrs = append(attrs, label.String("minke.ingress", st.ingress.namespace+"/"+st.ingress.name))
+	}
+	if st.rule != nil {
+		attrs = append(attrs,
+			label.String("minke.rule.host", st.rule.host),
+			label.String("minke.rule.path", st.rule.path),
+		)
+	}
+	if st.backend.name != "" {
+		attrs = append(attrs,
+			label.String("minke.backend.service", st.backend.namespace+"/"+st.backend.name),
+			label.String("minke.backend.port", st.backend.portName),
+		)
+	}
+	if st.variant != "" {
+		attrs = append(attrs, label.String("minke.split.variant", st.variant))
+	}
+	if st.endpoint.addr != "" {
+		attrs = append(attrs, label.String("minke.endpoint", st.endpoint.addr+":"+strconv.Itoa(st.endpoint.port)))
+		if st.endpoint.target != "" {
+			attrs = append(attrs, label.String("minke.endpoint.target", st.endpoint.target))
+		}
+	}
+	return attrs
+}
+
+// tracingTransport wraps upstream requests in a client span, and passes
+// the trace context on to the backend.
+type tracingTransport struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	base       http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	opts := []trace.SpanOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(r)...),
+	}
+	ctx, span := t.tracer.Start(r.Context(), "HTTP "+r.Method, opts...)
+	defer span.End()
+
+	r = r.WithContext(ctx)
+	r.Header = r.Header.Clone()
+	// Drop anything the client sent, so backends only see our span as the
+	// parent, whichever format they read.
+	for _, f := range t.propagator.Fields() {
+		r.Header.Del(f)
+	}
+	t.propagator.Inject(ctx, r.Header)
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(resp.StatusCode)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(resp.StatusCode))
+	return resp, nil
 }
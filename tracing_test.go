@@ -0,0 +1,188 @@
+package minke
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/sdk/export/trace/tracetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTracing(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	clientset := fake.NewSimpleClientset(
+		&networkingv1beta1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "traced",
+				Namespace: "default",
+				Annotations: map[string]string{
+					"kubernetes.io/ingress.class":        "minke",
+					"ingress.kubernetes.io/ssl-redirect": "false",
+				},
+			},
+			Spec: networkingv1beta1.IngressSpec{
+				Rules: []networkingv1beta1.IngressRule{
+					{
+						Host: "blah",
+						IngressRuleValue: networkingv1beta1.IngressRuleValue{
+							HTTP: &networkingv1beta1.HTTPIngressRuleValue{
+								Paths: []networkingv1beta1.HTTPIngressPath{
+									{
+										Backend: networkingv1beta1.IngressBackend{
+											ServiceName: "app",
+											ServicePort: intstr.FromString("http"),
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: 80}},
+			},
+		},
+		&corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: u.Hostname()}},
+					Ports:     []corev1.EndpointPort{{Name: "http", Port: int32(port)}},
+				},
+			},
+		},
+	)
+
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+
+	ctrl, err := New(clientset, WithTracer(tp.Tracer("minke")))
+	if err != nil {
+		t.Fatalf("error creating controller, err = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ctrl.Run(ctx.Done())
+	time.Sleep(1 * time.Second)
+
+	pts := httptest.NewServer(ctrl)
+	defer pts.Close()
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		trace   string
+		parent  string
+	}{
+		{
+			name:    "tracecontext",
+			headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			trace:   "4bf92f3577b34da6a3ce929d0e0e4736",
+			parent:  "00f067aa0ba902b7",
+		},
+		{
+			name:    "b3",
+			headers: map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"},
+			trace:   "80f198ee56343ba864fe8b2a57d3eff7",
+			parent:  "e457b5a2e4d86bd1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exp.Reset()
+
+			req, _ := http.NewRequest("GET", pts.URL+"/hello", nil)
+			req.Host = "blah"
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := pts.Client().Do(req)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %v", resp.StatusCode)
+			}
+			sent := <-headers
+
+			spans := exp.GetSpans()
+			if len(spans) != 2 {
+				t.Fatalf("expected 2 spans, got %d", len(spans))
+			}
+			// the client span ends first
+			client, server := spans[0], spans[1]
+
+			if server.SpanKind != trace.SpanKindServer {
+				t.Errorf("expected server span, got %v", server.SpanKind)
+			}
+			if client.SpanKind != trace.SpanKindClient {
+				t.Errorf("expected client span, got %v", client.SpanKind)
+			}
+			if got := server.SpanContext.TraceID.String(); got != tt.trace {
+				t.Errorf("expected trace %s, got %s", tt.trace, got)
+			}
+			if got := server.ParentSpanID.String(); got != tt.parent {
+				t.Errorf("expected parent %s, got %s", tt.parent, got)
+			}
+			if client.ParentSpanID != server.SpanContext.SpanID {
+				t.Errorf("client span is not a child of the server span")
+			}
+
+			attrs := map[label.Key]string{}
+			for _, kv := range server.Attributes {
+				attrs[kv.Key] = kv.Value.Emit()
+			}
+			expAttrs := map[label.Key]string{
+				"minke.ingress":         "default/traced",
+				"minke.rule.host":       "blah",
+				"minke.backend.service": "default/app",
+				"minke.endpoint":        u.Host,
+				"http.status_code":      "200",
+			}
+			for k, v := range expAttrs {
+				if attrs[k] != v {
+					t.Errorf("expected attribute %s=%q, got %q", k, v, attrs[k])
+				}
+			}
+
+			// the backend sees our client span as its parent, in both
+			// formats.
+			expParent := "00-" + tt.trace + "-" + client.SpanContext.SpanID.String() + "-01"
+			if got := sent.Get("traceparent"); got != expParent {
+				t.Errorf("expected traceparent %q, got %q", expParent, got)
+			}
+			if got := sent.Get("X-B3-Spanid"); got != client.SpanContext.SpanID.String() {
+				t.Errorf("expected b3 span id %q, got %q", client.SpanContext.SpanID, got)
+			}
+		})
+	}
+}